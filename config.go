@@ -0,0 +1,206 @@
+package main
+
+import (
+	"command-runner/schema"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/kingpin/v2"
+	"gopkg.in/yaml.v2"
+)
+
+// notSettings are the flags command-runner.yaml cannot set: those choosing the file and profile, and
+// kingpin's own
+var notSettings = map[string]bool{
+	"config": true, "profile": true, "help": true, "help-long": true, "help-man": true, "version": true,
+	"completion-bash": true, "completion-script-bash": true, "completion-script-zsh": true,
+}
+
+// runnerConfig is the command-runner.yaml in use, and settings where each flag's value came from
+var (
+	runnerConfig schema.RunnerConfig
+	settings     map[string]schema.ResolvedSetting
+)
+
+// settingFlags returns the flags that are settings, by name
+func settingFlags(app *kingpin.Application) map[string]*kingpin.FlagModel {
+	flags := map[string]*kingpin.FlagModel{}
+	for _, flag := range app.Model().Flags {
+		if !notSettings[flag.Name] {
+			flags[flag.Name] = flag
+		}
+	}
+	return flags
+}
+
+// bindSettingEnvVars lets every setting be given as a COMMAND_RUNNER_* environment variable
+func bindSettingEnvVars(app *kingpin.Application) {
+	for name := range settingFlags(app) {
+		app.GetFlag(name).Envar(schema.SettingEnvVar(name))
+	}
+}
+
+// applyRunnerConfig sets the flags that were given neither on the command line nor in the environment
+// from command-runner.yaml and its profile. Call it after kingpin.Parse.
+func applyRunnerConfig(app *kingpin.Application, args []string) error {
+	context, err := app.ParseContext(args)
+	if err != nil {
+		return err
+	}
+	given := map[string]bool{}
+	for _, element := range context.Elements {
+		if flag, ok := element.Clause.(*kingpin.FlagClause); ok {
+			given[flag.Model().Name] = true
+		}
+	}
+
+	required := given["config"] || os.Getenv(schema.SettingEnvVar("config")) != ""
+	if !required {
+		*runnerConfigPath = schema.RunnerConfigPath(*p4VarDir)
+	}
+	if runnerConfig, err = schema.LoadRunnerConfig(*runnerConfigPath, required); err != nil {
+		return err
+	}
+	flags := settingFlags(app)
+	names := make([]string, 0, len(flags))
+	for name := range flags {
+		names = append(names, name)
+	}
+	if settings, err = runnerConfig.Resolve(names, *profile, given); err != nil {
+		return fmt.Errorf("%s: %w", *runnerConfigPath, err)
+	}
+	for name, setting := range settings {
+		if setting.Source != schema.SourceFile && setting.Source != schema.SourceProfile {
+			continue
+		}
+		if err := flags[name].Value.Set(setting.Value); err != nil {
+			return fmt.Errorf("%s: invalid %s %q: %w", *runnerConfigPath, name, setting.Value, err)
+		}
+	}
+
+	// The config files are found in the SDP config directory unless given
+	if settings["p4-var-dir"].Source != schema.SourceDefault {
+		for name, file := range map[string]string{"cmdcfg": schema.CmdConfigYamlFile, "mcfg": ".push_metrics.cfg"} {
+			if settings[name].Source == schema.SourceDefault {
+				flags[name].Value.Set(filepath.Join(*p4VarDir, file))
+			}
+		}
+	}
+	schema.P4baseDir = *p4BaseDir
+	schema.P4VarDir = *p4VarDir
+	schema.AutobotsDir = *autobotsDir
+	return nil
+}
+
+// runShowConfig prints the effective configuration as YAML, each setting followed by where it came from,
+// with secrets masked
+func runShowConfig(app *kingpin.Application) {
+	profileName := *profile
+	if profileName == "" {
+		profileName = runnerConfig.Profile
+	}
+	fmt.Println("# Effective configuration. Precedence: flag > env (COMMAND_RUNNER_*) > file > profile > default")
+	fmt.Printf("config: %s\n", yamlScalar(*runnerConfigPath))
+	fmt.Printf("profile: %s\n", yamlScalar(profileName))
+	if err := runnerConfig.CheckRequired(*profile, settings); err != nil {
+		fmt.Printf("# %v\n", err)
+	}
+
+	flags := settingFlags(app)
+	names := make([]string, 0, len(flags))
+	for name := range flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Println("settings:")
+	for _, name := range names {
+		source := settings[name].Source
+		switch source {
+		case schema.SourceEnv:
+			source += " " + schema.SettingEnvVar(name)
+		case schema.SourceProfile:
+			source += " " + profileName
+		}
+		fmt.Printf("  %s: %s # %s\n", name, yamlScalar(schema.MaskSecret(name, flags[name].Value.String())), source)
+	}
+
+	fmt.Println("cmd_config:")
+	if err := schema.LoadCmdConfigDefaults(*DefaultCmdConfigYAMLPath); err != nil {
+		fmt.Printf("  # not loaded: %v\n", err)
+	} else if err := applyCmdConfigOverrides(); err != nil {
+		fmt.Printf("  # not applied: %v\n", err)
+	} else {
+		fmt.Printf("  default_timeout: %s\n", schema.CommandTimeout)
+		fmt.Printf("  max_parallel: %d\n", schema.MaxParallel)
+		sinks := make([]schema.SinkConfig, len(schema.Sinks))
+		for i, sink := range schema.Sinks {
+			sinks[i] = sink
+			sinks[i].URL = schema.MaskSecret("url", sink.URL)
+			if sink.Headers != nil {
+				sinks[i].Headers = map[string]string{}
+				for key, value := range sink.Headers {
+					sinks[i].Headers[key] = schema.MaskSecret(key, value)
+				}
+			}
+		}
+		if len(sinks) > 0 {
+			out, _ := yaml.Marshal(map[string][]schema.SinkConfig{"sinks": sinks})
+			for _, line := range strings.Split(strings.TrimSuffix(string(out), "\n"), "\n") {
+				fmt.Println("  " + line)
+			}
+		}
+	}
+
+	fmt.Println("metrics_config:")
+	values, err := schema.ReadMetricsConfigValues(*MetricsConfigFile)
+	if err != nil {
+		fmt.Printf("  # not loaded: %v\n", err)
+		return
+	}
+	if os.Getenv(schema.EnvMetricsPasswd) != "" {
+		values["metrics_passwd"] = os.Getenv(schema.EnvMetricsPasswd)
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("  %s: %s\n", key, yamlScalar(schema.MaskSecret(key, values[key])))
+	}
+}
+
+// applyCmdConfigOverrides applies the flags overriding settings of cmd_config.yaml, and the sinks of
+// command-runner.yaml, once cmd_config.yaml is loaded
+func applyCmdConfigOverrides() error {
+	if *maxParallel > 0 {
+		schema.MaxParallel = *maxParallel
+	}
+	if *defaultTimeout != "" {
+		timeout, err := schema.ParseTimeout(*defaultTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid --default-timeout: %w", err)
+		}
+		schema.CommandTimeout = timeout
+	}
+	if len(runnerConfig.Sinks) > 0 {
+		schema.Sinks = runnerConfig.Sinks
+	}
+	return nil
+}
+
+// yamlScalar formats a value for YAML output, leaving booleans and numbers unquoted
+func yamlScalar(value string) string {
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return value
+	}
+	if _, err := strconv.ParseBool(value); err == nil {
+		return value
+	}
+	out, _ := yaml.Marshal(value)
+	return strings.TrimSuffix(string(out), "\n")
+}
@@ -3,9 +3,11 @@ module command-runner
 go 1.18
 
 require (
+	github.com/klauspost/compress v1.17.0
 	github.com/perforce/p4prometheus v0.7.6
 	github.com/sirupsen/logrus v1.9.3
 	gopkg.in/yaml.v2 v2.4.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -13,7 +15,6 @@ require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/xhit/go-str2duration/v2 v2.1.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
 
 require (
@@ -0,0 +1,61 @@
+package helpers
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic writes data to a temporary file next to path and renames it into place, so readers
+// never see a partially written file. The file ends up with the given permissions.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	return CopyFileAtomic(path, bytes.NewReader(data), perm)
+}
+
+// CopyFileAtomic is WriteFileAtomic for data read from r, which is copied without holding it in memory
+func CopyFileAtomic(path string, r io.Reader, perm os.FileMode) error {
+	tmp, err := CreateTempFor(path, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	return CommitTemp(tmp, path)
+}
+
+// CreateTempFor creates a temporary file in the same directory as path (so it can be renamed over it)
+// with the given permissions.
+func CreateTempFor(path string, perm os.FileMode) (*os.File, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return tmp, nil
+}
+
+// CommitTemp syncs and closes a file from CreateTempFor and renames it to path
+func CommitTemp(tmp *os.File, path string) error {
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+
+package helpers
+
+import (
+	"os"
+	"syscall"
+)
+
+// ChownLike gives f the owner and group of the file described by fi, so a file replaced by a rename
+// keeps its ownership. Nothing is changed when they already match.
+func ChownLike(f *os.File, fi os.FileInfo) error {
+	want, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	current, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if have, ok := current.Sys().(*syscall.Stat_t); ok && have.Uid == want.Uid && have.Gid == want.Gid {
+		return nil
+	}
+	return f.Chown(int(want.Uid), int(want.Gid))
+}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package helpers
+
+import "os"
+
+// ChownLike is not available on Windows, where a new file takes its owner from the directory
+func ChownLike(f *os.File, fi os.FileInfo) error {
+	return nil
+}
@@ -7,7 +7,11 @@ import (
 	"command-runner/schema"
 	"command-runner/tools"
 
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"strings"
 
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/perforce/p4prometheus/version"
@@ -17,7 +21,7 @@ import (
 var (
 	//	autobotsArg             = kingpin.Flag("autobots", "Enable running autobots scripts").Short('a').Bool() // TODO [TEMP]  removed short tor safty
 	debug                   = kingpin.Flag("debug", "Enable debug logging").Short('d').Bool()
-	cloudProvider           = kingpin.Flag("cloud", "Cloud provider (aws, gcp, azure, or onprem)").Short('c').Default("onprem").String()
+	cloudProvider           = kingpin.Flag("cloud", "Cloud provider (aws, gcp, azure, oracle, or onprem)").Short('c').Default("onprem").String()
 	instanceArg             = kingpin.Flag("instance", "SDP instance commands argument for the command-runner").Short('i').String()                        //TODO [TEMP] .Required()
 	ProccessAllSDPinstances = kingpin.Flag("allSDP", "Run on all SDP instances commands argument for the command-runner").Default("false").Hidden().Bool() //TODO [TEMP] Hidden for safety
 	serverArg               = kingpin.Flag("server", "OS commands argument for the command-runner").Short('s').Bool()                                      //TODO [TEMP].Required()
@@ -26,25 +30,52 @@ var (
 	MainLogFilePath         = kingpin.Flag("log", "Path to the write the log file").Short('l').Default(schema.MainLogFilePath).String()                    //[TEMP] .Required()
 	OutputJSONFilePath      = kingpin.Flag("output", "Path to the output JSON file").Short('o').Default(schema.OutputJSONFilePath).String()
 	MetricsConfigFile       = kingpin.Flag("mcfg", "Path to the metrics configuration file").Default(schema.MetricsConfigFile).Short('m').String()
-	Vars2SourceFilePath     = kingpin.Flag("vars", "Path to the metrics configuration file").Default(schema.Vars2SourceFilePath).String()
+	Vars2SourceFilePath     = kingpin.Flag("vars", "Path to the SDP vars file to source (default: /p4/common/config/p4_<instance>.vars)").String()
+	maxParallel             = kingpin.Flag("parallel", "Maximum number of commands and SDP instances to run at once (overrides max_parallel in cmd_config.yaml)").Short('p').Int()
 	//CmdConfigYAMLPath       = kingpin.Flag("cmdcfg", "Path to the cmd_config.yaml file").Default(schema.DefaultCmdConfigYAMLPath).Short('y').String()
 	DefaultCmdConfigYAMLPath = kingpin.Flag("cmdcfg", "Path to the cmd_config.yaml file").Default(schema.DefaultCmdConfigYAMLPath).Short('y').String()
 	nodelOut                 = kingpin.Flag("nodel", "Delete json data after running [default: true]").Default("false").Bool()
-	//TODO Should be editable autobotsdir
+	ndjsonOutput             = kingpin.Flag("ndjson", "Stream results to the output file as NDJSON instead of holding them in memory (for very large payloads)").Bool()
+	legacyOutput             = kingpin.Flag("legacy-output", "Write the results as the legacy flat JSON array for older datapushgateway receivers").Bool()
+	spoolDir                 = kingpin.Flag("spool-dir", "Directory for payloads that failed to push, replayed on later runs (empty disables spooling)").Default(schema.DefaultSpoolDir).String()
+	spoolMaxSize             = kingpin.Flag("spool-max-size", "Maximum total size of the spool directory in MB").Default("100").Int64()
+	spoolMaxAge              = kingpin.Flag("spool-max-age", "Spooled payloads older than this are discarded").Default("72h").Duration()
+	stateDir                 = kingpin.Flag("state-dir", "Directory for state kept between runs, such as the offsets of files parsed in tail mode").Default(schema.DefaultStateDir).String()
+	p4BaseDir                = kingpin.Flag("p4-base-dir", "Directory holding the SDP instances").Default(schema.DefaultP4BaseDir).String()
+	p4VarDir                 = kingpin.Flag("p4-var-dir", "Directory holding the SDP p4_<instance>.vars files, and by default cmd_config.yaml and .push_metrics.cfg").Default(schema.DefaultP4VarDir).String()
+	autobotsDir              = kingpin.Flag("autobots-dir", "Directory holding the autobots scripts").Default(schema.AutobotsDir).String()
+	defaultTimeout           = kingpin.Flag("default-timeout", "Maximum time a command or autobot may run, as a duration or seconds (overrides default_timeout in cmd_config.yaml)").String()
+	runnerConfigPath         = kingpin.Flag("config", "Path to command-runner.yaml, holding any of these flags as settings (optional in --p4-var-dir, where it is looked for by default)").Default(schema.DefaultRunnerConfigPath).Envar("COMMAND_RUNNER_CONFIG").String()
+	profile                  = kingpin.Flag("profile", "Settings profile: minimal, full-support or one defined in command-runner.yaml (overrides profile in the file)").Envar("COMMAND_RUNNER_PROFILE").String()
+	cloudCacheTTL            = kingpin.Flag("cloud-cache-ttl", "How long --autocloud reuses the cloud provider it detected (0 detects on every run)").Default(schema.DefaultCloudCacheTTL.String()).Duration()
+
+	runCmd   = kingpin.Command("run", "Collect results and push them to the datapushgateway (default)").Default()
+	flushCmd = kingpin.Command("flush", "Replay payloads spooled by earlier runs to the datapushgateway and exit")
+	// validate only checks the file given by --cmdcfg, exiting non-zero on any problem for use in CI
+	validateCmd = kingpin.Command("validate", "Check cmd_config.yaml (--cmdcfg) and report every problem with its line and column")
+	// show-config prints the settings merged from flags, environment, command-runner.yaml and defaults
+	showConfigCmd = kingpin.Command("show-config", "Print the effective configuration and where each setting came from, with secrets masked")
 )
 
 func validateFlags() bool {
-	return isValidProvider() && isValidFlag()
+	return isValidProvider() && isValidProfile() && isValidFlag()
+}
+
+// isValidProfile checks that the settings the profile needs but cannot set itself are given
+func isValidProfile() bool {
+	if err := runnerConfig.CheckRequired(*profile, settings); err != nil {
+		logrus.Error(err)
+		return false
+	}
+	return true
 }
 
 func isValidProvider() bool {
-	switch *cloudProvider {
-	case "aws", "gcp", "azure", "onprem":
-		return true
-	default:
-		logrus.Errorf("Invalid cloud provider '%s'. Please specify one of ['aws', 'gcp', 'azure', 'onprem'].", *cloudProvider)
+	if !schema.IsValidCloudProvider(*cloudProvider) {
+		logrus.Errorf("Invalid cloud provider '%s'. Please specify one of %s.", *cloudProvider, strings.Join(schema.CloudProviders, ", "))
 		return false
 	}
+	return true
 }
 func GetDefaultCmdConfigYAMLPath() string {
 	return *DefaultCmdConfigYAMLPath
@@ -92,27 +123,85 @@ func isValidFlag() bool {
 		logrus.Error("At least one valid flag must be provided.")
 		return false
 	}
-	// If --var is set, set schema.CustomSourceVars to true
-	if *Vars2SourceFilePath != schema.Vars2SourceFilePath {
-		schema.CustomSourceVars = true
-		schema.Vars2SourceFilePath = *Vars2SourceFilePath
+	// If --vars is set, every instance sources that file instead of its own p4_<instance>.vars
+	if *Vars2SourceFilePath != "" {
+		schema.CustomVarsFilePath = *Vars2SourceFilePath
+	}
+	if *maxParallel < 0 {
+		logrus.Error("The 'parallel' flag must not be negative.")
+		return false
 	}
 	return true
 }
 
+// runFlush replays spooled payloads for the flush subcommand
+func runFlush(spool *tools.Spool) {
+	if spool == nil {
+		logrus.Fatal("Nothing to flush: spooling is disabled (empty --spool-dir)")
+	}
+	if err := tools.FlushSpool(*MetricsConfigFile, spool); err != nil {
+		logrus.Fatal("Error flushing spooled payloads: ", err)
+	}
+	logrus.Info("Spool flushed.")
+}
+
+// runValidate reports every problem in the cmd_config.yaml file for the validate subcommand
+func runValidate() {
+	problems, err := schema.LintCmdConfigYAML(*DefaultCmdConfigYAMLPath)
+	if err != nil {
+		logrus.Fatalf("Error reading %s: %v", *DefaultCmdConfigYAMLPath, err)
+	}
+	for _, problem := range problems {
+		position := *DefaultCmdConfigYAMLPath
+		if problem.Line > 0 {
+			position = fmt.Sprintf("%s:%d:%d", position, problem.Line, problem.Column)
+		}
+		fmt.Printf("%s: %s\n", position, problem.Message)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%d problem(s) found in %s\n", len(problems), *DefaultCmdConfigYAMLPath)
+		os.Exit(1)
+	}
+	fmt.Printf("%s is valid\n", *DefaultCmdConfigYAMLPath)
+}
+
 func main() {
 
 	kingpin.UsageTemplate(kingpin.CompactUsageTemplate).Version(version.Print("command-runner")).Author("Will Kreitzmann")
 	kingpin.CommandLine.Help = "Runs a configurable set of commands and collects and reports the results as JSON for server/system monitoring\n"
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	bindSettingEnvVars(kingpin.CommandLine)
+	command := kingpin.Parse()
+	if err := applyRunnerConfig(kingpin.CommandLine, os.Args[1:]); err != nil {
+		kingpin.Fatalf("%v", err)
+	}
+	if command == showConfigCmd.FullCommand() {
+		runShowConfig(kingpin.CommandLine)
+		return
+	}
 	// Setting up the logger
 	helpers.SetupLogger(*debug, *MainLogFilePath)
 
+	if command == validateCmd.FullCommand() {
+		runValidate()
+		return
+	}
+
 	if !schema.IsCommandRunnerEnabled(*MetricsConfigFile) {
 		logrus.Info("Command-runner is disabled as per the metrics config file.")
 		return
 	}
+	spool := tools.NewSpool(*spoolDir, *spoolMaxSize*1024*1024, *spoolMaxAge)
+	schema.StateDir = *stateDir
+	schema.CloudCacheTTL = *cloudCacheTTL
+
+	switch command {
+	case flushCmd.FullCommand():
+		runFlush(spool)
+		return
+	case runCmd.FullCommand():
+		// Collect and push, below
+	}
 	*cloudProvider = schema.FetchOrDetermineCloudProvider(*autoCloudFlag, *cloudProvider, *MetricsConfigFile)
 
 	//logrus.Infof("Parsed Flags: cloudProvider=%s, instanceArg=%s, serverArg=%v", *cloudProvider, *instanceArg, *serverArg)
@@ -126,49 +215,69 @@ func main() {
 	//tools.GetVars(*DefaultCmdConfigYAMLPath)
 	schema.SendVars(*DefaultCmdConfigYAMLPath, *MetricsConfigFile)
 
-	schema.SetInstanceArg(*instanceArg) //TODO This will need to be part of a loop when allSDP happens or...?
-
 	//exeDir := schema.GetExecutableDir()                                             //TODO MOVE THIS
 	//schema.YamlCmdConfigFilePath = schema.GetConfigPath(exeDir, *CmdConfigYAMLPath) //TODO FIX THIS
 	// Validate the CmdConfig.yaml file
 	if err := schema.ValidateCmdConfigYAML(*DefaultCmdConfigYAMLPath); err != nil {
 		logrus.Fatal("Error validating cmd_config.yaml:", err)
 	}
+	if err := schema.LoadCmdConfigDefaults(*DefaultCmdConfigYAMLPath); err != nil {
+		logrus.Fatal("Error loading cmd_config.yaml settings:", err)
+	}
+	if err := applyCmdConfigOverrides(); err != nil {
+		logrus.Fatal("Error applying settings:", err)
+	}
+	tools.SetExecSlots(schema.MaxParallel)
+	scrubber, err := tools.NewScrubber(schema.Redactions, schema.BuiltinRedactions)
+	if err != nil {
+		logrus.Fatal("Error loading redactions from cmd_config.yaml:", err)
+	}
+	tools.SetScrubber(scrubber)
 
-	if *serverArg {
-		// If autoCloudFlag is enabled, detect the cloud provider
-		if *autoCloudFlag {
-			detectedCloudProvider, err := tools.DetectCloudProvider()
-			if err != nil {
-				logrus.Fatal("Error detecting cloud provider:", err)
-			}
+	// If autoCloudFlag is enabled, detect the cloud provider
+	if *serverArg && *autoCloudFlag {
+		detectedCloudProvider, err := tools.DetectCloudProviderCached()
+		if err != nil {
+			logrus.Fatal("Error detecting cloud provider:", err)
+		}
 
-			// Update cloudProvider variable with the detected value
-			*cloudProvider = detectedCloudProvider
+		// Update cloudProvider variable with the detected value
+		*cloudProvider = detectedCloudProvider
 
-			// Update the metrics config with the detected cloud provider
-			if err := schema.UpdateMetricsConfig(detectedCloudProvider); err != nil {
-				logrus.Fatal("Error updating metrics configuration:", err)
-			}
+		// Record the detected cloud provider in the metrics config, which is only rewritten when it changed
+		if err := schema.UpdateMetricsConfig(detectedCloudProvider); err != nil {
+			logrus.Fatal("Error updating metrics configuration:", err)
 		}
+	}
+
+	// Every handler adds its results to the collector, which is written out once at the end
+	collector := tools.NewCollector()
+	if *ndjsonOutput {
+		var err error
+		if collector, err = tools.NewStreamingCollector(*OutputJSONFilePath, *cloudProvider, *legacyOutput); err != nil {
+			logrus.Fatal("Error creating NDJSON output:", err)
+		}
+	}
+
+	if *serverArg {
 		// Handle server logic here
-		if err := tools.HandleOsCommands(*cloudProvider, *OutputJSONFilePath); err != nil {
+		if err := tools.HandleOsCommands(*cloudProvider, collector); err != nil {
 			logrus.Fatal("Error handling OS commands:", err)
 		}
 		if *autobotsArg {
 			logrus.Infof("Running P4 SDP autobots...")
-			tools.HandleOSAutobotsScripts(*OutputJSONFilePath, "") //TODO Look at blank
+			tools.HandleOSAutobotsScripts(collector, "") //TODO Look at blank
 		}
 		//TODO this doesn't needd to happen ever time does it?
 		tools.FindP4D()
 		if tools.P4dInstalled {
 			// Do something if p4d is installed
 			if *ProccessAllSDPinstances {
-				if err := tools.GetSDPInstances(*OutputJSONFilePath, *autobotsArg, true, *debug); err != nil {
+				if err := tools.GetSDPInstances(collector, *autobotsArg, true, *debug); err != nil {
 					logrus.Fatal("Error handling SDP instances:", err)
 				}
 			} else { // *allSDPinstances is false
-				if err := tools.GetSDPInstances(*OutputJSONFilePath, *autobotsArg, false, *debug); err != nil {
+				if err := tools.GetSDPInstances(collector, *autobotsArg, false, *debug); err != nil {
 					logrus.Fatal("Error handling SDP instances:", err)
 				}
 			}
@@ -180,12 +289,45 @@ func main() {
 
 	// Lets party for --instance=
 	if *instanceArg != "" {
-		if err := tools.HandleSDPInstance(*OutputJSONFilePath, *instanceArg, *autobotsArg, *debug); err != nil {
+		if err := tools.HandleSDPInstance(collector, *instanceArg, *autobotsArg, *debug); err != nil {
 			logrus.Fatal("Error handling P4 commands:", err)
 		}
 	}
-	if err := tools.PushToDataPushGateway(*OutputJSONFilePath, *MetricsConfigFile); err != nil {
-		logrus.Fatal("Error Pushing to Data Push Gateway", err) //TODO this is possible not the right message
+	if err := collector.WriteFile(*OutputJSONFilePath, *cloudProvider, *legacyOutput); err != nil {
+		logrus.Fatal("Error writing output JSON:", err)
+	}
+	contentType := tools.ContentTypeJSON
+	if *ndjsonOutput {
+		contentType = tools.ContentTypeNDJSON
+	}
+	sinks, err := tools.NewSinks(schema.Sinks, *MetricsConfigFile, spool, contentType)
+	if err != nil {
+		logrus.Fatal("Error setting up output sinks:", err)
+	}
+	output, err := os.Open(*OutputJSONFilePath)
+	if err != nil {
+		logrus.Fatal("Error reading output JSON:", err)
+	}
+	info, err := output.Stat()
+	if err != nil {
+		logrus.Fatal("Error reading output JSON:", err)
+	}
+	results := tools.SendToSinks(sinks, io.NewSectionReader(output, 0, info.Size()))
+	output.Close()
+	sinksFailed := false
+	for _, result := range results {
+		if errors.Is(result.Err, tools.ErrPayloadSpooled) {
+			// The payload is safe in the spool and will be sent by a later run
+			logrus.Warnf("Output sink %s unavailable, payload spooled", result.Name)
+		} else if result.Err != nil {
+			sinksFailed = true
+		}
+	}
+	if sinksFailed {
+		logrus.Fatalf("One or more output sinks failed, keeping %s", *OutputJSONFilePath)
+	}
+	if err := tools.SaveTailOffsets(); err != nil {
+		logrus.Error(err)
 	}
 
 	if !*nodelOut {
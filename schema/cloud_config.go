@@ -0,0 +1,82 @@
+package schema
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Default base URLs of the cloud instance metadata services
+const (
+	DefaultAWSMetadataEndpoint   = "http://169.254.169.254"
+	DefaultGCPMetadataEndpoint   = "http://metadata.google.internal"
+	DefaultAzureMetadataEndpoint = "http://169.254.169.254"
+)
+
+// CloudProviders are the values --cloud and metrics_cloudtype accept. oracle is only detected, by
+// --autocloud, and no instance metadata is collected for it.
+var CloudProviders = []string{"aws", "gcp", "azure", "oracle", "onprem"}
+
+// IsValidCloudProvider reports whether provider is one of CloudProviders
+func IsValidCloudProvider(provider string) bool {
+	for _, p := range CloudProviders {
+		if p == provider {
+			return true
+		}
+	}
+	return false
+}
+
+// Environment variables overriding the metadata endpoints, e.g. to go through a proxy or reach a test server
+const (
+	EnvAWSMetadataEndpoint   = "COMMAND_RUNNER_AWS_METADATA_URL"
+	EnvGCPMetadataEndpoint   = "COMMAND_RUNNER_GCP_METADATA_URL"
+	EnvAzureMetadataEndpoint = "COMMAND_RUNNER_AZURE_METADATA_URL"
+)
+
+// Base URLs the cloud metadata requests are sent to. Overridden by cloud_metadata in cmd_config.yaml,
+// which the environment variables above override in turn.
+var (
+	AWSMetadataEndpoint   = DefaultAWSMetadataEndpoint
+	GCPMetadataEndpoint   = DefaultGCPMetadataEndpoint
+	AzureMetadataEndpoint = DefaultAzureMetadataEndpoint
+)
+
+// CloudMetadataConfig is cloud_metadata in cmd_config.yaml
+type CloudMetadataConfig struct {
+	AWS   string `yaml:"aws"`
+	GCP   string `yaml:"gcp"`
+	Azure string `yaml:"azure"`
+}
+
+// loadCloudMetadataEndpoints sets the metadata endpoints from cloud_metadata and the environment
+func loadCloudMetadataEndpoints(config CloudMetadataConfig) error {
+	endpoints := []struct {
+		name     string
+		endpoint *string
+		value    string
+		env      string
+	}{
+		{"aws", &AWSMetadataEndpoint, config.AWS, EnvAWSMetadataEndpoint},
+		{"gcp", &GCPMetadataEndpoint, config.GCP, EnvGCPMetadataEndpoint},
+		{"azure", &AzureMetadataEndpoint, config.Azure, EnvAzureMetadataEndpoint},
+	}
+	for _, e := range endpoints {
+		value := e.value
+		if env := os.Getenv(e.env); env != "" {
+			logrus.Infof("Using %s metadata endpoint %s from %s", e.name, env, e.env)
+			value = env
+		}
+		if value == "" {
+			continue
+		}
+		u, err := url.Parse(value)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid %s metadata endpoint %q: expecting a URL such as %s", e.name, value, DefaultAWSMetadataEndpoint)
+		}
+		*e.endpoint = value
+	}
+	return nil
+}
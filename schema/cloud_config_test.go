@@ -0,0 +1,52 @@
+package schema
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadCloudMetadataEndpoints(t *testing.T) {
+	aws, gcp, azure := AWSMetadataEndpoint, GCPMetadataEndpoint, AzureMetadataEndpoint
+	t.Cleanup(func() { AWSMetadataEndpoint, GCPMetadataEndpoint, AzureMetadataEndpoint = aws, gcp, azure })
+
+	t.Setenv(EnvGCPMetadataEndpoint, "http://127.0.0.1:8081")
+	err := loadCloudMetadataEndpoints(CloudMetadataConfig{AWS: "http://imds-proxy:8080", GCP: "http://ignored"})
+	assert.NoError(t, err)
+	assert.Equal(t, "http://imds-proxy:8080", AWSMetadataEndpoint)
+	assert.Equal(t, "http://127.0.0.1:8081", GCPMetadataEndpoint, "the environment overrides cmd_config.yaml")
+	assert.Equal(t, DefaultAzureMetadataEndpoint, AzureMetadataEndpoint)
+
+	assert.Error(t, loadCloudMetadataEndpoints(CloudMetadataConfig{Azure: "169.254.169.254"}))
+}
+
+func TestPersistedCloudProviderIsValid(t *testing.T) {
+	saved := MetricsConfigFile
+	t.Cleanup(func() { MetricsConfigFile = saved })
+	MetricsConfigFile = writeMetricsConfig(t, "enabled=1\n"+minimalMetricsConfig)
+
+	// What --autocloud records must be accepted by the --cloud validation of later runs
+	for _, provider := range []string{"aws", "gcp", "azure", "oracle", "onprem"} {
+		t.Run(provider, func(t *testing.T) {
+			assert.NoError(t, UpdateMetricsConfig(provider))
+			got := FetchOrDetermineCloudProvider(false, "onprem", MetricsConfigFile)
+			assert.Equal(t, provider, got)
+			assert.True(t, IsValidCloudProvider(got))
+		})
+	}
+	assert.False(t, IsValidCloudProvider("ibm"))
+}
+
+func TestAutoCloudIgnoresPersistedCloudProvider(t *testing.T) {
+	saved := MetricsConfigFile
+	t.Cleanup(func() { MetricsConfigFile = saved })
+	MetricsConfigFile = writeMetricsConfig(t, "enabled=1\n"+minimalMetricsConfig)
+
+	// Two --autocloud runs against the same metrics config: the second must still see the --cloud default,
+	// which is all --autocloud accepts, rather than what the first run recorded
+	for run := 1; run <= 2; run++ {
+		assert.Equal(t, "onprem", FetchOrDetermineCloudProvider(true, "onprem", MetricsConfigFile), "run %d", run)
+		assert.NoError(t, UpdateMetricsConfig("aws"))
+	}
+	assert.Equal(t, "aws", FetchOrDetermineCloudProvider(false, "onprem", MetricsConfigFile), "used without --autocloud")
+}
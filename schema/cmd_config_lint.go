@@ -0,0 +1,534 @@
+package schema
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ValidationError is one problem found in cmd_config.yaml. Line and Column are 1 based, 0 when unknown.
+// Strict problems (unknown keys, duplicate monitor tags) do not stop a run but fail the validate command.
+type ValidationError struct {
+	Line    int
+	Column  int
+	Message string
+	Strict  bool
+}
+
+func (e ValidationError) Error() string {
+	if e.Line == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Message)
+}
+
+// ValidationErrors is every problem found in a file, in document order
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, v := range e {
+		msgs[i] = v.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+type fieldKind int
+
+const (
+	kindScalar      fieldKind = iota // Any scalar, decoded into a string field
+	kindText                         // A YAML string, other scalar types are dropped by FileConfig.UnmarshalYAML
+	kindBool                         // A YAML boolean
+	kindInt                          // A YAML integer
+	kindTimeout                      // A duration string or a number of seconds
+	kindTextList                     // A sequence of scalars
+	kindTextOrList                   // A single string or a sequence of scalars
+	kindTextMap                      // A mapping of scalars
+	kindRegexList                    // A sequence of regular expressions
+	kindGlobList                     // A sequence of file name patterns
+	kindCommandList                  // A sequence of commands
+	kindFileList                     // A sequence of file parser entries
+	kindSinkList                     // A sequence of output sinks
+)
+
+// Keys accepted in each part of cmd_config.yaml
+var (
+	cmdConfigKeys = map[string]fieldKind{
+		"files":                      kindFileList,
+		"p4_commands":                kindCommandList,
+		"os_commands":                kindCommandList,
+		"default_timeout":            kindTimeout,
+		"max_parallel":               kindInt,
+		"sinks":                      kindSinkList,
+		"redactions":                 kindRegexList,
+		"disable_builtin_redactions": kindBool,
+		"cloud_metadata":             kindTextMap,
+	}
+	cloudMetadataKeys = map[string]fieldKind{
+		"aws":   kindText,
+		"gcp":   kindText,
+		"azure": kindText,
+	}
+	commandKeys = map[string]fieldKind{
+		"description": kindScalar,
+		"command":     kindScalar,
+		"monitor_tag": kindScalar,
+		"timeout":     kindTimeout,
+	}
+	fileKeys = map[string]fieldKind{
+		"pathtofile":           kindText,
+		"monitor_tag":          kindText,
+		"parseAll":             kindBool,
+		"parsingLevel":         kindText,
+		"sanitizationKeywords": kindTextList,
+		"keywords":             kindTextOrList,
+		"regexKeywords":        kindRegexList,
+		"redactions":           kindRegexList,
+		"mode":                 kindText,
+		"max_bytes":            kindInt,
+		"max_lines":            kindInt,
+		"before":               kindInt,
+		"after":                kindInt,
+		"max_matches":          kindInt,
+		"keep":                 kindText,
+		"include":              kindGlobList,
+		"exclude":              kindGlobList,
+		"max_files":            kindInt,
+		"max_depth":            kindInt,
+		"format":               kindText,
+		"select":               kindTextList,
+		"collect":              kindText,
+	}
+	sinkKeys = map[string]fieldKind{
+		"type":    kindScalar,
+		"name":    kindScalar,
+		"path":    kindScalar,
+		"url":     kindScalar,
+		"method":  kindScalar,
+		"headers": kindTextMap,
+		"timeout": kindTimeout,
+		"network": kindScalar,
+		"address": kindScalar,
+		"tag":     kindScalar,
+	}
+)
+
+// yaml.v2, which loads the config at run time, also accepts these unquoted words as booleans
+var yamlV2Bools = map[string]bool{
+	"y": true, "Y": true, "yes": true, "Yes": true, "YES": true, "on": true, "On": true, "ON": true,
+	"n": true, "N": true, "no": true, "No": true, "NO": true, "off": true, "Off": true, "OFF": true,
+}
+
+// LintCmdConfigYAML checks cmd_config.yaml and returns every problem found, with its position.
+// The error is only set when the file cannot be read.
+func LintCmdConfigYAML(filePath string) (ValidationErrors, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return ValidationErrors{{Message: fmt.Sprintf("error parsing YAML: %v", err)}}, nil
+	}
+
+	l := &cmdConfigLinter{}
+	if len(doc.Content) > 0 {
+		l.lintRoot(doc.Content[0])
+	}
+	sort.SliceStable(l.errs, func(i, j int) bool {
+		if l.errs[i].Line != l.errs[j].Line {
+			return l.errs[i].Line < l.errs[j].Line
+		}
+		return l.errs[i].Column < l.errs[j].Column
+	})
+	return l.errs, nil
+}
+
+type cmdConfigLinter struct {
+	errs ValidationErrors
+}
+
+func (l *cmdConfigLinter) add(node *yaml.Node, strict bool, format string, args ...interface{}) {
+	l.errs = append(l.errs, ValidationError{Line: node.Line, Column: node.Column, Message: fmt.Sprintf(format, args...), Strict: strict})
+}
+
+// mapping checks the keys of a mapping node against keys and returns the values of the valid ones
+func (l *cmdConfigLinter) mapping(node *yaml.Node, what string, keys map[string]fieldKind) map[string]*yaml.Node {
+	values := map[string]*yaml.Node{}
+	if node.Kind != yaml.MappingNode {
+		l.add(node, false, "%s must be a mapping, got %s", what, describeNode(node))
+		return values
+	}
+	seen := map[string]*yaml.Node{}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if first, ok := seen[key.Value]; ok {
+			l.add(key, false, "duplicate key '%s' in %s, first set on line %d", key.Value, what, first.Line)
+			continue
+		}
+		seen[key.Value] = key
+
+		kind, ok := keys[key.Value]
+		if !ok {
+			if suggestion := closestKey(key.Value, keys); suggestion != "" {
+				l.add(key, true, "unknown key '%s' in %s, did you mean '%s'?", key.Value, what, suggestion)
+			} else {
+				l.add(key, true, "unknown key '%s' in %s", key.Value, what)
+			}
+			continue
+		}
+		if l.checkKind(value, kind, key.Value) {
+			values[key.Value] = value
+		}
+	}
+	return values
+}
+
+// checkKind reports a type mismatch for value and returns whether it can be used
+func (l *cmdConfigLinter) checkKind(value *yaml.Node, kind fieldKind, key string) bool {
+	if isNull(value) {
+		// Same as leaving the key out, required keys are checked separately
+		return true
+	}
+	ok := true
+	switch kind {
+	case kindScalar:
+		ok = value.Kind == yaml.ScalarNode
+	case kindText:
+		ok = value.Kind == yaml.ScalarNode && value.Tag == "!!str"
+	case kindBool:
+		ok = value.Kind == yaml.ScalarNode && (value.Tag == "!!bool" || (value.Style == 0 && yamlV2Bools[value.Value]))
+	case kindInt:
+		ok = value.Kind == yaml.ScalarNode && value.Tag == "!!int"
+	case kindTimeout:
+		if value.Kind != yaml.ScalarNode {
+			ok = false
+		} else if _, err := ParseTimeout(value.Value); err != nil {
+			l.add(value, false, "invalid %s: %v", key, err)
+			return false
+		}
+	case kindTextList:
+		ok = value.Kind == yaml.SequenceNode && allScalars(value.Content)
+	case kindTextOrList:
+		ok = (value.Kind == yaml.ScalarNode && value.Tag == "!!str") || (value.Kind == yaml.SequenceNode && allScalars(value.Content))
+	case kindTextMap:
+		ok = value.Kind == yaml.MappingNode && allScalars(value.Content)
+	case kindGlobList:
+		ok = value.Kind == yaml.SequenceNode && allScalars(value.Content)
+		if ok {
+			for _, item := range value.Content {
+				if _, err := filepath.Match(item.Value, ""); err != nil {
+					l.add(item, false, "invalid pattern '%s' in %s: %v", item.Value, key, err)
+				}
+			}
+		}
+	case kindRegexList:
+		ok = value.Kind == yaml.SequenceNode && allScalars(value.Content)
+		if ok {
+			for _, item := range value.Content {
+				if _, err := regexp.Compile(item.Value); err != nil {
+					l.add(item, false, "invalid regular expression in %s: %v", key, err)
+				}
+			}
+		}
+	case kindCommandList, kindFileList, kindSinkList:
+		ok = value.Kind == yaml.SequenceNode
+	}
+	if !ok {
+		l.add(value, false, "%s must be %s, got %s", key, describeKind(kind), describeNode(value))
+	}
+	return ok
+}
+
+func (l *cmdConfigLinter) lintRoot(root *yaml.Node) {
+	if isNull(root) {
+		return
+	}
+	values := l.mapping(root, "cmd_config", cmdConfigKeys)
+	if v, ok := values["max_parallel"]; ok && strings.HasPrefix(v.Value, "-") {
+		l.add(v, false, "invalid max_parallel %s: must not be negative", v.Value)
+	}
+	if v, ok := values["p4_commands"]; ok {
+		l.lintCommands(v, "P4 command")
+	}
+	if v, ok := values["os_commands"]; ok {
+		l.lintCommands(v, "OS command")
+	}
+	if v, ok := values["files"]; ok {
+		l.lintFiles(v)
+	}
+	if v, ok := values["sinks"]; ok {
+		l.lintSinks(v)
+	}
+	if v, ok := values["cloud_metadata"]; ok && v.Kind == yaml.MappingNode {
+		for name, endpoint := range l.mapping(v, "cloud_metadata", cloudMetadataKeys) {
+			if u, err := url.Parse(endpoint.Value); endpoint.Kind == yaml.ScalarNode && (err != nil || u.Scheme == "" || u.Host == "") {
+				l.add(endpoint, false, "invalid %s metadata endpoint '%s': expecting a URL such as %s", name, endpoint.Value, DefaultAWSMetadataEndpoint)
+			}
+		}
+	}
+}
+
+func (l *cmdConfigLinter) lintCommands(list *yaml.Node, what string) {
+	tags := map[string]*yaml.Node{}
+	for _, item := range list.Content {
+		values := l.mapping(item, what, commandKeys)
+		if item.Kind != yaml.MappingNode {
+			continue
+		}
+		description := scalarValue(values["description"])
+		for _, key := range []string{"command", "monitor_tag", "description"} {
+			if isEmpty(scalarValue(values[key])) {
+				l.add(item, false, "missing %s for %s: %s", key, what, description)
+			}
+		}
+		l.checkDuplicateTag(values["monitor_tag"], tags, what)
+	}
+}
+
+func (l *cmdConfigLinter) lintFiles(list *yaml.Node) {
+	tags := map[string]*yaml.Node{}
+	for _, item := range list.Content {
+		values := l.mapping(item, "file", fileKeys)
+		if item.Kind != yaml.MappingNode {
+			continue
+		}
+		path := scalarValue(values["pathtofile"])
+		for _, key := range []string{"pathtofile", "monitor_tag"} {
+			if isEmpty(scalarValue(values[key])) {
+				l.add(item, false, "missing %s for file path: %s", key, path)
+			}
+		}
+		l.checkDuplicateTag(values["monitor_tag"], tags, "file")
+
+		if level, ok := values["parsingLevel"]; !ok {
+			l.add(item, false, "missing parsingLevel for file path: %s", path)
+		} else if level.Value != "server" && level.Value != "instance" {
+			l.add(level, false, "invalid parsingLevel '%s' for file path: %s. Expecting 'server' or 'instance'", level.Value, path)
+		}
+
+		tail := false
+		if mode, ok := values["mode"]; ok {
+			switch mode.Value {
+			case FileModeFull:
+			case FileModeTail:
+				tail = true
+			default:
+				l.add(mode, false, "invalid mode '%s' for file path: %s. Expecting '%s' or '%s'", mode.Value, path, FileModeFull, FileModeTail)
+			}
+		}
+		for _, key := range []string{"max_bytes", "max_lines", "max_files", "max_depth", "before", "after", "max_matches"} {
+			if v, ok := values[key]; ok && strings.HasPrefix(v.Value, "-") {
+				l.add(v, false, "invalid %s %s for file path: %s: must not be negative", key, v.Value, path)
+			}
+		}
+
+		structured := false
+		if format, ok := values["format"]; ok {
+			switch format.Value {
+			case FileFormatEnv, FileFormatINI, FileFormatJSON, FileFormatYAML, FileFormatPHPArray:
+				structured = true
+			default:
+				l.add(format, false, "invalid format '%s' for file path: %s. Expecting one of %s, %s, %s, %s or %s", format.Value, path,
+					FileFormatEnv, FileFormatINI, FileFormatJSON, FileFormatYAML, FileFormatPHPArray)
+			}
+			if tail {
+				l.add(format, false, "format cannot be used with mode tail for file path: %s", path)
+			}
+		}
+
+		metadata := false
+		if collect, ok := values["collect"]; ok {
+			switch collect.Value {
+			case FileCollectContent:
+			case FileCollectMetadata:
+				metadata = true
+				if tail || structured {
+					l.add(collect, false, "collect metadata cannot be used with mode tail or a format for file path: %s", path)
+				}
+			default:
+				l.add(collect, false, "invalid collect '%s' for file path: %s. Expecting '%s' or '%s'", collect.Value, path, FileCollectContent, FileCollectMetadata)
+			}
+		}
+
+		// In tail mode every new line is parsed when there are no keywords; with a format or when only
+		// collecting metadata keywords are not used
+		parseAll := tail || structured || metadata || (values["parseAll"] != nil && isTrue(values["parseAll"]))
+		keywords := values["keywords"]
+		hasKeywords := keywords != nil && (scalarValue(keywords) != "" || len(keywords.Content) > 0)
+		if regexKeywords := values["regexKeywords"]; regexKeywords != nil && len(regexKeywords.Content) > 0 {
+			hasKeywords = true
+		}
+		if !parseAll && !hasKeywords {
+			l.add(item, false, "for file %s: parseAll is set to false, but no keywords are provided", path)
+		}
+
+		if keep, ok := values["keep"]; ok && keep.Value != FileKeepFirst && keep.Value != FileKeepLast {
+			l.add(keep, false, "invalid keep '%s' for file path: %s. Expecting '%s' or '%s'", keep.Value, path, FileKeepFirst, FileKeepLast)
+		}
+		// Context and match limits only apply to the lines selected by keywords
+		if structured || metadata || !hasKeywords || (values["parseAll"] != nil && isTrue(values["parseAll"])) {
+			for _, key := range []string{"before", "after", "max_matches", "keep"} {
+				if v, ok := values[key]; ok {
+					l.add(v, false, "%s only applies when parsing keywords for file path: %s", key, path)
+				}
+			}
+		}
+	}
+}
+
+func (l *cmdConfigLinter) lintSinks(list *yaml.Node) {
+	for i, item := range list.Content {
+		what := fmt.Sprintf("sink %d", i+1)
+		values := l.mapping(item, what, sinkKeys)
+		if item.Kind != yaml.MappingNode {
+			continue
+		}
+		sinkType := scalarValue(values["type"])
+		switch sinkType {
+		case SinkDataPushGateway, SinkStdout, SinkSyslog:
+		case SinkFile:
+			if isEmpty(scalarValue(values["path"])) {
+				l.add(item, false, "missing path for file %s", what)
+			}
+		case SinkWebhook:
+			if isEmpty(scalarValue(values["url"])) {
+				l.add(item, false, "missing url for webhook %s", what)
+			}
+		default:
+			node := item
+			if v, ok := values["type"]; ok {
+				node = v
+			}
+			l.add(node, false, "invalid type '%s' for %s. Expecting one of %s, %s, %s, %s or %s", sinkType, what,
+				SinkDataPushGateway, SinkFile, SinkStdout, SinkWebhook, SinkSyslog)
+		}
+	}
+}
+
+// checkDuplicateTag reports a monitor_tag already used earlier in the same section
+func (l *cmdConfigLinter) checkDuplicateTag(tag *yaml.Node, tags map[string]*yaml.Node, what string) {
+	if tag == nil || isEmpty(tag.Value) {
+		return
+	}
+	if first, ok := tags[tag.Value]; ok {
+		l.add(tag, true, "duplicate monitor_tag '%s' for %s, first used on line %d", tag.Value, what, first.Line)
+		return
+	}
+	tags[tag.Value] = tag
+}
+
+// closestKey returns the known key that key is most likely a misspelling of, or "" if none is close
+func closestKey(key string, keys map[string]fieldKind) string {
+	best, bestDistance := "", 3
+	for candidate := range keys {
+		if strings.EqualFold(candidate, key) {
+			return candidate
+		}
+		if d := editDistance(strings.ToLower(key), strings.ToLower(candidate)); d < bestDistance || (d == bestDistance && candidate < best) {
+			best, bestDistance = candidate, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = cur[j-1] + 1
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if prev[j-1]+cost < cur[j] {
+				cur[j] = prev[j-1] + cost
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func scalarValue(node *yaml.Node) string {
+	if node == nil || node.Kind != yaml.ScalarNode || node.Tag == "!!null" {
+		return ""
+	}
+	return node.Value
+}
+
+func isNull(node *yaml.Node) bool {
+	return node.Kind == yaml.ScalarNode && node.Tag == "!!null"
+}
+
+func isTrue(node *yaml.Node) bool {
+	switch node.Value {
+	case "true", "True", "TRUE", "y", "Y", "yes", "Yes", "YES", "on", "On", "ON":
+		return true
+	}
+	return false
+}
+
+func allScalars(nodes []*yaml.Node) bool {
+	for _, n := range nodes {
+		if n.Kind != yaml.ScalarNode {
+			return false
+		}
+	}
+	return true
+}
+
+func describeKind(kind fieldKind) string {
+	switch kind {
+	case kindScalar, kindText:
+		return "a string"
+	case kindBool:
+		return "true or false"
+	case kindInt:
+		return "an integer"
+	case kindTimeout:
+		return "a duration"
+	case kindTextList, kindRegexList, kindGlobList:
+		return "a list of strings"
+	case kindTextOrList:
+		return "a string or a list of strings"
+	case kindTextMap:
+		return "a mapping of strings"
+	default:
+		return "a list"
+	}
+}
+
+func describeNode(node *yaml.Node) string {
+	switch node.Kind {
+	case yaml.MappingNode:
+		return "a mapping"
+	case yaml.SequenceNode:
+		return "a list"
+	case yaml.AliasNode:
+		return "an alias"
+	}
+	switch node.Tag {
+	case "!!str":
+		return fmt.Sprintf("string %q", node.Value)
+	case "!!null":
+		return "null"
+	}
+	return fmt.Sprintf("%s %s", strings.TrimPrefix(node.Tag, "!!"), node.Value)
+}
@@ -81,6 +81,11 @@ func TestValidateCmdConfigYAMLFromFile(t *testing.T) {
 			filepath: filepath.Join("testfiles", "parseAll_false_with_no_keywords.yaml"),
 			wantErr:  true,
 		},
+		{
+			name:     "Invalid YAML - invalid command timeout",
+			filepath: filepath.Join("testfiles", "invalid_timeout.yaml"),
+			wantErr:  true,
+		},
 		{
 			name:     "Server/Instance Level mismatch - parsingLevel not 'server' or 'instance'",
 			filepath: filepath.Join("testfiles", "parseLevel_not_server_or_instance.yaml"),
@@ -101,3 +106,31 @@ func TestValidateCmdConfigYAMLFromFile(t *testing.T) {
 		})
 	}
 }
+
+func TestLintCmdConfigYAML(t *testing.T) {
+	problems, err := LintCmdConfigYAML(filepath.Join("testfiles", "valid.yaml"))
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+
+	problems, err = LintCmdConfigYAML(filepath.Join("testfiles", "lint_problems.yaml"))
+	assert.NoError(t, err)
+	var got []string
+	for _, p := range problems {
+		got = append(got, fmt.Sprintf("%d:%d strict=%v %s", p.Line, p.Column, p.Strict, p.Message))
+	}
+	assert.Equal(t, []string{
+		`1:15 strict=false max_parallel must be an integer, got string "two"`,
+		`3:5 strict=false for file /etc/hosts: parseAll is set to false, but no keywords are provided`,
+		`5:5 strict=true unknown key 'parseall' in file, did you mean 'parseAll'?`,
+		`6:15 strict=false parseAll must be true or false, got string "yes"`,
+		`9:18 strict=true duplicate monitor_tag 'hosts' for file, first used on line 4`,
+		`15:12 strict=false after only applies when parsing keywords for file path: /p4/1/logs/log`,
+		`16:11 strict=false invalid keep 'middle' for file path: /p4/1/logs/log. Expecting 'first' or 'last'`,
+		`16:11 strict=false keep only applies when parsing keywords for file path: /p4/1/logs/log`,
+		`22:5 strict=true unknown key 'timout' in OS command, did you mean 'timeout'?`,
+	}, got)
+
+	problems, err = LintCmdConfigYAML(filepath.Join("testfiles", "invalid_yaml.yaml"))
+	assert.NoError(t, err)
+	assert.Len(t, problems, 1)
+}
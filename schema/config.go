@@ -4,36 +4,54 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
 )
 
 var (
 	ExeDir                   = GetExecutableDir()
-	InstanceArg              = "1"
 	DefaultCmdConfigYAMLPath string
-	Vars2SourceFilePath      string
-	AutobotsDir              string //TODO Should be editable in main.go
-	CustomSourceVars         bool
+	CustomVarsFilePath       string             // Set once from --vars; when empty each instance sources its own p4_<instance>.vars
+	AutobotsDir              string             // Set from --autobots-dir, by default autobots next to the executable
+	P4baseDir                = DefaultP4BaseDir // Set from --p4-base-dir; the SDP instances are found in it
+	P4VarDir                 = DefaultP4VarDir  // Set from --p4-var-dir; holds the p4_<instance>.vars files
 	MetricsConfigFile        = "/p4/common/config/.push_metrics.cfg"
+	CommandTimeout           = DefaultCommandTimeout // Overridden by default_timeout in cmd_config.yaml
+	MaxParallel              = DefaultMaxParallel    // Overridden by max_parallel in cmd_config.yaml or --parallel
+	Sinks                    []SinkConfig            // From sinks in cmd_config.yaml, empty means datapushgateway only
+	Redactions               []string                // From redactions in cmd_config.yaml, masked in every result
+	BuiltinRedactions        = true                  // Cleared by disable_builtin_redactions in cmd_config.yaml
+	StateDir                 = DefaultStateDir       // Set from --state-dir; persists tail offsets between runs
+	CloudCacheTTL            = DefaultCloudCacheTTL  // Set from --cloud-cache-ttl; how long a detected cloud provider is reused
 )
 
 // Define default paths
 const (
-	P4baseDir          = "/p4" // TODO make this editable as well. and surely not /p4 consider flags
+	DefaultP4BaseDir   = "/p4"
 	LogFileName        = "command-runner.log"
 	MainLogFilePath    = "/opt/perforce/command-runner/logs/" + LogFileName
 	CmdConfigYamlFile  = "cmd_config.yaml"
 	OutputJSONFilePath = "/tmp/out.json"
+	DefaultSpoolDir    = "/opt/perforce/command-runner/spool"
+	DefaultStateDir    = "/opt/perforce/command-runner/state"
 	DefaultP4VarDir    = "/p4/common/config/"
+	// DefaultCommandTimeout applies to commands and autobots when neither the command nor cmd_config.yaml sets one
+	DefaultCommandTimeout = 5 * time.Minute
+	// DefaultCloudCacheTTL is how long --autocloud reuses the cloud provider it detected, see StateDir
+	DefaultCloudCacheTTL = 24 * time.Hour
+	// DefaultMaxParallel is the number of commands (and SDP instances) processed at the same time
+	DefaultMaxParallel = 4
 )
 
 func init() {
 	// Assuming ExeDir is a variable that you've defined and initialized somewhere.
 
-	AutobotsDir = ExeDir + "autobots"
+	AutobotsDir = filepath.Join(ExeDir, "autobots")
 	DefaultCmdConfigYAMLPath = DefaultP4VarDir + CmdConfigYamlFile
-	Vars2SourceFilePath = DefaultP4VarDir + "p4_" + InstanceArg + ".vars"
 
 }
 func SendVars(defpath string, metricspath string) {
@@ -47,21 +65,80 @@ func GetExecutableDir() string {
 	}
 	return filepath.Dir(exePath)
 }
-func SetInstanceArg(arg string) {
-	InstanceArg = arg
-	//TODO Set Vars2Source?
+
+// VarsFilePath returns the SDP vars file to source for the given instance.
+// It has no side effects so it is safe to call from concurrently processed instances.
+func VarsFilePath(instance string) string {
+	if CustomVarsFilePath != "" {
+		logrus.Debugf("Custom vars file. Using: %s", CustomVarsFilePath)
+		return CustomVarsFilePath
+	}
+	varsFilePath := filepath.Join(P4VarDir, "p4_"+instance+".vars")
+	logrus.Debugf("No custom vars file. Using: %s", varsFilePath)
+	return varsFilePath
+}
+
+// LoadCmdConfigDefaults reads the global settings (default_timeout, max_parallel, sinks) from cmd_config.yaml
+func LoadCmdConfigDefaults(filePath string) error {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", filePath, err)
+	}
+	var config CmdConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("failed to unmarshal %s: %w", filePath, err)
+	}
+	if config.DefaultTimeout != "" {
+		timeout, err := ParseTimeout(config.DefaultTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid default_timeout: %w", err)
+		}
+		CommandTimeout = timeout
+	}
+	if config.MaxParallel > 0 {
+		MaxParallel = config.MaxParallel
+	}
+	Sinks = config.Sinks
+	Redactions = config.Redactions
+	BuiltinRedactions = !config.DisableBuiltinRedactions
+	if err := loadCloudMetadataEndpoints(config.CloudMetadata); err != nil {
+		return err
+	}
+	logrus.Debugf("Default command timeout: %s, max parallel: %d", CommandTimeout, MaxParallel)
+	return nil
 }
-func ReSetVars2SourceFilePath(arg string) {
-	if !CustomSourceVars {
-		// When CustomSourceVars is false
-		logrus.Debugf("No custom vars file. Using: %s", Vars2SourceFilePath)
-		InstanceArg = arg
-		Vars2SourceFilePath = DefaultP4VarDir + "p4_" + arg + ".vars"
-	} else {
-		// When CustomSourceVars is true
-		logrus.Debugf("Custom vars file. Using: %s", Vars2SourceFilePath)
+
+// ParseTimeout parses a timeout given either as a Go duration ("90s", "5m") or a plain number of seconds.
+// An empty value returns 0, meaning "use the default".
+func ParseTimeout(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0, fmt.Errorf("timeout %q must not be negative", value)
+		}
+		return time.Duration(secs) * time.Second, nil
 	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("timeout %q is not a duration or number of seconds", value)
+	}
+	if timeout < 0 {
+		return 0, fmt.Errorf("timeout %q must not be negative", value)
+	}
+	return timeout, nil
 }
+
+// GetTimeout returns the timeout configured for the command, falling back to the global CommandTimeout
+func (c Command) GetTimeout() time.Duration {
+	if timeout, err := ParseTimeout(c.Timeout); err == nil && timeout > 0 {
+		return timeout
+	}
+	return CommandTimeout
+}
+
 func GetConfigPath(basePath, configName string) string {
 	return filepath.Join(basePath, configName)
 }
@@ -94,6 +171,60 @@ func (fc *FileConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 					fc.SanitizationKeywords = append(fc.SanitizationKeywords, fmt.Sprintf("%v", s))
 				}
 			}
+		case "regexKeywords":
+			if rk, ok := value.([]interface{}); ok {
+				for _, r := range rk {
+					fc.RegexKeywords = append(fc.RegexKeywords, fmt.Sprintf("%v", r))
+				}
+			}
+		case "redactions":
+			if rd, ok := value.([]interface{}); ok {
+				for _, r := range rd {
+					fc.Redactions = append(fc.Redactions, fmt.Sprintf("%v", r))
+				}
+			}
+		case "include":
+			if inc, ok := value.([]interface{}); ok {
+				for _, i := range inc {
+					fc.Include = append(fc.Include, fmt.Sprintf("%v", i))
+				}
+			}
+		case "exclude":
+			if exc, ok := value.([]interface{}); ok {
+				for _, e := range exc {
+					fc.Exclude = append(fc.Exclude, fmt.Sprintf("%v", e))
+				}
+			}
+		case "max_files":
+			fc.MaxFiles, _ = value.(int)
+		case "max_depth":
+			fc.MaxDepth, _ = value.(int)
+		case "collect":
+			fc.Collect, _ = value.(string)
+		case "format":
+			fc.Format, _ = value.(string)
+		case "select":
+			if sel, ok := value.([]interface{}); ok {
+				for _, k := range sel {
+					fc.Select = append(fc.Select, fmt.Sprintf("%v", k))
+				}
+			}
+		case "mode":
+			fc.Mode, _ = value.(string)
+		case "max_bytes":
+			if mb, ok := value.(int); ok {
+				fc.MaxBytes = int64(mb)
+			}
+		case "max_lines":
+			fc.MaxLines, _ = value.(int)
+		case "before":
+			fc.Before, _ = value.(int)
+		case "after":
+			fc.After, _ = value.(int)
+		case "max_matches":
+			fc.MaxMatches, _ = value.(int)
+		case "keep":
+			fc.Keep, _ = value.(string)
 		case "keywords":
 			// This is where we handle both scenarios
 			if kw, ok := value.([]interface{}); ok {
@@ -117,9 +248,17 @@ type FileParserConfig struct {
 // CmdConfig represents the entire structure of cmd_config.yaml
 type CmdConfig struct {
 	//	Files            []FileConfig `yaml:",inline"`
-	Files      []FileConfig `yaml:"files"`
-	P4Commands []Command    `yaml:"p4_commands"`
-	OsCommands []Command    `yaml:"os_commands"`
+	Files          []FileConfig `yaml:"files"`
+	P4Commands     []Command    `yaml:"p4_commands"`
+	OsCommands     []Command    `yaml:"os_commands"`
+	DefaultTimeout string       `yaml:"default_timeout"`
+	MaxParallel    int          `yaml:"max_parallel"`
+	Sinks          []SinkConfig `yaml:"sinks"`
+	// Secret scrubbing applied to every result, on top of the per file redactions
+	Redactions               []string `yaml:"redactions"`
+	DisableBuiltinRedactions bool     `yaml:"disable_builtin_redactions"`
+	// Base URLs of the cloud metadata services, for proxies and tests
+	CloudMetadata CloudMetadataConfig `yaml:"cloud_metadata"`
 }
 
 // FileConfig represents each file configuration in cmd_config.yaml
@@ -130,13 +269,98 @@ type FileConfig struct {
 	ParsingLevel         string   `yaml:"parsingLevel"`
 	SanitizationKeywords []string `yaml:"sanitizationKeywords"`
 	MonitorTag           string   `yaml:"monitor_tag"`
+	RegexKeywords        []string `yaml:"regexKeywords"` // Lines matching any of these regular expressions are included, like keywords
+	Redactions           []string `yaml:"redactions"`    // Regular expressions whose matches (or capture groups, if any) are masked
+	Mode                 string   `yaml:"mode"`          // FileModeFull (default) or FileModeTail
+	// Full mode: most bytes collected from the file, 0 for DefaultFileMaxBytes.
+	// Tail mode: most new bytes read per run, 0 for DefaultTailMaxBytes.
+	MaxBytes int64 `yaml:"max_bytes"`
+	MaxLines int   `yaml:"max_lines"` // Most lines collected from the file, 0 for no limit
+	// When parsing keywords, matching lines can be sent with lines of context around them, and are then
+	// numbered like grep -n output
+	Before     int    `yaml:"before"`      // Lines of context before each match
+	After      int    `yaml:"after"`       // Lines of context after each match
+	MaxMatches int    `yaml:"max_matches"` // Most matches collected, 0 for no limit
+	Keep       string `yaml:"keep"`        // FileKeepFirst (default) or FileKeepLast: which matches max_matches keeps
+	// When pathtofile is a glob or a directory every matching file is collected as its own entry
+	Include  []string `yaml:"include"`   // Base name patterns a file must match, all files if empty
+	Exclude  []string `yaml:"exclude"`   // Base name patterns of files to leave out
+	MaxFiles int      `yaml:"max_files"` // Most files collected, 0 for DefaultMaxFiles
+	MaxDepth int      `yaml:"max_depth"` // Levels of subdirectories searched below a directory, 0 for none
+	// With a format the file is parsed into a JSON object instead of being sent as text, and
+	// sanitizationKeywords drop matching keys instead of lines
+	Format string   `yaml:"format"` // One of the FileFormat values
+	Select []string `yaml:"select"` // Dot separated key paths to keep, e.g. p4.port; everything if empty
+	// Collect is FileCollectContent (default) or FileCollectMetadata to send only size, mode, owner,
+	// mtime, SHA-256 and symlink target
+	Collect string `yaml:"collect"`
 }
 
+// File parsing modes
+const (
+	// FileModeFull parses the whole file every run
+	FileModeFull = "full"
+	// FileModeTail only parses what was appended since the last run, see StateDir
+	FileModeTail = "tail"
+	// DefaultFileMaxBytes caps what full mode collects from a file
+	DefaultFileMaxBytes = 10 * 1024 * 1024
+	// DefaultTailMaxBytes caps what tail mode reads from a file in one run
+	DefaultTailMaxBytes = 1024 * 1024
+	// DefaultMaxFiles caps the files collected for one glob or directory pathtofile
+	DefaultMaxFiles = 100
+)
+
+// Which matches max_matches keeps
+const (
+	FileKeepFirst = "first"
+	FileKeepLast  = "last"
+)
+
+// What is collected from a file
+const (
+	FileCollectContent  = "content"
+	FileCollectMetadata = "metadata"
+)
+
+// Structured file formats
+const (
+	FileFormatEnv      = "env"
+	FileFormatINI      = "ini"
+	FileFormatJSON     = "json"
+	FileFormatYAML     = "yaml"
+	FileFormatPHPArray = "php-array"
+)
+
 // Command represents individual command details
 type Command struct {
 	Description string `yaml:"description"`
 	Command     string `yaml:"command"`
 	MonitorTag  string `yaml:"monitor_tag"`
+	Timeout     string `yaml:"timeout"` // e.g. "30s" or "30", empty means default_timeout
+}
+
+// Output sink types
+const (
+	SinkDataPushGateway = "datapushgateway"
+	SinkFile            = "file"
+	SinkStdout          = "stdout"
+	SinkWebhook         = "webhook"
+	SinkSyslog          = "syslog"
+)
+
+// SinkConfig represents one output destination in the sinks section of cmd_config.yaml.
+// Which fields apply depends on Type.
+type SinkConfig struct {
+	Type    string            `yaml:"type"`
+	Name    string            `yaml:"name,omitempty"`    // Optional label used in logs
+	Path    string            `yaml:"path,omitempty"`    // file: a file to overwrite, or a directory (ending in /) to archive into
+	URL     string            `yaml:"url,omitempty"`     // webhook
+	Method  string            `yaml:"method,omitempty"`  // webhook, default POST
+	Headers map[string]string `yaml:"headers,omitempty"` // webhook
+	Timeout string            `yaml:"timeout,omitempty"` // webhook
+	Network string            `yaml:"network,omitempty"` // syslog: "udp" or "tcp", empty for the local syslog daemon
+	Address string            `yaml:"address,omitempty"` // syslog: host:port when network is set
+	Tag     string            `yaml:"tag,omitempty"`     // syslog, default command-runner
 }
 
 // CommandConfig holds the configuration from the YAML file for p4_commands (formerly instance_commands) and os_commands(formerly server_commands)
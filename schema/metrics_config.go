@@ -2,40 +2,87 @@ package schema
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+// MetricsConfig is the .push_metrics.cfg file, which sets where and how results are pushed
 type MetricsConfig struct {
+	Enabled   bool // enabled=1 turns command-runner on
 	Host      string
 	Customer  string
 	Instance  string
 	User      string
 	Passwd    string
 	CloudType string
+	JSONURL   string // Full URL of the datapushgateway JSON endpoint, e.g. https://host:9092/json/
+
+	// Upload options, see tools/push_request.go for the receiver contract
+	Gzip        bool          // Send request bodies with Content-Encoding: gzip
+	ChunkSize   int64         // Split payloads larger than this many bytes into chunks, 0 disables chunking
+	PushTimeout time.Duration // Limit on each push request, 0 for none
+
+	// TLS and authentication options for the push client
+	BearerToken        string // Sent as "Authorization: Bearer" instead of basic auth when set
+	CAFile             string // PEM bundle trusted in addition to the system roots
+	ClientCert         string // PEM client certificate for mTLS, used with ClientKey
+	ClientKey          string
+	ServerName         string // Overrides the name verified in the server certificate
+	InsecureSkipVerify bool
+	Proxy              string // Proxy URL, otherwise HTTPS_PROXY/HTTP_PROXY from the environment apply
+}
+
+// DefaultPushTimeout limits each push request unless metrics_push_timeout is set
+const DefaultPushTimeout = 60 * time.Second
+
+// EnvMetricsPasswd overrides the datapushgateway password of the metrics config, so it need not be stored in it
+const EnvMetricsPasswd = "COMMAND_RUNNER_METRICS_PASSWD"
+
+// envMetricsPrefix followed by a key in upper case, e.g. CR_METRICS_HOST, overrides that key of the metrics config
+const envMetricsPrefix = "CR_"
+
+// metricsConfigKeys are the keys of the metrics config that command-runner uses, the only ones CR_*
+// environment variables override
+var metricsConfigKeys = []string{
+	"enabled", "metrics_host", "metrics_customer", "metrics_instance", "metrics_user", "metrics_passwd",
+	"metrics_passwd_file", "metrics_cloudtype", "metrics_json_url", "metrics_gzip", "metrics_chunk_size",
+	"metrics_push_timeout",
+	"metrics_bearer_token", "metrics_ca_file", "metrics_client_cert", "metrics_client_key",
+	"metrics_server_name", "metrics_insecure_skip_verify", "metrics_proxy",
+}
+
+// requiredMetricsConfigKeys are the keys command-runner cannot run or push without, so a line setting
+// one of them that cannot be parsed fails the whole file rather than being skipped
+var requiredMetricsConfigKeys = map[string]bool{
+	"enabled": true, "metrics_host": true, "metrics_customer": true, "metrics_json_url": true,
 }
 
+// ErrInvalidMetricsConfig is returned by ParseMetricsConfig when required keys are missing or values are invalid
+var ErrInvalidMetricsConfig = errors.New("invalid metrics config")
+
+// ParseMetricsConfig reads the metrics config (see ReadMetricsConfigValues) and checks that it can be used
+// to push: metrics_customer and either metrics_host or metrics_json_url are required. The password is
+// taken from COMMAND_RUNNER_METRICS_PASSWD if set, else from the file named by metrics_passwd_file, else
+// from metrics_passwd.
 func ParseMetricsConfig(filePath string) (MetricsConfig, error) {
-	file, err := os.Open(filePath)
+	values, err := ReadMetricsConfigValues(filePath)
 	if err != nil {
 		return MetricsConfig{}, err
 	}
-	defer file.Close()
-
-	config := MetricsConfig{}
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.SplitN(line, "=", 2)
-		if len(parts) != 2 {
-			continue
-		}
 
-		key, value := parts[0], parts[1]
+	config := MetricsConfig{PushTimeout: DefaultPushTimeout}
+	var problems []string
+	for key, value := range values {
 		switch key {
+		case "enabled":
+			config.Enabled = parseMetricsBool(value)
 		case "metrics_host":
 			config.Host = value
 		case "metrics_customer":
@@ -48,86 +95,229 @@ func ParseMetricsConfig(filePath string) (MetricsConfig, error) {
 			config.Passwd = value
 		case "metrics_cloudtype":
 			config.CloudType = value
+		case "metrics_json_url":
+			config.JSONURL = value
+		case "metrics_gzip":
+			config.Gzip = parseMetricsBool(value)
+		case "metrics_chunk_size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				problems = append(problems, fmt.Sprintf("metrics_chunk_size %q must be a number of bytes", value))
+			}
+			config.ChunkSize = size
+		case "metrics_push_timeout":
+			timeout, err := ParseTimeout(value)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("metrics_push_timeout: %v", err))
+			}
+			config.PushTimeout = timeout
+		case "metrics_bearer_token":
+			config.BearerToken = value
+		case "metrics_ca_file":
+			config.CAFile = value
+		case "metrics_client_cert":
+			config.ClientCert = value
+		case "metrics_client_key":
+			config.ClientKey = value
+		case "metrics_server_name":
+			config.ServerName = value
+		case "metrics_insecure_skip_verify":
+			config.InsecureSkipVerify = parseMetricsBool(value)
+		case "metrics_proxy":
+			config.Proxy = value
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		return MetricsConfig{}, err
+	switch {
+	case os.Getenv(EnvMetricsPasswd) != "":
+		config.Passwd = os.Getenv(EnvMetricsPasswd)
+	case values["metrics_passwd_file"] != "":
+		passwd, err := os.ReadFile(values["metrics_passwd_file"])
+		if err != nil {
+			return MetricsConfig{}, fmt.Errorf("error reading metrics_passwd_file: %w", err)
+		}
+		config.Passwd = strings.TrimRight(string(passwd), "\r\n")
 	}
 
+	if config.Host == "" && config.JSONURL == "" {
+		problems = append(problems, "metrics_host (or metrics_json_url) is required")
+	}
+	if config.Customer == "" {
+		problems = append(problems, "metrics_customer is required")
+	}
+	if (config.ClientCert == "") != (config.ClientKey == "") {
+		problems = append(problems, "metrics_client_cert and metrics_client_key must be set together")
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return MetricsConfig{}, fmt.Errorf("%w %s: %s", ErrInvalidMetricsConfig, filePath, strings.Join(problems, "; "))
+	}
 	return config, nil
 }
-func UpdateMetricsConfig(metricsCloudType string) error {
-	// Log the action
-	logrus.Infof("Updating Metrics Config File with metrics_cloudtype=%s", metricsCloudType)
 
-	// Read the current content of the configuration file
-	content, err := os.ReadFile(MetricsConfigFile)
+// ReadMetricsConfigValues reads the key=value lines of the metrics config with shell quoting rules, as
+// the file is also sourced by shell scripts: blank lines and # comments are skipped, keys may be preceded
+// by export, and values may be 'single' or "double" quoted. A CR_<KEY> environment variable overrides
+// a key command-runner uses, e.g. CR_METRICS_HOST overrides metrics_host; other CR_* variables are ignored.
+// A line that cannot be parsed is logged and skipped, unless it sets a required key.
+func ReadMetricsConfigValues(filePath string) (map[string]string, error) {
+	file, err := os.Open(filePath)
 	if err != nil {
-		logrus.Errorf("Error reading %s: %v", MetricsConfigFile, err)
-		return fmt.Errorf("error reading %s: %v", MetricsConfigFile, err)
+		return nil, err
 	}
+	defer file.Close()
 
-	// Convert to string and check if the key already exists
-	contentStr := string(content)
-	if strings.Contains(contentStr, "metrics_cloudtype=") {
-		// Replace the existing entry with the new value
-		contentStr = strings.Replace(contentStr, "metrics_cloudtype="+metricsCloudType, "", -1)
-		contentStr = strings.TrimSpace(contentStr) // Clean up possible extra newlines
-		contentStr += fmt.Sprintf("\nmetrics_cloudtype=%s\n", metricsCloudType)
-	} else {
-		// Append the new entry if it doesn't exist
-		contentStr += fmt.Sprintf("metrics_cloudtype=%s\n", metricsCloudType)
+	values := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		key, raw, ok := splitMetricsConfigLine(scanner.Text())
+		if !ok {
+			continue
+		}
+		value, err := unquoteMetricsValue(raw)
+		if err != nil {
+			if requiredMetricsConfigKeys[key] {
+				return nil, fmt.Errorf("%s:%d: %s: %w", filePath, number, key, err)
+			}
+			logrus.Warnf("Skipping %s:%d: %s: %v", filePath, number, key, err)
+			continue
+		}
+		values[key] = value
 	}
-
-	// Write the updated content back to the configuration file
-	err = os.WriteFile(MetricsConfigFile, []byte(contentStr), 0644)
-	if err != nil {
-		logrus.Errorf("Error updating %s with metrics_cloudtype=%s: %v", MetricsConfigFile, metricsCloudType, err)
-		return fmt.Errorf("error updating %s with metrics_cloudtype=%s: %v", MetricsConfigFile, metricsCloudType, err)
+	if err := scanner.Err(); err != nil {
+		return nil, err
 	}
 
-	return nil
+	for _, key := range metricsConfigKeys {
+		name := envMetricsPrefix + strings.ToUpper(key)
+		if value, ok := os.LookupEnv(name); ok {
+			logrus.Debugf("Using %s from %s", key, name)
+			values[key] = value
+		}
+	}
+	return values, nil
 }
-func IsCommandRunnerEnabled(MetricsConfigFile string) bool {
-	file, err := os.Open(MetricsConfigFile)
-	if err != nil {
-		logrus.Errorf("Error opening metrics config file: %v", err)
-		return false
+
+// splitMetricsConfigLine returns the key of a key=value line and its value as written, or false for a
+// comment, a blank line or anything else
+func splitMetricsConfigLine(line string) (key, raw string, ok bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false
 	}
-	defer file.Close()
+	if rest := strings.TrimPrefix(line, "export"); rest != line && (rest == "" || rest[0] == ' ' || rest[0] == '\t') {
+		line = strings.TrimSpace(rest)
+	}
+	key, raw, ok = strings.Cut(line, "=")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" || strings.ContainsAny(key, " \t") {
+		return "", "", false
+	}
+	return key, strings.TrimSpace(raw), true
+}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.TrimSpace(line) == "enabled=1" {
-			return true
+// unquoteMetricsValue interprets a value as the shell would: 'single quotes' are literal, "double quotes"
+// allow \\, \", \$ and \` escapes, a backslash outside quotes escapes the next character, and unquoted
+// whitespace ends the value, which may only be followed by a # comment
+func unquoteMetricsValue(raw string) (string, error) {
+	var value strings.Builder
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		switch c {
+		case '\'':
+			end := strings.IndexByte(raw[i+1:], '\'')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated single quote")
+			}
+			value.WriteString(raw[i+1 : i+1+end])
+			i += end + 1
+		case '"':
+			i++
+			for ; i < len(raw) && raw[i] != '"'; i++ {
+				if raw[i] == '\\' && i+1 < len(raw) && strings.IndexByte("\\\"$`", raw[i+1]) >= 0 {
+					i++
+				}
+				value.WriteByte(raw[i])
+			}
+			if i == len(raw) {
+				return "", fmt.Errorf("unterminated double quote")
+			}
+		case '\\':
+			if i+1 < len(raw) {
+				i++
+				value.WriteByte(raw[i])
+			}
+		case ' ', '\t':
+			if rest := strings.TrimSpace(raw[i:]); !strings.HasPrefix(rest, "#") {
+				return "", fmt.Errorf("unexpected %q after the value, quote values containing spaces", rest)
+			}
+			return value.String(), nil
+		default:
+			value.WriteByte(c)
 		}
 	}
+	return value.String(), nil
+}
 
-	if err := scanner.Err(); err != nil {
-		logrus.Errorf("Error reading metrics config file: %v", err)
+// quoteMetricsValue quotes a value for the metrics config when the shell would otherwise change it
+func quoteMetricsValue(value string) string {
+	if value != "" && strings.Trim(value, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./:@%+,=~") == "" {
+		return value
 	}
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
 
+// parseMetricsBool reports whether a value means true: 1, true, yes or on, in any case
+func parseMetricsBool(value string) bool {
+	switch strings.ToLower(value) {
+	case "1", "true", "yes", "on":
+		return true
+	}
 	return false
 }
+
+// UpdateMetricsConfig sets metrics_cloudtype in the metrics config, only rewriting the file when the value changed
+func UpdateMetricsConfig(metricsCloudType string) error {
+	changed, err := SetMetricsConfigValues(MetricsConfigFile, map[string]string{"metrics_cloudtype": metricsCloudType})
+	if err != nil {
+		logrus.Errorf("Error updating %s with metrics_cloudtype=%s: %v", MetricsConfigFile, metricsCloudType, err)
+		return fmt.Errorf("error updating %s with metrics_cloudtype=%s: %w", MetricsConfigFile, metricsCloudType, err)
+	}
+	if changed {
+		logrus.Infof("Updated %s with metrics_cloudtype=%s", MetricsConfigFile, metricsCloudType)
+	}
+	return nil
+}
+
+// IsCommandRunnerEnabled reports whether enabled is set to a true value (1, true, yes or on) in the metrics config
+func IsCommandRunnerEnabled(MetricsConfigFile string) bool {
+	values, err := ReadMetricsConfigValues(MetricsConfigFile)
+	if err != nil {
+		logrus.Errorf("Command-runner is disabled, the metrics config cannot be read: %v", err)
+		return false
+	}
+	return parseMetricsBool(values["enabled"])
+}
+
+// GetCloudType returns metrics_cloudtype from the metrics config, onprem if it is not set
 func GetCloudType(MetricsConfigFile string) (string, error) {
-	config, err := ParseMetricsConfig(MetricsConfigFile)
+	values, err := ReadMetricsConfigValues(MetricsConfigFile)
 	if err != nil {
 		return "", err
 	}
 
-	if config.CloudType == "" {
+	if values["metrics_cloudtype"] == "" {
 		return "onprem", nil
 	}
 
-	return config.CloudType, nil
+	return values["metrics_cloudtype"], nil
 }
 
-// FetchOrDetermineCloudProvider returns the cloud provider based on flags and configuration.
+// FetchOrDetermineCloudProvider returns the cloud provider based on flags and configuration. With autocloud
+// the provider is detected later, so the metrics_cloudtype recorded by an earlier run is not used.
 func FetchOrDetermineCloudProvider(autoCloudFlag bool, cloudProviderFlag string, metricsConfigFile string) string {
 
-	if cloudProviderFlag == "onprem" { // Default value for the flag
+	if cloudProviderFlag == "onprem" && !autoCloudFlag { // Default value for the flag
 		// Fetch from .push_metrics.cfg
 		valueFromConfig, err := GetCloudType(metricsConfigFile)
 		if err != nil {
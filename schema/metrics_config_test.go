@@ -0,0 +1,217 @@
+package schema
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeMetricsConfig writes content to a .push_metrics.cfg in a temporary directory
+func writeMetricsConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), ".push_metrics.cfg")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+const minimalMetricsConfig = "metrics_host=https://metrics.example.com:9092\nmetrics_customer=acme\n"
+
+func TestReadMetricsConfigValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+	}{
+		{"plain", "metrics_host=https://metrics.example.com\n", map[string]string{"metrics_host": "https://metrics.example.com"}},
+		{"whitespace around key and value", "  metrics_host = https://metrics.example.com  \n", map[string]string{"metrics_host": "https://metrics.example.com"}},
+		{"export", "export metrics_customer=acme\n", map[string]string{"metrics_customer": "acme"}},
+		{"double quotes", `metrics_customer="Acme Corp"` + "\n", map[string]string{"metrics_customer": "Acme Corp"}},
+		{"single quotes are literal", `metrics_passwd='pa$$ "word"\'` + "\n", map[string]string{"metrics_passwd": `pa$$ "word"\`}},
+		{"escapes in double quotes", `metrics_passwd="a\"b\\c\$d\n"` + "\n", map[string]string{"metrics_passwd": `a"b\c$d\n`}},
+		{"backslash outside quotes", `metrics_customer=Acme\ Corp` + "\n", map[string]string{"metrics_customer": "Acme Corp"}},
+		{"adjacent quoted parts", `metrics_customer="Acme"' Corp'` + "\n", map[string]string{"metrics_customer": "Acme Corp"}},
+		{"comments", "# Perforce metrics\n\n   # indented comment\nmetrics_customer=acme # trailing comment\n", map[string]string{"metrics_customer": "acme"}},
+		{"hash inside a value", "metrics_passwd=pass#word\n", map[string]string{"metrics_passwd": "pass#word"}},
+		{"empty value", "metrics_proxy=\nmetrics_user=''\n", map[string]string{"metrics_proxy": "", "metrics_user": ""}},
+		{"last value wins", "metrics_cloudtype=onprem\nmetrics_cloudtype=aws\n", map[string]string{"metrics_cloudtype": "aws"}},
+		{"not key=value", "exported=1\nnot a setting\nbad key=1\n", map[string]string{"exported": "1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadMetricsConfigValues(writeMetricsConfig(t, tt.content))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestReadMetricsConfigValuesErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"unterminated double quote", "metrics_host=https://metrics.example.com\nmetrics_customer=\"acme\n", `:2: metrics_customer: unterminated double quote`},
+		{"unterminated single quote", "metrics_host='https://metrics.example.com\n", `:1: metrics_host: unterminated single quote`},
+		{"enabled", "enabled=yes please\n", `:1: enabled: unexpected "please" after the value`},
+		{"unquoted space", "metrics_customer=Acme Corp\n", `:1: metrics_customer: unexpected "Corp" after the value`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadMetricsConfigValues(writeMetricsConfig(t, tt.content))
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestReadMetricsConfigValuesSkipsBadOptionalLines(t *testing.T) {
+	path := writeMetricsConfig(t, "enabled=1\n"+minimalMetricsConfig+
+		"report_title=Acme Corp\nmetrics_passwd='secret\nmetrics_user=push\n")
+
+	got, err := ReadMetricsConfigValues(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "acme", got["metrics_customer"])
+	assert.Equal(t, "push", got["metrics_user"], "lines after a bad one are read")
+	assert.NotContains(t, got, "report_title")
+	assert.NotContains(t, got, "metrics_passwd")
+	assert.True(t, IsCommandRunnerEnabled(path))
+}
+
+func TestReadMetricsConfigValuesEnvOverrides(t *testing.T) {
+	t.Setenv("CR_METRICS_HOST", "https://override.example.com")
+	t.Setenv("CR_METRICS_GZIP", "1")
+
+	got, err := ReadMetricsConfigValues(writeMetricsConfig(t, minimalMetricsConfig))
+	assert.NoError(t, err)
+	assert.Equal(t, "https://override.example.com", got["metrics_host"])
+	assert.Equal(t, "acme", got["metrics_customer"])
+	assert.Equal(t, "1", got["metrics_gzip"])
+
+	t.Setenv("CR_FOO", "bar")
+	got, err = ReadMetricsConfigValues(writeMetricsConfig(t, minimalMetricsConfig))
+	assert.NoError(t, err)
+	assert.NotContains(t, got, "foo", "only keys of the metrics config are overridden")
+}
+
+func TestParseMetricsConfig(t *testing.T) {
+	t.Setenv(EnvMetricsPasswd, "")
+	config, err := ParseMetricsConfig(writeMetricsConfig(t, "enabled=1\n"+minimalMetricsConfig+
+		"metrics_instance=\"master 1\"\nmetrics_user=push\nmetrics_passwd='s3cret pass'\nmetrics_gzip=yes\nmetrics_chunk_size=1048576\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, MetricsConfig{
+		Enabled:     true,
+		Host:        "https://metrics.example.com:9092",
+		Customer:    "acme",
+		Instance:    "master 1",
+		User:        "push",
+		Passwd:      "s3cret pass",
+		Gzip:        true,
+		ChunkSize:   1048576,
+		PushTimeout: DefaultPushTimeout,
+	}, config)
+}
+
+func TestParseMetricsConfigPasswd(t *testing.T) {
+	passwdFile := filepath.Join(t.TempDir(), "passwd")
+	assert.NoError(t, os.WriteFile(passwdFile, []byte("from-file\n"), 0600))
+
+	tests := []struct {
+		name    string
+		content string
+		env     string
+		want    string
+	}{
+		{"from config", "metrics_passwd=from-config\n", "", "from-config"},
+		{"from file", "metrics_passwd=from-config\nmetrics_passwd_file=" + passwdFile + "\n", "", "from-file"},
+		{"from env", "metrics_passwd=from-config\nmetrics_passwd_file=" + passwdFile + "\n", "from-env", "from-env"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(EnvMetricsPasswd, tt.env)
+			config, err := ParseMetricsConfig(writeMetricsConfig(t, minimalMetricsConfig+tt.content))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, config.Passwd)
+		})
+	}
+}
+
+func TestParseMetricsConfigErrors(t *testing.T) {
+	t.Setenv(EnvMetricsPasswd, "")
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"empty", "", "metrics_customer is required; metrics_host (or metrics_json_url) is required"},
+		{"missing customer", "metrics_host=https://metrics.example.com\n", "metrics_customer is required"},
+		{"bad chunk size", minimalMetricsConfig + "metrics_chunk_size=1MB\n", `metrics_chunk_size "1MB" must be a number of bytes`},
+		{"bad push timeout", minimalMetricsConfig + "metrics_push_timeout=soon\n", `metrics_push_timeout: timeout "soon" is not a duration or number of seconds`},
+		{"cert without key", minimalMetricsConfig + "metrics_client_cert=/etc/cr/client.pem\n", "metrics_client_cert and metrics_client_key must be set together"},
+		{"missing passwd file", minimalMetricsConfig + "metrics_passwd_file=/nonexistent/passwd\n", "error reading metrics_passwd_file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseMetricsConfig(writeMetricsConfig(t, tt.content))
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+
+	_, err := ParseMetricsConfig(writeMetricsConfig(t, ""))
+	assert.ErrorIs(t, err, ErrInvalidMetricsConfig)
+}
+
+func TestParseMetricsConfigPushTimeout(t *testing.T) {
+	tests := []struct {
+		content string
+		want    time.Duration
+	}{
+		{"", DefaultPushTimeout},
+		{"metrics_push_timeout=5m\n", 5 * time.Minute},
+		{"metrics_push_timeout=300\n", 300 * time.Second},
+		{"metrics_push_timeout=0\n", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.content, func(t *testing.T) {
+			config, err := ParseMetricsConfig(writeMetricsConfig(t, minimalMetricsConfig+tt.content))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, config.PushTimeout)
+		})
+	}
+}
+
+func TestParseMetricsConfigJSONURLWithoutHost(t *testing.T) {
+	config, err := ParseMetricsConfig(writeMetricsConfig(t, "metrics_json_url=https://metrics.example.com:9092/json/\nmetrics_customer=acme\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "https://metrics.example.com:9092/json/", config.JSONURL)
+}
+
+func TestIsCommandRunnerEnabled(t *testing.T) {
+	tests := []struct {
+		content string
+		want    bool
+	}{
+		{"enabled=1\n", true},
+		{"  enabled = true # turned on by the SDP install\n", true},
+		{"export enabled=\"yes\"\n", true},
+		{"enabled=0\n", false},
+		{"#enabled=1\n", false},
+		{"metrics_customer=acme\n", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.content, func(t *testing.T) {
+			assert.Equal(t, tt.want, IsCommandRunnerEnabled(writeMetricsConfig(t, tt.content)))
+		})
+	}
+
+	assert.False(t, IsCommandRunnerEnabled(filepath.Join(t.TempDir(), "missing.cfg")))
+	t.Setenv("CR_ENABLED", "0")
+	assert.False(t, IsCommandRunnerEnabled(writeMetricsConfig(t, "enabled=1\n")))
+}
@@ -0,0 +1,100 @@
+package schema
+
+import (
+	"command-runner/helpers"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SetMetricsConfigValues sets keys in the metrics config at path, leaving the rest of the file as it was:
+// comments, blank lines and other keys keep their place, a key already set keeps its line (any later
+// duplicates are dropped) and new keys are appended in name order, quoted when the shell needs it. The
+// file is only rewritten when its content changes, atomically and with its current permissions and
+// owner; when path is a symlink, the file it points to is rewritten and the link kept. It reports
+// whether it was rewritten.
+func SetMetricsConfigValues(path string, values map[string]string) (bool, error) {
+	path, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false, err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+
+	text := string(content)
+	endsWithNewline := text == "" || strings.HasSuffix(text, "\n")
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	if text == "" {
+		lines = nil
+	}
+
+	done := map[string]bool{}
+	kept := lines[:0]
+	for _, line := range lines {
+		key, raw, ok := splitMetricsConfigLine(line)
+		value, set := values[key]
+		if !ok || !set {
+			kept = append(kept, line)
+			continue
+		}
+		if done[key] {
+			continue // A duplicate, which would otherwise override the value set above
+		}
+		done[key] = true
+		if current, err := unquoteMetricsValue(raw); err == nil && current == value {
+			kept = append(kept, line) // Keep the quoting and any comment
+		} else {
+			kept = append(kept, line[:strings.Index(line, "=")+1]+quoteMetricsValue(value))
+		}
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		if !done[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		kept = append(kept, key+"="+quoteMetricsValue(values[key]))
+	}
+
+	updated := strings.Join(kept, "\n")
+	if len(kept) > 0 && (endsWithNewline || len(keys) > 0) {
+		updated += "\n"
+	}
+	if updated == text {
+		return false, nil
+	}
+	if err := writeLike(path, []byte(updated), fi); err != nil {
+		return false, fmt.Errorf("error writing %s: %w", path, err)
+	}
+	return true, nil
+}
+
+// writeLike atomically replaces path with data, keeping the permissions and owner described by fi
+func writeLike(path string, data []byte, fi os.FileInfo) error {
+	tmp, err := helpers.CreateTempFor(path, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if err := helpers.ChownLike(tmp, fi); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	return helpers.CommitTemp(tmp, path)
+}
@@ -0,0 +1,155 @@
+package schema
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetMetricsConfigValues(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		values      map[string]string
+		want        string
+		wantChanged bool
+	}{
+		{
+			name:        "replaces the old value in place",
+			content:     "# Metrics settings\nmetrics_host=https://metrics.example.com\nmetrics_cloudtype=onprem\nmetrics_customer=acme\n",
+			values:      map[string]string{"metrics_cloudtype": "aws"},
+			want:        "# Metrics settings\nmetrics_host=https://metrics.example.com\nmetrics_cloudtype=aws\nmetrics_customer=acme\n",
+			wantChanged: true,
+		},
+		{
+			name:        "drops duplicates left by older versions",
+			content:     "metrics_cloudtype=onprem\nmetrics_customer=acme\n\nmetrics_cloudtype=gcp\nmetrics_cloudtype=aws\n",
+			values:      map[string]string{"metrics_cloudtype": "azure"},
+			want:        "metrics_cloudtype=azure\nmetrics_customer=acme\n\n",
+			wantChanged: true,
+		},
+		{
+			name:        "appends new keys in name order",
+			content:     "metrics_host=https://metrics.example.com\n",
+			values:      map[string]string{"metrics_instance": "1", "metrics_cloudtype": "gcp"},
+			want:        "metrics_host=https://metrics.example.com\nmetrics_cloudtype=gcp\nmetrics_instance=1\n",
+			wantChanged: true,
+		},
+		{
+			name:        "appends after a last line without newline",
+			content:     "metrics_host=https://metrics.example.com",
+			values:      map[string]string{"metrics_cloudtype": "gcp"},
+			want:        "metrics_host=https://metrics.example.com\nmetrics_cloudtype=gcp\n",
+			wantChanged: true,
+		},
+		{
+			name:        "keeps export and indentation",
+			content:     "  export metrics_cloudtype=onprem\n",
+			values:      map[string]string{"metrics_cloudtype": "aws"},
+			want:        "  export metrics_cloudtype=aws\n",
+			wantChanged: true,
+		},
+		{
+			name:        "ignores commented out keys",
+			content:     "#metrics_cloudtype=gcp\n",
+			values:      map[string]string{"metrics_cloudtype": "aws"},
+			want:        "#metrics_cloudtype=gcp\nmetrics_cloudtype=aws\n",
+			wantChanged: true,
+		},
+		{
+			name:        "quotes values the shell would change",
+			content:     "metrics_customer=acme\n",
+			values:      map[string]string{"metrics_customer": "Acme's Corp", "metrics_instance": ""},
+			want:        "metrics_customer='Acme'\\''s Corp'\nmetrics_instance=''\n",
+			wantChanged: true,
+		},
+		{
+			name:    "unchanged quoted value keeps its quoting",
+			content: "metrics_cloudtype=\"aws\" # detected\n",
+			values:  map[string]string{"metrics_cloudtype": "aws"},
+			want:    "metrics_cloudtype=\"aws\" # detected\n",
+		},
+		{
+			name:    "unchanged",
+			content: "metrics_customer=acme\nmetrics_cloudtype=aws\n",
+			values:  map[string]string{"metrics_cloudtype": "aws"},
+			want:    "metrics_customer=acme\nmetrics_cloudtype=aws\n",
+		},
+		{
+			name:        "empty file",
+			values:      map[string]string{"metrics_cloudtype": "aws"},
+			want:        "metrics_cloudtype=aws\n",
+			wantChanged: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), ".push_metrics.cfg")
+			assert.NoError(t, os.WriteFile(path, []byte(tt.content), 0640))
+			assert.NoError(t, os.Chmod(path, 0640))
+
+			changed, err := SetMetricsConfigValues(path, tt.values)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantChanged, changed)
+
+			got, err := os.ReadFile(path)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, string(got))
+			fi, err := os.Stat(path)
+			assert.NoError(t, err)
+			assert.Equal(t, os.FileMode(0640), fi.Mode().Perm())
+		})
+	}
+}
+
+func TestSetMetricsConfigValuesUnchangedIsNotRewritten(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, ".push_metrics.cfg")
+	assert.NoError(t, os.WriteFile(path, []byte("metrics_cloudtype=aws\n"), 0600))
+	before, err := os.Stat(path)
+	assert.NoError(t, err)
+
+	changed, err := SetMetricsConfigValues(path, map[string]string{"metrics_cloudtype": "aws"})
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	after, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.True(t, os.SameFile(before, after), "the file was replaced")
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestSetMetricsConfigValuesMissingFile(t *testing.T) {
+	_, err := SetMetricsConfigValues(filepath.Join(t.TempDir(), "missing.cfg"), map[string]string{"metrics_cloudtype": "aws"})
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestSetMetricsConfigValuesThroughSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "p4", "common", "config", ".push_metrics.cfg")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(target), 0700))
+	assert.NoError(t, os.WriteFile(target, []byte("metrics_customer=acme\n"), 0640))
+	link := filepath.Join(dir, ".push_metrics.cfg")
+	if err := os.Symlink(target, link); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+
+	changed, err := SetMetricsConfigValues(link, map[string]string{"metrics_cloudtype": "aws"})
+	assert.NoError(t, err)
+	assert.True(t, changed)
+
+	fi, err := os.Lstat(link)
+	assert.NoError(t, err)
+	assert.Equal(t, os.ModeSymlink, fi.Mode().Type(), "the link is kept")
+	got, err := os.ReadFile(target)
+	assert.NoError(t, err)
+	assert.Equal(t, "metrics_customer=acme\nmetrics_cloudtype=aws\n", string(got))
+	entries, err := os.ReadDir(filepath.Dir(target))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
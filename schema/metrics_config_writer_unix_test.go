@@ -0,0 +1,32 @@
+//go:build !windows
+
+package schema
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetMetricsConfigValuesKeepsOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing the owner of a file needs root")
+	}
+	path := filepath.Join(t.TempDir(), ".push_metrics.cfg")
+	assert.NoError(t, os.WriteFile(path, []byte("metrics_customer=acme\n"), 0640))
+	assert.NoError(t, os.Chown(path, 1234, 5678))
+
+	changed, err := SetMetricsConfigValues(path, map[string]string{"metrics_cloudtype": "aws"})
+	assert.NoError(t, err)
+	assert.True(t, changed)
+
+	fi, err := os.Stat(path)
+	assert.NoError(t, err)
+	st := fi.Sys().(*syscall.Stat_t)
+	assert.Equal(t, uint32(1234), st.Uid)
+	assert.Equal(t, uint32(5678), st.Gid)
+	assert.Equal(t, os.FileMode(0640), fi.Mode().Perm())
+}
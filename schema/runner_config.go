@@ -0,0 +1,218 @@
+package schema
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// command-runner.yaml optionally holds the settings otherwise given as flags, which COMMAND_RUNNER_*
+// environment variables may also set
+const (
+	RunnerConfigFileName    = "command-runner.yaml"
+	DefaultRunnerConfigPath = DefaultP4VarDir + RunnerConfigFileName
+	settingEnvPrefix        = "COMMAND_RUNNER_"
+)
+
+// Where a setting came from, in order of precedence
+const (
+	SourceFlag    = "flag"
+	SourceEnv     = "env"
+	SourceFile    = "file"
+	SourceProfile = "profile"
+	SourceDefault = "default"
+)
+
+// ResolvedSetting is where a setting comes from, and its value when it comes from the file or the profile.
+// Flags, environment variables and defaults are applied by the command line parser.
+type ResolvedSetting struct {
+	Source string
+	Value  string
+}
+
+// Built-in profiles, which profiles: in command-runner.yaml may redefine
+const (
+	ProfileMinimal     = "minimal"
+	ProfileFullSupport = "full-support"
+)
+
+// BuiltinProfiles are the settings of the built-in profiles, by flag name
+var BuiltinProfiles = map[string]map[string]string{
+	// Only the OS and P4 commands, one at a time
+	ProfileMinimal: {"autobots": "false", "allSDP": "false", "autocloud": "false", "parallel": "1"},
+	// Everything support may need: every SDP instance, autobots and the cloud instance metadata
+	ProfileFullSupport: {"server": "true", "autobots": "true", "allSDP": "true", "autocloud": "true"},
+}
+
+// ProfileRequires lists the settings a built-in profile needs but cannot set, as they differ from server to
+// server. full-support runs with --server, which needs --instance.
+var ProfileRequires = map[string][]string{
+	ProfileFullSupport: {"instance"},
+}
+
+// RunnerConfigPath returns where command-runner.yaml is looked for without --config: in the SDP config
+// directory p4VarDir
+func RunnerConfigPath(p4VarDir string) string {
+	if p4VarDir == "" || p4VarDir == DefaultP4VarDir {
+		return DefaultRunnerConfigPath
+	}
+	return filepath.Join(p4VarDir, RunnerConfigFileName)
+}
+
+// RunnerConfig is command-runner.yaml. Settings are named after the command line flags (log, output,
+// cmdcfg, mcfg, parallel, state-dir, p4-base-dir, autobots-dir, ...) and apply when neither the flag nor
+// its COMMAND_RUNNER_* environment variable is given. A profile supplies settings the file does not set.
+type RunnerConfig struct {
+	Profile  string                       `yaml:"profile"`  // Name of the profile to use, overridden by --profile
+	Settings map[string]string            `yaml:"settings"` // Setting name to value
+	Profiles map[string]map[string]string `yaml:"profiles"` // Profiles added to or replacing BuiltinProfiles
+	Sinks    []SinkConfig                 `yaml:"sinks"`    // Replace the sinks of cmd_config.yaml when set
+}
+
+// LoadRunnerConfig reads command-runner.yaml at path. A file that does not exist gives an empty config
+// unless required is set, as the file is optional at its default location.
+func LoadRunnerConfig(path string, required bool) (RunnerConfig, error) {
+	var config RunnerConfig
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) && !required {
+		return config, nil
+	}
+	if err != nil {
+		return config, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return config, fmt.Errorf("failed to unmarshal %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// SettingEnvVar returns the environment variable of a setting: COMMAND_RUNNER_ and its name in upper case,
+// with - replaced by _, e.g. COMMAND_RUNNER_STATE_DIR for state-dir
+func SettingEnvVar(name string) string {
+	return settingEnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// Resolve decides where each of the named settings comes from: a flag (given), its environment variable,
+// the settings of the file, the profile (the named one, or else the one the file selects) or the default.
+// A setting in the file or the profile that is not one of names is an error.
+func (c RunnerConfig) Resolve(names []string, profile string, given map[string]bool) (map[string]ResolvedSetting, error) {
+	if profile == "" {
+		profile = c.Profile
+	}
+	profileSettings, err := c.ProfileSettings(profile)
+	if err != nil {
+		return nil, err
+	}
+	known := map[string]bool{}
+	for _, name := range names {
+		known[name] = true
+	}
+	for _, in := range []struct {
+		where    string
+		settings map[string]string
+	}{{"settings", c.Settings}, {"profile " + profile, profileSettings}} {
+		for name := range in.settings {
+			if !known[name] {
+				return nil, fmt.Errorf("unknown setting %q in %s", name, in.where)
+			}
+		}
+	}
+
+	resolved := map[string]ResolvedSetting{}
+	for _, name := range names {
+		fileValue, inFile := c.Settings[name]
+		profileValue, inProfile := profileSettings[name]
+		switch {
+		case given[name]:
+			resolved[name] = ResolvedSetting{Source: SourceFlag}
+		case os.Getenv(SettingEnvVar(name)) != "":
+			resolved[name] = ResolvedSetting{Source: SourceEnv}
+		case inFile:
+			resolved[name] = ResolvedSetting{Source: SourceFile, Value: fileValue}
+		case inProfile:
+			resolved[name] = ResolvedSetting{Source: SourceProfile, Value: profileValue}
+		default:
+			resolved[name] = ResolvedSetting{Source: SourceDefault}
+		}
+	}
+	return resolved, nil
+}
+
+// CheckRequired returns an error naming the settings of ProfileRequires that resolved (see Resolve) leaves
+// at their default, for the named profile or else the one the file selects. A profile the file redefines
+// requires nothing.
+func (c RunnerConfig) CheckRequired(profile string, resolved map[string]ResolvedSetting) error {
+	if profile == "" {
+		profile = c.Profile
+	}
+	if _, redefined := c.Profiles[profile]; redefined {
+		return nil
+	}
+	var missing []string
+	for _, name := range ProfileRequires[profile] {
+		if setting, ok := resolved[name]; !ok || setting.Source == SourceDefault {
+			missing = append(missing, fmt.Sprintf("%s (--%s, %s or settings)", name, name, SettingEnvVar(name)))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("profile %s needs %s", profile, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// ProfileSettings returns the settings of the named profile, looked up in the file's profiles and then in
+// BuiltinProfiles. An empty name means no profile.
+func (c RunnerConfig) ProfileSettings(name string) (map[string]string, error) {
+	if name == "" {
+		return nil, nil
+	}
+	if settings, ok := c.Profiles[name]; ok {
+		return settings, nil
+	}
+	if settings, ok := BuiltinProfiles[name]; ok {
+		return settings, nil
+	}
+	return nil, fmt.Errorf("unknown profile %q, expecting one of: %s", name, strings.Join(c.ProfileNames(), ", "))
+}
+
+// ProfileNames returns the names of the built-in profiles and those of the file, sorted
+func (c RunnerConfig) ProfileNames() []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, profiles := range []map[string]map[string]string{BuiltinProfiles, c.Profiles} {
+		for name := range profiles {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// MaskSecret returns value masked when key names a secret (a password, token, API key or Authorization
+// header), and otherwise with the password of a URL masked, for printing settings. Keys ending in _file
+// name the file holding a secret and are not masked.
+func MaskSecret(key, value string) string {
+	if value == "" {
+		return value
+	}
+	lower := strings.ToLower(key)
+	for _, secret := range []string{"passwd", "password", "token", "secret", "authorization", "api-key", "apikey"} {
+		if strings.Contains(lower, secret) && !strings.HasSuffix(lower, "_file") {
+			return "****"
+		}
+	}
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			return strings.Replace(u.Redacted(), ":xxxxx@", ":****@", 1)
+		}
+	}
+	return value
+}
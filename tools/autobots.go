@@ -7,23 +7,18 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
 var (
-	autobotsDir       = schema.AutobotsDir //TODO Should be editable
 	osScriptsExecuted bool
 )
 
-func init() {
-	//	exeDir := schema.GetExecutableDir()
-	//	autobotsDir = schema.GetConfigPath(exeDir, schema.AutobotsDir)
-}
-
 // HandleAutobotsScripts runs all scripts/binaries in the autobots directory
-func HandleAutobotsScripts(OutputJSONFilePath string, instanceArg string, autobotsArg bool) error {
-	files, err := ioutil.ReadDir(autobotsDir)
+func HandleAutobotsScripts(collector *Collector, instanceArg string, autobotsArg bool) error {
+	files, err := ioutil.ReadDir(schema.AutobotsDir)
 	if err != nil {
 		return fmt.Errorf("error reading autobots directory: %w", err)
 	}
@@ -48,9 +43,10 @@ func HandleAutobotsScripts(OutputJSONFilePath string, instanceArg string, autobo
 			prepend := prefix == "P4_"
 
 			logrus.Debugf("running P4 Autobots")
-			//cmdPath := filepath.Join(autobotsDir, file.Name())
+			//cmdPath := filepath.Join(schema.AutobotsDir, file.Name())
 			//output, _, err := ExecuteShellCommand(cmdPath, prependSource, instanceArg)
-			output, err := RunAutoBotCommand(autobotsDir+"/"+file.Name(), instanceArg, prepend)
+			start := time.Now()
+			output, err := RunAutoBotCommand(filepath.Join(schema.AutobotsDir, file.Name()), instanceArg, prepend)
 			//output, _, err := ExecuteShellCommand(cmd.Command, prependSource, instanceArg)
 			if err != nil {
 				logrus.Errorf("Error running command %s: %s", file.Name(), err)
@@ -67,19 +63,15 @@ func HandleAutobotsScripts(OutputJSONFilePath string, instanceArg string, autobo
 				description = fmt.Sprintf("[OS] Output from %s", monitorTag)
 			}
 
-			jsonData := JSONData{
-				Command:     fmt.Sprintf("Autobot: %s", monitorTag),
-				Description: description,
-				Output:      EncodeToBase64(output),
-				MonitorTag:  fmt.Sprintf("Autobot %s", monitorTag),
-			}
-			logrus.Debugf("results: %s", []JSONData{jsonData})
-			logrus.Debugf("OutputJSONFilePath: %s", OutputJSONFilePath)
+			jsonData := newResult(SourceAutobot, instanceArg, start)
+			jsonData.Command = fmt.Sprintf("Autobot: %s", monitorTag)
+			jsonData.Description = description
+			jsonData.Output = EncodeToBase64(output)
+			jsonData.MonitorTag = fmt.Sprintf("Autobot %s", monitorTag)
+			jsonData.setError(err)
+			logrus.Debugf("results: %v", []JSONData{jsonData})
 
-			// Save results to OutputJSONFilePath
-			if err := AppendParsedDataToFile([]JSONData{jsonData}, OutputJSONFilePath); err != nil {
-				logrus.Errorf("[Autobots] error appending data to output for %s: %v", prefix, err)
-			}
+			collector.Add(jsonData)
 		}
 
 		// Set the flag only after processing all OS-level scripts in one go
@@ -97,8 +89,8 @@ func isExecutable(mode os.FileMode) bool {
 }
 
 // Handle OS-level Autobots scripts
-func HandleOSAutobotsScripts(OutputJSONFilePath string, instanceArg string) error {
-	files, err := ioutil.ReadDir(autobotsDir)
+func HandleOSAutobotsScripts(collector *Collector, instanceArg string) error {
+	files, err := ioutil.ReadDir(schema.AutobotsDir)
 	if err != nil {
 		return fmt.Errorf("error reading autobots directory: %w", err)
 	}
@@ -108,23 +100,22 @@ func HandleOSAutobotsScripts(OutputJSONFilePath string, instanceArg string) erro
 			continue
 		}
 
-		cmdPath := filepath.Join(autobotsDir, file.Name())
+		cmdPath := filepath.Join(schema.AutobotsDir, file.Name())
+		start := time.Now()
 		output, err := RunAutoBotCommand(cmdPath, instanceArg, false)
 		if err != nil {
 			logrus.Errorf("Error running OS-level command %s: %s", file.Name(), err)
 		}
 
 		description := fmt.Sprintf("[OS] Output from %s", strings.TrimPrefix(file.Name(), "OS_"))
-		jsonData := JSONData{
-			Command:     fmt.Sprintf("Autobot: %s", file.Name()),
-			Description: description,
-			Output:      EncodeToBase64(output),
-			MonitorTag:  fmt.Sprintf("Autobot %s", file.Name()),
-		}
-
-		if err := AppendParsedDataToFile([]JSONData{jsonData}, OutputJSONFilePath); err != nil {
-			logrus.Errorf("[Autobots] error appending data to output for OS-level scripts: %v", err)
-		}
+		jsonData := newResult(SourceAutobot, "", start)
+		jsonData.Command = fmt.Sprintf("Autobot: %s", file.Name())
+		jsonData.Description = description
+		jsonData.Output = EncodeToBase64(output)
+		jsonData.MonitorTag = fmt.Sprintf("Autobot %s", file.Name())
+		jsonData.setError(err)
+
+		collector.Add(jsonData)
 	}
 
 	logrus.Info("OS-level Autobots scripts executed and results saved.")
@@ -132,8 +123,8 @@ func HandleOSAutobotsScripts(OutputJSONFilePath string, instanceArg string) erro
 }
 
 // Handle SDP/P4-level Autobots scripts
-func HandleSDPinstanceAutobotsScripts(OutputJSONFilePath string, instanceArg string) error {
-	files, err := ioutil.ReadDir(autobotsDir)
+func HandleSDPinstanceAutobotsScripts(collector *Collector, instanceArg string) error {
+	files, err := ioutil.ReadDir(schema.AutobotsDir)
 	if err != nil {
 		return fmt.Errorf("error reading autobots directory: %w", err)
 	}
@@ -143,23 +134,22 @@ func HandleSDPinstanceAutobotsScripts(OutputJSONFilePath string, instanceArg str
 			continue
 		}
 
-		cmdPath := filepath.Join(autobotsDir, file.Name())
+		cmdPath := filepath.Join(schema.AutobotsDir, file.Name())
+		start := time.Now()
 		output, err := RunAutoBotCommand(cmdPath, instanceArg, true)
 		if err != nil {
 			logrus.Errorf("Error running SDP/P4-level command %s: %s", file.Name(), err)
 		}
 
 		description := fmt.Sprintf("[SDP Instance: %s] Output from %s", instanceArg, strings.TrimPrefix(file.Name(), "P4_"))
-		jsonData := JSONData{
-			Command:     fmt.Sprintf("Autobot: %s", file.Name()),
-			Description: description,
-			Output:      EncodeToBase64(output),
-			MonitorTag:  fmt.Sprintf("Autobot %s", file.Name()),
-		}
-
-		if err := AppendParsedDataToFile([]JSONData{jsonData}, OutputJSONFilePath); err != nil {
-			logrus.Errorf("[Autobots] error appending data to output for SDP/P4-level scripts: %v", err)
-		}
+		jsonData := newResult(SourceAutobot, instanceArg, start)
+		jsonData.Command = fmt.Sprintf("Autobot: %s", file.Name())
+		jsonData.Description = description
+		jsonData.Output = EncodeToBase64(output)
+		jsonData.MonitorTag = fmt.Sprintf("Autobot %s", file.Name())
+		jsonData.setError(err)
+
+		collector.Add(jsonData)
 	}
 
 	logrus.Info("SDP/P4-level Autobots scripts executed and results saved.")
@@ -0,0 +1,69 @@
+package tools
+
+import (
+	"command-runner/helpers"
+	"command-runner/schema"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// cloudCacheFile holds the last cloud provider detected, in the state directory
+const cloudCacheFile = "cloud_detection.json"
+
+// cloudDetection is a cached DetectCloudProvider result. The DMI vendor and product it was detected on are
+// kept so that a disk image cloned to another machine detects again.
+type cloudDetection struct {
+	CloudProvider string    `json:"cloud_provider"`
+	DetectedAt    time.Time `json:"detected_at"`
+	SysVendor     string    `json:"sys_vendor,omitempty"`
+	ProductName   string    `json:"product_name,omitempty"`
+}
+
+// DetectCloudProviderCached returns the cloud provider detected by an earlier run if it is younger than
+// schema.CloudCacheTTL, and otherwise detects it and caches the result in schema.StateDir. A TTL of 0 or
+// an empty state directory disables the cache.
+func DetectCloudProviderCached() (string, error) {
+	if schema.CloudCacheTTL <= 0 || schema.StateDir == "" {
+		return DetectCloudProvider()
+	}
+	path := filepath.Join(schema.StateDir, cloudCacheFile)
+	platform := DetectPlatform()
+
+	var cached cloudDetection
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &cached); err != nil {
+			logrus.Warnf("Ignoring corrupt cloud detection cache %s: %v", path, err)
+		} else if age := time.Since(cached.DetectedAt); cached.CloudProvider != "" && age >= 0 && age < schema.CloudCacheTTL &&
+			cached.SysVendor == platform.SysVendor && cached.ProductName == platform.ProductName {
+			logrus.Infof("Using cloud provider %s detected %s ago", cached.CloudProvider, age.Round(time.Second))
+			return cached.CloudProvider, nil
+		}
+	} else if !os.IsNotExist(err) {
+		logrus.Warnf("Error reading cloud detection cache: %v", err)
+	}
+
+	provider, err := DetectCloudProvider()
+	if err != nil {
+		return "", err
+	}
+	cached = cloudDetection{CloudProvider: provider, DetectedAt: time.Now().UTC(), SysVendor: platform.SysVendor, ProductName: platform.ProductName}
+	if err := saveCloudDetection(path, cached); err != nil {
+		logrus.Warnf("Error saving cloud detection cache, the provider will be detected again next run: %v", err)
+	}
+	return provider, nil
+}
+
+func saveCloudDetection(path string, detection cloudDetection) error {
+	data, err := json.MarshalIndent(detection, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return helpers.WriteFileAtomic(path, data, 0600)
+}
@@ -0,0 +1,86 @@
+package tools
+
+import (
+	"command-runner/schema"
+	"command-runner/tools/fakemetadata"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setupCloudCache hides the host's DMI data behind a GCP metadata server and uses a fresh state directory
+func setupCloudCache(t *testing.T, ttl time.Duration) *fakemetadata.Server {
+	server := fakemetadata.NewGCP(t)
+	setupCloudTest(t, server.URL)
+	stateDir, savedTTL := schema.StateDir, schema.CloudCacheTTL
+	schema.StateDir, schema.CloudCacheTTL = t.TempDir(), ttl
+	t.Cleanup(func() { schema.StateDir, schema.CloudCacheTTL = stateDir, savedTTL })
+	return server
+}
+
+func writeCloudCache(t *testing.T, detection cloudDetection) {
+	data, err := json.Marshal(detection)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(schema.StateDir, cloudCacheFile), data, 0600))
+}
+
+func TestDetectCloudProviderCached(t *testing.T) {
+	tests := []struct {
+		name       string
+		ttl        time.Duration
+		cached     *cloudDetection
+		want       string
+		wantProbes bool
+	}{
+		{"no cache detects", time.Hour, nil, "gcp", true},
+		{"fresh cache is used", time.Hour, &cloudDetection{CloudProvider: "azure", DetectedAt: time.Now().Add(-time.Minute)}, "azure", false},
+		{"expired cache detects", time.Hour, &cloudDetection{CloudProvider: "azure", DetectedAt: time.Now().Add(-2 * time.Hour)}, "gcp", true},
+		{"cache from another machine detects", time.Hour, &cloudDetection{CloudProvider: "azure", DetectedAt: time.Now(), SysVendor: "Microsoft Corporation"}, "gcp", true},
+		{"ttl 0 detects", 0, &cloudDetection{CloudProvider: "azure", DetectedAt: time.Now()}, "gcp", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := setupCloudCache(t, tt.ttl)
+			if tt.cached != nil {
+				writeCloudCache(t, *tt.cached)
+			}
+
+			got, err := DetectCloudProviderCached()
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantProbes, len(server.Requests()) > 0)
+		})
+	}
+}
+
+func TestDetectCloudProviderCachedSavesResult(t *testing.T) {
+	server := setupCloudCache(t, time.Hour)
+
+	got, err := DetectCloudProviderCached()
+	assert.NoError(t, err)
+	assert.Equal(t, "gcp", got)
+	probes := len(server.Requests())
+
+	got, err = DetectCloudProviderCached()
+	assert.NoError(t, err)
+	assert.Equal(t, "gcp", got)
+	assert.Len(t, server.Requests(), probes, "the second run probed again")
+
+	fi, err := os.Stat(filepath.Join(schema.StateDir, cloudCacheFile))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+}
+
+func TestDetectCloudProviderCachedCorruptCache(t *testing.T) {
+	setupCloudCache(t, time.Hour)
+	assert.NoError(t, os.WriteFile(filepath.Join(schema.StateDir, cloudCacheFile), []byte("{not json"), 0600))
+
+	got, err := DetectCloudProviderCached()
+	assert.NoError(t, err)
+	assert.Equal(t, "gcp", got)
+}
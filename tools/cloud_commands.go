@@ -1,6 +1,7 @@
 /* cloudd_commands.go
  	aws_commands.go
 	gcp_commands.go
+	azure_commands.go
 */
 
 package tools
@@ -8,11 +9,13 @@ package tools
 // Add your AWS-specific functions and structures here.
 
 import (
+	"command-runner/schema"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"os"
+	"net/url"
 	"strings"
 	"time"
 
@@ -20,43 +23,83 @@ import (
 )
 
 const (
-	AWSEndpoint   = "http://169.254.169.254"
-	AWSTokenTTL   = "21600"
-	ClientTimeout = 5 * time.Second
+	AWSTokenTTL             = "21600"
+	AzureInstanceAPIVersion = "2021-02-01"
+	AzureAttestedAPIVersion = "2020-09-01"
+	ClientTimeout           = 5 * time.Second
 	//http constants
 	autoCloudTimeout = 5 * time.Second // assuming 5 seconds for the timeout
 )
 
 var httpClient = &http.Client{Timeout: ClientTimeout}
 
-// GetAWSToken retrieves the AWS metadata token.
-func GetAWSToken(OutputJSONFilePath string) (string, error) {
+var (
+	// errAWSTokenRefused is returned by GetAWSToken when IMDS answers the token request with an error status,
+	// as it does where IMDSv2 is unavailable
+	errAWSTokenRefused = errors.New("AWS metadata token refused")
+	// errAWSMetadataNotFound is returned by getAWSEndpoint for a 404, e.g. for tags when instance tags are
+	// not allowed in metadata
+	errAWSMetadataNotFound = errors.New("not found in AWS metadata")
+)
+
+// AWSInstanceInfo is what GetAWSInstanceIdentityInfo collects: the main fields of the instance identity
+// document and the instance tags with their values
+type AWSInstanceInfo struct {
+	InstanceID       string            `json:"instance_id"`
+	InstanceType     string            `json:"instance_type"`
+	Region           string            `json:"region"`
+	AvailabilityZone string            `json:"availability_zone"`
+	AccountID        string            `json:"account_id"`
+	ImageID          string            `json:"image_id"`
+	Architecture     string            `json:"architecture,omitempty"`
+	PrivateIP        string            `json:"private_ip,omitempty"`
+	PendingTime      string            `json:"pending_time,omitempty"`
+	Tags             map[string]string `json:"tags"`
+	IMDSVersion      string            `json:"imds_version"` // "v2", or "v1" when no token could be had
+}
+
+// awsIdentityDocument is the part of the instance identity document kept in AWSInstanceInfo
+type awsIdentityDocument struct {
+	AccountID        string `json:"accountId"`
+	Architecture     string `json:"architecture"`
+	AvailabilityZone string `json:"availabilityZone"`
+	ImageID          string `json:"imageId"`
+	InstanceID       string `json:"instanceId"`
+	InstanceType     string `json:"instanceType"`
+	PendingTime      string `json:"pendingTime"`
+	PrivateIP        string `json:"privateIp"`
+	Region           string `json:"region"`
+}
+
+// GetAWSToken retrieves the AWS metadata token. errAWSTokenRefused is returned if IMDS refuses to hand
+// one out. Errors are left for the caller to record.
+func GetAWSToken() (string, error) {
 	logrus.Info("Fetching AWS metadata token...")
 
-	tokenURL := fmt.Sprintf("%s/latest/api/token", AWSEndpoint)
+	tokenURL := fmt.Sprintf("%s/latest/api/token", schema.AWSMetadataEndpoint)
 	req, err := http.NewRequest("PUT", tokenURL, nil)
 	if err != nil {
-		saveErrorToJSON(OutputJSONFilePath, "GetAWSToken", fmt.Sprintf("Failed to create request for AWS token: %s", err), "AWS")
-		return "", err
+		return "", fmt.Errorf("failed to create request for AWS token: %w", err)
 	}
 	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", AWSTokenTTL)
 	resp, err := httpClient.Do(req)
 
 	if err != nil {
-		saveErrorToJSON(OutputJSONFilePath, "GetAWSToken", fmt.Sprintf("HTTP error while fetching token: %s", err), "AWS")
-		return "", err
+		return "", fmt.Errorf("HTTP error while fetching token: %w", err)
 	}
 	defer resp.Body.Close()
 
 	token, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		saveErrorToJSON(OutputJSONFilePath, "GetAWSToken", fmt.Sprintf("Failed to read response body: %s", err), "AWS")
-		return "", err
+		return "", fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%w: %s", errAWSTokenRefused, resp.Status)
 	}
 
 	// Check if the token length is zero
 	if len(token) == 0 {
-		saveErrorToJSON(OutputJSONFilePath, "GetAWSToken", "Received empty AWS metadata token", "AWS")
 		return "", fmt.Errorf("received empty AWS metadata token")
 	}
 
@@ -64,97 +107,121 @@ func GetAWSToken(OutputJSONFilePath string) (string, error) {
 	return string(token), nil
 }
 
-// GetAWSInstanceIdentityInfo retrieves the instance identity document and tags from the AWS metadata service.
-func GetAWSInstanceIdentityInfo(OutputJSONFilePath string) error {
-	token, err := GetAWSToken(OutputJSONFilePath)
-	if err != nil {
-		saveErrorToJSON(OutputJSONFilePath, "GetAWSInstanceIdentityInfo", fmt.Sprintf("Failed to get AWS token: %s", err), "AWS")
+// GetAWSInstanceIdentityInfo retrieves the instance identity document and tags from the AWS metadata service,
+// and adds them as one AWSInstanceInfo JSON object. When no IMDSv2 token is handed out it falls back to IMDSv1.
+func GetAWSInstanceIdentityInfo(collector *Collector) error {
+	start := time.Now()
+	info := AWSInstanceInfo{IMDSVersion: "v2"}
+	token, err := GetAWSToken()
+	if errors.Is(err, errAWSTokenRefused) {
+		logrus.Warnf("%s, falling back to IMDSv1", err)
+		token, info.IMDSVersion = "", "v1"
+	} else if err != nil {
+		saveErrorToJSON(collector, "GetAWSInstanceIdentityInfo", fmt.Sprintf("Failed to get AWS token: %s", err), "AWS")
 		return err
 	}
 
-	documentURL := fmt.Sprintf("%s/latest/dynamic/instance-identity/document", AWSEndpoint)
-	documentOUT, err := getAWSEndpoint(token, documentURL, OutputJSONFilePath)
+	documentURL := fmt.Sprintf("%s/latest/dynamic/instance-identity/document", schema.AWSMetadataEndpoint)
+	documentOUT, err := getAWSEndpoint(token, documentURL)
 
 	if err != nil {
-		saveErrorToJSON(OutputJSONFilePath, "GetAWSInstanceIdentityInfo", fmt.Sprintf("Failed to get instance identity document: %s", err), "AWS")
+		saveErrorToJSON(collector, "GetAWSInstanceIdentityInfo", fmt.Sprintf("Failed to get instance identity document: %s", err), "AWS")
 		return err
 	}
 	logrus.Debug("Instance Identity Document Raw:")
 	logrus.Debug(string(documentOUT))
 
-	metadataURL := fmt.Sprintf("%s/latest/meta-data/tags/instance/", AWSEndpoint)
-	metadataOUT, err := getAWSEndpoint(token, metadataURL, OutputJSONFilePath)
-	if err != nil {
-		saveErrorToJSON(OutputJSONFilePath, "GetAWSInstanceIdentityInfo", fmt.Sprintf("Failed to get metadata: %s", err), "AWS metadata")
+	var document awsIdentityDocument
+	if err := json.Unmarshal(documentOUT, &document); err != nil {
+		saveErrorToJSON(collector, "GetAWSInstanceIdentityInfo", fmt.Sprintf("Failed to decode instance identity document: %s", err), "AWS")
 		return err
 	}
-	logrus.Debug("Metadata Raw:")
-	logrus.Debug(string(metadataOUT))
-
-	// Get the existing JSON data from the file
-	existingJSONData, err := ReadJSONFromFile(OutputJSONFilePath)
-	if err != nil && !os.IsNotExist(err) {
-		saveErrorToJSON(OutputJSONFilePath, "GetAWSInstanceIdentityInfo", fmt.Sprintf("Error reading JSON from file: %s", err), "AWS")
+	info.InstanceID = document.InstanceID
+	info.InstanceType = document.InstanceType
+	info.Region = document.Region
+	info.AvailabilityZone = document.AvailabilityZone
+	info.AccountID = document.AccountID
+	info.ImageID = document.ImageID
+	info.Architecture = document.Architecture
+	info.PrivateIP = document.PrivateIP
+	info.PendingTime = document.PendingTime
+
+	if info.Tags, err = getAWSTags(token); err != nil {
+		saveErrorToJSON(collector, "GetAWSInstanceIdentityInfo", fmt.Sprintf("Failed to get instance tags: %s", err), "AWS")
 		return err
 	}
 
-	// Append the Base64 encoded documentOUT and metadataOUT to the JSON data
-	existingJSONData = append(existingJSONData, JSONData{
-		Command:     "Instance Identity Document",
-		Description: "AWS Instance Identity Document",
-		Output:      EncodeToBase64(string(documentOUT)),
-		MonitorTag:  "AWS",
-	})
-
-	metadataJSON := JSONData{
-		Command:     "Metadata",
-		Description: "AWS Metadata",
-		Output:      EncodeToBase64(string(metadataOUT)),
-		MonitorTag:  "AWS metadata",
+	infoOUT, err := json.Marshal(info)
+	if err != nil {
+		return saveErrorToJSON(collector, "GetAWSInstanceIdentityInfo", fmt.Sprintf("Failed to encode instance info: %s", err), "AWS")
 	}
+	documentJSON := newResult(SourceCloud, "", start)
+	documentJSON.Command = "Instance Identity Document"
+	documentJSON.Description = "AWS Instance Identity Document and Tags"
+	documentJSON.Output = EncodeToBase64(string(infoOUT))
+	documentJSON.MonitorTag = "AWS"
+	collector.Add(documentJSON)
 
-	existingJSONData = append(existingJSONData, metadataJSON)
+	return nil
+}
 
-	// Write the updated JSON data back to the file
-	if err := WriteJSONToFile(existingJSONData, OutputJSONFilePath); err != nil {
-		saveErrorToJSON(OutputJSONFilePath, "GetAWSInstanceIdentityInfo", fmt.Sprintf("Error writing JSON to file: %s", err), "AWS")
-		return err
+// getAWSTags returns the instance tags and their values. There are none when tags are not allowed in
+// instance metadata.
+func getAWSTags(token string) (map[string]string, error) {
+	tagsURL := fmt.Sprintf("%s/latest/meta-data/tags/instance/", schema.AWSMetadataEndpoint)
+	keys, err := getAWSEndpoint(token, tagsURL)
+	if errors.Is(err, errAWSMetadataNotFound) {
+		logrus.Info("No instance tags in AWS metadata, tags must be allowed in instance metadata to collect them.")
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	tags := map[string]string{}
+	for _, key := range strings.Split(string(keys), "\n") {
+		if key = strings.TrimSpace(key); key == "" {
+			continue
+		}
+		value, err := getAWSEndpoint(token, tagsURL+url.PathEscape(key))
+		if err != nil {
+			return nil, fmt.Errorf("tag %s: %w", key, err)
+		}
+		tags[key] = string(value)
+	}
+	return tags, nil
 }
 
-func getAWSEndpoint(token, url, OutputJSONFilePath string) ([]byte, error) { // Added OutputJSONFilePath parameter
+// getAWSEndpoint fetches an IMDS URL, with the IMDSv2 token if there is one. errAWSMetadataNotFound is
+// returned for a 404. Errors are left for the caller to record.
+func getAWSEndpoint(token, url string) ([]byte, error) {
 	url = strings.TrimSpace(url)
 
 	logrus.Debugf("Fetching data from AWS endpoint: %s", url)
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		saveErrorToJSON(OutputJSONFilePath, "getAWSEndpoint", fmt.Sprintf("Failed to create request: %s", err), "AWS")
-		return nil, err
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if token != "" {
+		req.Header.Set("X-aws-ec2-metadata-token", token)
 	}
-	req.Header.Set("X-aws-ec2-metadata-token", token)
 	resp, err := httpClient.Do(req)
 
 	if err != nil {
-		saveErrorToJSON(OutputJSONFilePath, "getAWSEndpoint", fmt.Sprintf("HTTP request failed for URL %s: %s", url, err), "AWS")
-		return nil, err
+		return nil, fmt.Errorf("HTTP request failed for URL %s: %w", url, err)
 	}
 	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		saveErrorToJSON(OutputJSONFilePath, "getAWSEndpoint", fmt.Sprintf("Failed to read response body for URL %s: %s", url, err), "AWS")
-		return nil, err
+		return nil, fmt.Errorf("failed to read response body for URL %s: %w", url, err)
 	}
 
 	if resp.StatusCode == http.StatusNotFound {
-		// If the response is 404, return the content as is without treating it as an error
-		return body, nil
+		// Left for the caller to decide whether a missing path is an error
+		return nil, fmt.Errorf("%w: %s", errAWSMetadataNotFound, url)
 	} else if resp.StatusCode != http.StatusOK {
-		errorMsg := fmt.Sprintf("Unexpected response status for URL %s: %s", url, resp.Status)
-		saveErrorToJSON(OutputJSONFilePath, "getAWSEndpoint", errorMsg, "AWS")
-		return nil, fmt.Errorf(errorMsg)
+		return nil, fmt.Errorf("unexpected response status for URL %s: %s", url, resp.Status)
 	}
 
 	return body, nil
@@ -166,45 +233,30 @@ func getAWSEndpoint(token, url, OutputJSONFilePath string) ([]byte, error) { //
 // Add your GCP-specific functions and structures here.
 
 // GetGCPInstanceIdentityInfo retrieves the instance identity document and tags from the AWS metadata service.
-func GetGCPInstanceIdentityInfo(OutputJSONFilePath string) error {
-	documentURL := "http://metadata.google.internal/computeMetadata/v1/instance/?recursive=true"
+func GetGCPInstanceIdentityInfo(collector *Collector) error {
+	start := time.Now()
+	documentURL := fmt.Sprintf("%s/computeMetadata/v1/instance/?recursive=true", schema.GCPMetadataEndpoint)
 	documentOUT, err := getGCPEndpoint(documentURL)
 	logrus.Info("Fetching GCP instance identity document...")
 
 	if err != nil {
 		logrus.Errorf("Failed to fetch GCP instance identity document: %s", err)
-		return saveErrorToJSON(OutputJSONFilePath, "Instance Identity Document", err.Error(), "GCP")
+		return saveErrorToJSON(collector, "Instance Identity Document", err.Error(), "GCP")
 	}
 	// Sanitize sensitive information from documentOUT
 	sanitizedDocument, err := sanitizeGCPInstanceDocument(documentOUT)
 	if err != nil {
 		logrus.Errorf("Failed to sanitize GCP instance identity document: %s", err)
-		return saveErrorToJSON(OutputJSONFilePath, "Instance Identity Document Sanitization", err.Error(), "GCP")
-	}
-
-	// Get the existing JSON data from the file
-	existingJSONData, err := ReadJSONFromFile(OutputJSONFilePath)
-	if err != nil && !os.IsNotExist(err) {
-		logrus.Errorf("Failed to read JSON from file %s: %s", OutputJSONFilePath, err)
-		return err
+		return saveErrorToJSON(collector, "Instance Identity Document Sanitization", err.Error(), "GCP")
 	}
 
-	// Append the Base64 encoded sanitizedDocument to the JSON data
-	existingJSONData = append(existingJSONData, JSONData{
-		Command:     "Instance Identity Document",
-		Description: "GCP Instance Identity Document",
-		Output:      EncodeToBase64(string(sanitizedDocument)),
-		MonitorTag:  "GCP",
-	})
-	logrus.Info("Appended GCP data to existing JSON.")
-
-	// existingJSONData = append(existingJSONData)
-
-	// Write the updated JSON data back to the file
-	if err := WriteJSONToFile(existingJSONData, OutputJSONFilePath); err != nil {
-		logrus.Errorf("Failed to write JSON to file %s: %s", OutputJSONFilePath, err)
-		return err
-	}
+	// Add the Base64 encoded sanitizedDocument to the collected results
+	documentJSON := newResult(SourceCloud, "", start)
+	documentJSON.Command = "Instance Identity Document"
+	documentJSON.Description = "GCP Instance Identity Document"
+	documentJSON.Output = EncodeToBase64(string(sanitizedDocument))
+	documentJSON.MonitorTag = "GCP"
+	collector.Add(documentJSON)
 	logrus.Info("Successfully updated JSON data with GCP instance information.")
 
 	return nil
@@ -220,8 +272,10 @@ func sanitizeGCPInstanceDocument(documentOUT []byte) ([]byte, error) {
 	}
 
 	// Remove the "ssh-keys" field from the map
-	delete(documentMap["attributes"].(map[string]interface{}), "ssh-keys")
-	logrus.Debug("Removed ssh-keys from GCP document.")
+	if attributes, ok := documentMap["attributes"].(map[string]interface{}); ok {
+		delete(attributes, "ssh-keys")
+		logrus.Debug("Removed ssh-keys from GCP document.")
+	}
 
 	// Marshal the modified map back into JSON
 	sanitizedDocument, err := json.Marshal(documentMap)
@@ -244,8 +298,7 @@ func getGCPEndpoint(url string) ([]byte, error) {
 		return nil, err
 	}
 	req.Header.Set("Metadata-Flavor", "Google")
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		logrus.Errorf("Failed to fetch data from GCP endpoint %s: %s", url, err)
 		return nil, err
@@ -271,16 +324,124 @@ func getGCPEndpoint(url string) ([]byte, error) {
 	return body, nil
 }
 
-func HandleCloudProviders(cloudProvider string, OutputJSONFilePath string) error {
+// azure_commands.go
+//
+
+// GetAzureInstanceIdentityInfo retrieves the instance metadata and the attested document from the Azure
+// Instance Metadata Service. SSH public keys and custom data are removed from the metadata.
+func GetAzureInstanceIdentityInfo(collector *Collector) error {
+	start := time.Now()
+	logrus.Info("Fetching Azure instance metadata...")
+	instanceURL := fmt.Sprintf("%s/metadata/instance?api-version=%s", schema.AzureMetadataEndpoint, AzureInstanceAPIVersion)
+	instanceOUT, err := getAzureEndpoint(instanceURL)
+	if err != nil {
+		logrus.Errorf("Failed to fetch Azure instance metadata: %s", err)
+		return saveErrorToJSON(collector, "Instance Metadata", err.Error(), "Azure")
+	}
+	sanitizedInstance, err := sanitizeAzureInstanceMetadata(instanceOUT)
+	if err != nil {
+		logrus.Errorf("Failed to sanitize Azure instance metadata: %s", err)
+		return saveErrorToJSON(collector, "Instance Metadata Sanitization", err.Error(), "Azure")
+	}
+
+	instanceJSON := newResult(SourceCloud, "", start)
+	instanceJSON.Command = "Instance Metadata"
+	instanceJSON.Description = "Azure Instance Metadata"
+	instanceJSON.Output = EncodeToBase64(string(sanitizedInstance))
+	instanceJSON.MonitorTag = "Azure"
+	collector.Add(instanceJSON)
+
+	logrus.Info("Fetching Azure attested document...")
+	attestedURL := fmt.Sprintf("%s/metadata/attested/document?api-version=%s", schema.AzureMetadataEndpoint, AzureAttestedAPIVersion)
+	attestedOUT, err := getAzureEndpoint(attestedURL)
+	if err != nil {
+		logrus.Errorf("Failed to fetch Azure attested document: %s", err)
+		return saveErrorToJSON(collector, "Attested Document", err.Error(), "Azure")
+	}
+
+	attestedJSON := newResult(SourceCloud, "", start)
+	attestedJSON.Command = "Attested Document"
+	attestedJSON.Description = "Azure Attested Document"
+	attestedJSON.Output = EncodeToBase64(string(attestedOUT))
+	attestedJSON.MonitorTag = "Azure"
+	collector.Add(attestedJSON)
+	logrus.Info("Successfully updated JSON data with Azure instance information.")
+
+	return nil
+}
+
+// azureSecretKeys are removed from the compute section of the Azure instance metadata
+var azureSecretKeys = []string{"publicKeys", "customData", "userData"}
+
+func sanitizeAzureInstanceMetadata(instanceOUT []byte) ([]byte, error) {
+	logrus.Debug("Sanitizing Azure instance metadata...")
+
+	var instanceMap map[string]interface{}
+	if err := json.Unmarshal(instanceOUT, &instanceMap); err != nil {
+		logrus.Errorf("Failed to unmarshal Azure instance metadata: %s", err)
+		return nil, err
+	}
+
+	if compute, ok := instanceMap["compute"].(map[string]interface{}); ok {
+		for _, key := range azureSecretKeys {
+			delete(compute, key)
+		}
+		if osProfile, ok := compute["osProfile"].(map[string]interface{}); ok {
+			delete(osProfile, "customData")
+		}
+		logrus.Debug("Removed public keys and custom data from Azure instance metadata.")
+	}
+
+	sanitizedInstance, err := json.Marshal(instanceMap)
+	if err != nil {
+		logrus.Errorf("Failed to marshal sanitized Azure instance metadata: %s", err)
+		return nil, err
+	}
+	return sanitizedInstance, nil
+}
+
+// getAzureEndpoint fetches an IMDS URL. IMDS refuses requests without the Metadata header.
+func getAzureEndpoint(url string) ([]byte, error) {
+	logrus.Debugf("Fetching data from Azure endpoint: %s", url)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		logrus.Errorf("Failed to create request for Azure endpoint %s: %s", url, err)
+		return nil, err
+	}
+	req.Header.Set("Metadata", "true")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		logrus.Errorf("Failed to fetch data from Azure endpoint %s: %s", url, err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	logrus.Debugf("Received response from Azure endpoint %s with status: %s", url, resp.Status)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		logrus.Errorf("Failed to read response body from Azure endpoint %s: %s", url, err)
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		logrus.Errorf("Unexpected response status from Azure endpoint %s: %s", url, resp.Status)
+		return nil, fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return body, nil
+}
+
+func HandleCloudProviders(cloudProvider string, collector *Collector) error {
 	logrus.Infof("Cloud provider: %s", cloudProvider)
 	switch cloudProvider {
 	case "aws":
-		return handleCloudProvider(GetAWSInstanceIdentityInfo, "AWS instance identity info", OutputJSONFilePath)
+		return handleCloudProvider(GetAWSInstanceIdentityInfo, "AWS instance identity info", collector)
 	case "gcp":
-		return handleCloudProvider(GetGCPInstanceIdentityInfo, "GCP instance identity info", OutputJSONFilePath)
+		return handleCloudProvider(GetGCPInstanceIdentityInfo, "GCP instance identity info", collector)
 	case "azure":
-		logrus.Warn("Azure cloud provider not yet implemented.")
-		return nil // Nothing to do for Azure currently
+		return handleCloudProvider(GetAzureInstanceIdentityInfo, "Azure instance identity info", collector)
+	case "oracle":
+		logrus.Warn("Oracle Cloud metadata collection not yet implemented.")
+		return nil
 	case "onprem":
 		logrus.Warn("On-premises provider.")
 		return nil // Nothing to do for on-prem currently
@@ -290,8 +451,8 @@ func HandleCloudProviders(cloudProvider string, OutputJSONFilePath string) error
 	}
 }
 
-func handleCloudProvider(providerFunc func(string) error, description string, OutputJSONFilePath string) error {
-	err := providerFunc(OutputJSONFilePath)
+func handleCloudProvider(providerFunc func(*Collector) error, description string, collector *Collector) error {
+	err := providerFunc(collector)
 	if err != nil {
 		logrus.Errorf("error executing %s: %s", description, err)
 		return err
@@ -300,58 +461,81 @@ func handleCloudProvider(providerFunc func(string) error, description string, Ou
 }
 
 // Save cloud handler errors
-func saveErrorToJSON(OutputJSONFilePath, source, errorMessage, monitorTag string) error {
-	// Get the existing JSON data from the file
-	existingJSONData, err := ReadJSONFromFile(OutputJSONFilePath)
-	if err != nil && !os.IsNotExist(err) {
-		return err
-	}
-
+func saveErrorToJSON(collector *Collector, source, errorMessage, monitorTag string) error {
 	// Create the concatenated description
 	description := fmt.Sprintf("Error - %s: %s", monitorTag, source)
 
 	// Append the error message to the JSON data
-	errorJSON := JSONData{
-		Command:     source,
-		Description: description,
-		Output:      EncodeToBase64(errorMessage),
-		MonitorTag:  monitorTag,
-	}
+	errorJSON := newResult(SourceCloud, "", time.Now())
+	errorJSON.Command = source
+	errorJSON.Description = description
+	errorJSON.MonitorTag = monitorTag
+	errorJSON.Status = StatusError
+	errorJSON.ExitCode = -1
+	errorJSON.Error = errorMessage
 
-	existingJSONData = append(existingJSONData, errorJSON)
-
-	// Write the updated JSON data back to the file
-	if err := WriteJSONToFile(existingJSONData, OutputJSONFilePath); err != nil {
-		return err
-	}
+	collector.Add(errorJSON)
 
 	return fmt.Errorf(errorMessage)
 }
+
+// DetectCloudProvider identifies the cloud provider from the local DMI data (see DetectPlatform). Only when
+// that is not conclusive does it probe the metadata services of Azure, AWS and GCP in turn, returning the
+// first that answers, or "onprem" if none does.
 func DetectCloudProvider() (string, error) {
 	logrus.Info("Detecting Cloud Provider")
+	platform := DetectPlatform()
+	if platform.Cloud != "" {
+		logrus.Infof("%s Detected from DMI data (%s %s)", platform.Cloud, platform.SysVendor, platform.ProductName)
+		return platform.Cloud, nil
+	}
+	if !platform.needsProbing() {
+		logrus.Infof("Not a cloud instance according to DMI data (%s %s), onprem", platform.SysVendor, platform.ProductName)
+		return "onprem", nil
+	}
+
 	client := &http.Client{
 		Timeout: autoCloudTimeout,
 	}
-
-	// Check Azure
-	resp, err := client.Get("http://169.254.169.254/metadata/instance?api-version=2021-02-01")
-	if err == nil && resp.StatusCode == http.StatusOK {
+	probe := func(url string, header http.Header, statuses ...int) bool {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			logrus.Debugf("Invalid metadata URL %s: %s", url, err)
+			return false
+		}
+		req.Header = header
+		resp, err := client.Do(req)
+		if err != nil {
+			logrus.Debugf("No answer from %s: %s", url, err)
+			return false
+		}
+		resp.Body.Close()
+		for _, status := range statuses {
+			if resp.StatusCode == status {
+				return true
+			}
+		}
+		logrus.Debugf("%s answered %s", url, resp.Status)
+		return false
+	}
+
+	// Check Azure, whose IMDS only answers requests with the Metadata header
+	if probe(fmt.Sprintf("%s/metadata/instance?api-version=%s", schema.AzureMetadataEndpoint, AzureInstanceAPIVersion),
+		http.Header{"Metadata": {"true"}}, http.StatusOK) {
 		logrus.Info("Azure Detected")
 		return "azure", nil
 	}
 
-	// Check AWS
-	resp, err = client.Get("http://169.254.169.254/latest/dynamic/instance-identity/document")
-	if err == nil && resp.StatusCode == http.StatusOK {
+	// Check AWS. Instances requiring IMDSv2 answer 401 without a token, which is still AWS.
+	if probe(fmt.Sprintf("%s/latest/dynamic/instance-identity/document", schema.AWSMetadataEndpoint),
+		http.Header{}, http.StatusOK, http.StatusUnauthorized) {
 		logrus.Info("AWS Detected")
 		return "aws", nil
 	}
 
 	// Check GCP
-	req, _ := http.NewRequest("GET", "http://metadata.google.internal/computeMetadata/v1/instance/?recursive=true", nil)
-	req.Header.Add("Metadata-Flavor", "Google")
-	resp, err = client.Do(req)
-	if err == nil && resp.StatusCode == http.StatusOK {
+	if probe(fmt.Sprintf("%s/computeMetadata/v1/instance/?recursive=true", schema.GCPMetadataEndpoint),
+		http.Header{"Metadata-Flavor": {"Google"}}, http.StatusOK) {
 		logrus.Info("GCP Detected")
 		return "gcp", nil
 	}
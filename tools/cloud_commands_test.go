@@ -0,0 +1,289 @@
+package tools
+
+import (
+	"command-runner/schema"
+	"command-runner/tools/fakemetadata"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setupCloudTest points every metadata endpoint at url and shortens the metadata request timeout. The
+// host's own DMI data is hidden, so that detection probes the endpoints.
+func setupCloudTest(t *testing.T, url string) {
+	aws, gcp, azure, client := schema.AWSMetadataEndpoint, schema.GCPMetadataEndpoint, schema.AzureMetadataEndpoint, httpClient
+	schema.AWSMetadataEndpoint, schema.GCPMetadataEndpoint, schema.AzureMetadataEndpoint = url, url, url
+	httpClient = &http.Client{Timeout: 200 * time.Millisecond}
+	setPlatformRoot(t, t.TempDir())
+	t.Cleanup(func() {
+		schema.AWSMetadataEndpoint, schema.GCPMetadataEndpoint, schema.AzureMetadataEndpoint, httpClient = aws, gcp, azure, client
+	})
+}
+
+// unreachableURL is the URL of a server that was closed
+func unreachableURL() string {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	return server.URL
+}
+
+func decodedOutput(t *testing.T, result JSONData) string {
+	decoded, err := base64.StdEncoding.DecodeString(result.Output)
+	assert.NoError(t, err)
+	return string(decoded)
+}
+
+func assertAllErrors(t *testing.T, results []JSONData, monitorTag string) {
+	assert.NotEmpty(t, results)
+	for _, result := range results {
+		assert.Equal(t, StatusError, result.Status)
+		assert.Equal(t, SourceCloud, result.Source)
+		assert.Contains(t, result.MonitorTag, monitorTag)
+	}
+}
+
+func TestGetAWSInstanceIdentityInfo(t *testing.T) {
+	tests := []struct {
+		name         string
+		setup        func(s *fakemetadata.Server)
+		wantVersion  string
+		wantTags     map[string]string
+		wantRequests []string
+	}{
+		{
+			name:        "IMDSv2",
+			setup:       func(s *fakemetadata.Server) {},
+			wantVersion: "v2",
+			wantTags:    map[string]string{"Name": "perforce-commit", "Owner": "perforce-admins", "Cost Center": "1234"},
+			wantRequests: []string{
+				"PUT " + fakemetadata.AWSTokenPath,
+				"GET " + fakemetadata.AWSDocumentPath,
+				"GET " + fakemetadata.AWSTagsPath,
+				"GET " + fakemetadata.AWSTagsPath + "Name",
+				"GET " + fakemetadata.AWSTagsPath + "Owner",
+				"GET " + fakemetadata.AWSTagsPath + "Cost%20Center",
+			},
+		},
+		{
+			name: "IMDSv1 fallback when the token is refused",
+			setup: func(s *fakemetadata.Server) {
+				s.AllowIMDSv1()
+				s.SetStatus(fakemetadata.AWSTokenPath, http.StatusForbidden)
+			},
+			wantVersion: "v1",
+			wantTags:    map[string]string{"Name": "perforce-commit", "Owner": "perforce-admins", "Cost Center": "1234"},
+		},
+		{
+			name:        "tags not allowed in metadata",
+			setup:       func(s *fakemetadata.Server) { s.SetStatus(fakemetadata.AWSTagsPath, http.StatusNotFound) },
+			wantVersion: "v2",
+			wantTags:    map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := fakemetadata.NewAWS(t)
+			tt.setup(server)
+			setupCloudTest(t, server.URL)
+			collector := NewCollector()
+			assert.NoError(t, HandleCloudProviders("aws", collector))
+
+			results := collector.Results()
+			if !assert.Len(t, results, 1) {
+				return
+			}
+			assert.Equal(t, "AWS", results[0].MonitorTag)
+			assert.Equal(t, StatusOK, results[0].Status)
+			var info AWSInstanceInfo
+			assert.NoError(t, json.Unmarshal([]byte(decodedOutput(t, results[0])), &info))
+			assert.Equal(t, AWSInstanceInfo{
+				InstanceID:       "i-0123456789abcdef0",
+				InstanceType:     "r6i.2xlarge",
+				Region:           "eu-west-1",
+				AvailabilityZone: "eu-west-1a",
+				AccountID:        "123456789012",
+				ImageID:          "ami-0abcdef1234567890",
+				Architecture:     "x86_64",
+				PrivateIP:        "10.0.1.25",
+				PendingTime:      "2024-05-01T09:58:12Z",
+				Tags:             tt.wantTags,
+				IMDSVersion:      tt.wantVersion,
+			}, info)
+			if tt.wantRequests != nil {
+				assert.Equal(t, tt.wantRequests, server.Requests())
+			}
+		})
+	}
+}
+
+func TestGetAWSInstanceIdentityInfoErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(s *fakemetadata.Server)
+	}{
+		{"token refused and IMDSv1 disabled", func(s *fakemetadata.Server) { s.SetStatus(fakemetadata.AWSTokenPath, http.StatusForbidden) }},
+		{"document unauthorized", func(s *fakemetadata.Server) { s.SetStatus(fakemetadata.AWSDocumentPath, http.StatusUnauthorized) }},
+		{"document not found", func(s *fakemetadata.Server) { s.SetStatus(fakemetadata.AWSDocumentPath, http.StatusNotFound) }},
+		{"document not JSON", func(s *fakemetadata.Server) { s.SetBody(fakemetadata.AWSDocumentPath, "<html>") }},
+		{"tag value unavailable", func(s *fakemetadata.Server) {
+			s.SetStatus(fakemetadata.AWSTagsPath+"Owner", http.StatusInternalServerError)
+		}},
+		{"timeout", func(s *fakemetadata.Server) { s.SetDelay(time.Second) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := fakemetadata.NewAWS(t)
+			tt.setup(server)
+			setupCloudTest(t, server.URL)
+			collector := NewCollector()
+			assert.Error(t, GetAWSInstanceIdentityInfo(collector))
+			assertAllErrors(t, collector.Results(), "AWS")
+			assert.Len(t, collector.Results(), 1, "the error is recorded once")
+		})
+	}
+}
+
+func TestGetGCPInstanceIdentityInfo(t *testing.T) {
+	server := fakemetadata.NewGCP(t)
+	setupCloudTest(t, server.URL)
+	collector := NewCollector()
+	assert.NoError(t, HandleCloudProviders("gcp", collector))
+
+	results := collector.Results()
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, "GCP", results[0].MonitorTag)
+		document := decodedOutput(t, results[0])
+		assert.Contains(t, document, `"name":"perforce-commit"`)
+		assert.Contains(t, document, `"enable-oslogin":"FALSE"`)
+		assert.NotContains(t, document, "ssh-keys")
+		assert.NotContains(t, document, "ssh-rsa")
+	}
+	assert.Equal(t, []string{"GET " + fakemetadata.GCPInstancePath + "?recursive=true"}, server.Requests())
+}
+
+func TestGetGCPInstanceIdentityInfoErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(s *fakemetadata.Server)
+	}{
+		{"not found", func(s *fakemetadata.Server) { s.SetStatus(fakemetadata.GCPInstancePath, http.StatusNotFound) }},
+		{"server error", func(s *fakemetadata.Server) {
+			s.SetStatus(fakemetadata.GCPInstancePath, http.StatusInternalServerError)
+		}},
+		{"timeout", func(s *fakemetadata.Server) { s.SetDelay(time.Second) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := fakemetadata.NewGCP(t)
+			tt.setup(server)
+			setupCloudTest(t, server.URL)
+			collector := NewCollector()
+			assert.Error(t, GetGCPInstanceIdentityInfo(collector))
+			assertAllErrors(t, collector.Results(), "GCP")
+		})
+	}
+}
+
+func TestGetAzureInstanceIdentityInfo(t *testing.T) {
+	server := fakemetadata.NewAzure(t)
+	setupCloudTest(t, server.URL)
+	collector := NewCollector()
+	assert.NoError(t, HandleCloudProviders("azure", collector))
+
+	results := collector.Results()
+	if !assert.Len(t, results, 2) {
+		return
+	}
+	for _, result := range results {
+		assert.Equal(t, "Azure", result.MonitorTag)
+		assert.Equal(t, SourceCloud, result.Source)
+	}
+
+	assert.Equal(t, "Azure Instance Metadata", results[0].Description)
+	instance := decodedOutput(t, results[0])
+	assert.Contains(t, instance, `"vmId":"02aab8a4-74ef-476e-8182-f6d2ba4166a6"`)
+	assert.Contains(t, instance, `"adminUsername":"perforce"`)
+	assert.Contains(t, instance, `{"name":"Environment","value":"production"}`)
+	assert.NotContains(t, instance, "publicKeys")
+	assert.NotContains(t, instance, "ssh-rsa")
+	assert.NotContains(t, instance, "customData")
+	assert.NotContains(t, instance, "userData")
+
+	assert.Equal(t, "Azure Attested Document", results[1].Description)
+	assert.JSONEq(t, fakemetadata.AzureAttestedDocument, decodedOutput(t, results[1]))
+	assert.Equal(t, []string{
+		"GET " + fakemetadata.AzureInstancePath + "?api-version=" + AzureInstanceAPIVersion,
+		"GET " + fakemetadata.AzureAttestedPath + "?api-version=" + AzureAttestedAPIVersion,
+	}, server.Requests())
+}
+
+func TestGetAzureInstanceIdentityInfoAttestedDocumentError(t *testing.T) {
+	server := fakemetadata.NewAzure(t)
+	server.SetStatus(fakemetadata.AzureAttestedPath, http.StatusInternalServerError)
+	setupCloudTest(t, server.URL)
+	collector := NewCollector()
+	assert.Error(t, GetAzureInstanceIdentityInfo(collector))
+
+	results := collector.Results()
+	if assert.Len(t, results, 2) {
+		assert.Equal(t, "Azure Instance Metadata", results[0].Description)
+		assert.Equal(t, StatusError, results[1].Status)
+		assert.Equal(t, "Attested Document", results[1].Command)
+		assert.Equal(t, "Azure", results[1].MonitorTag)
+	}
+}
+
+func TestGetAzureInstanceIdentityInfoErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		url  func(t *testing.T) string
+	}{
+		{"unreachable", func(t *testing.T) string { return unreachableURL() }},
+		{"timeout", func(t *testing.T) string {
+			server := fakemetadata.NewAzure(t)
+			server.SetDelay(time.Second)
+			return server.URL
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupCloudTest(t, tt.url(t))
+			collector := NewCollector()
+			assert.Error(t, GetAzureInstanceIdentityInfo(collector))
+			results := collector.Results()
+			assertAllErrors(t, results, "Azure")
+			assert.Equal(t, "Error - Azure: Instance Metadata", results[0].Description)
+		})
+	}
+}
+
+func TestDetectCloudProvider(t *testing.T) {
+	tests := []struct {
+		name string
+		url  func(t *testing.T) string
+		want string
+	}{
+		{"aws", func(t *testing.T) string { return fakemetadata.NewAWS(t).URL }, "aws"},
+		{"gcp", func(t *testing.T) string { return fakemetadata.NewGCP(t).URL }, "gcp"},
+		{"azure", func(t *testing.T) string { return fakemetadata.NewAzure(t).URL }, "azure"},
+		{"nothing answering", func(t *testing.T) string { return unreachableURL() }, "onprem"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupCloudTest(t, tt.url(t))
+			got, err := DetectCloudProvider()
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
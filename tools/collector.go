@@ -0,0 +1,139 @@
+// collector.go
+package tools
+
+import (
+	"bufio"
+	"command-runner/helpers"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// outputFilePerm is used for the output JSON file, which may contain sensitive configuration
+const outputFilePerm = 0600
+
+// Collector gathers results from every handler in memory, in the order they were added.
+// It is safe for concurrent use. The output file is only written once, by WriteFile, at the end of the run.
+//
+// A streaming collector (see NewStreamingCollector) instead writes each result as a line of NDJSON to a
+// temporary file as soon as it is added, so very large payloads are never held in memory.
+type Collector struct {
+	mu      sync.Mutex
+	results []JSONData
+
+	// Streaming mode only
+	stream       *os.File
+	streamWriter *bufio.Writer
+	legacy       bool
+	count        int
+}
+
+// NewCollector returns an empty in-memory collector
+func NewCollector() *Collector {
+	return &Collector{}
+}
+
+// NewStreamingCollector returns a collector that writes NDJSON to a temporary file next to OutputJSONFilePath.
+// Unless legacy is set the first line is the envelope header (everything but the results); each following
+// line is one result.
+func NewStreamingCollector(OutputJSONFilePath string, cloudProvider string, legacy bool) (*Collector, error) {
+	tmp, err := helpers.CreateTempFor(OutputJSONFilePath, outputFilePerm)
+	if err != nil {
+		return nil, fmt.Errorf("error creating streaming output for %s: %w", OutputJSONFilePath, err)
+	}
+	c := &Collector{stream: tmp, streamWriter: bufio.NewWriter(tmp), legacy: legacy}
+	if !legacy {
+		if err := c.writeLine(NewEnvelope(nil, cloudProvider).EnvelopeHeader); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Add appends results to the collector, after masking secrets in them with the active scrubber (see SetScrubber)
+func (c *Collector) Add(results ...JSONData) {
+	c.add(scrubResults(results))
+}
+
+func (c *Collector) add(results []JSONData) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stream == nil {
+		c.results = append(c.results, results...)
+		return
+	}
+	for _, result := range results {
+		var line interface{} = result
+		if c.legacy {
+			line = ToLegacy([]JSONData{result})[0]
+		}
+		if err := c.writeLine(line); err != nil {
+			logrus.Errorf("Error streaming result %q: %v", result.Command, err)
+			continue
+		}
+		c.count++
+	}
+}
+
+// Merge appends every result held by other, keeping their order. They were already scrubbed when added to other.
+func (c *Collector) Merge(other *Collector) {
+	c.add(other.Results())
+}
+
+// Results returns a copy of the results held in memory. It is always empty for a streaming collector.
+func (c *Collector) Results() []JSONData {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]JSONData(nil), c.results...)
+}
+
+// Len returns the number of results collected so far
+func (c *Collector) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stream != nil {
+		return c.count
+	}
+	return len(c.results)
+}
+
+// WriteFile atomically writes the collected results to OutputJSONFilePath as an Envelope, or as the legacy
+// flat array when legacy is set. For a streaming collector the NDJSON file is completed and moved into place.
+func (c *Collector) WriteFile(OutputJSONFilePath string, cloudProvider string, legacy bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stream != nil {
+		if err := c.streamWriter.Flush(); err != nil {
+			c.stream.Close()
+			os.Remove(c.stream.Name())
+			return err
+		}
+		logrus.Debugf("Moving streamed output %s to %s", c.stream.Name(), OutputJSONFilePath)
+		return helpers.CommitTemp(c.stream, OutputJSONFilePath)
+	}
+
+	var data interface{} = NewEnvelope(c.results, cloudProvider)
+	if legacy {
+		logrus.Info("Writing output in legacy flat array format")
+		data = ToLegacy(c.results)
+	}
+	return writeIndentedJSON(data, OutputJSONFilePath)
+}
+
+func (c *Collector) writeLine(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := c.streamWriter.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return nil
+}
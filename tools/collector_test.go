@@ -0,0 +1,88 @@
+package tools
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollectorWriteFile(t *testing.T) {
+	outputPath := filepath.Join(t.TempDir(), "out.json")
+	collector := NewCollector()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			collector.Add(JSONData{Command: fmt.Sprintf("cmd %d", i), Status: StatusOK})
+		}(i)
+	}
+	wg.Wait()
+
+	assert.NoError(t, collector.WriteFile(outputPath, "onprem", false))
+
+	info, err := os.Stat(outputPath)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	var envelope Envelope
+	data, _ := os.ReadFile(outputPath)
+	assert.NoError(t, json.Unmarshal(data, &envelope))
+	assert.Equal(t, EnvelopeSchemaVersion, envelope.SchemaVersion)
+	assert.Equal(t, "onprem", envelope.Host.CloudProvider)
+	assert.Len(t, envelope.Results, 50)
+}
+
+func TestCollectorMergeKeepsOrder(t *testing.T) {
+	parent := NewCollector()
+	for _, name := range []string{"1", "2"} {
+		child := NewCollector()
+		child.Add(JSONData{Command: name + "a"}, JSONData{Command: name + "b"})
+		parent.Merge(child)
+	}
+
+	var commands []string
+	for _, result := range parent.Results() {
+		commands = append(commands, result.Command)
+	}
+	assert.Equal(t, []string{"1a", "1b", "2a", "2b"}, commands)
+}
+
+func TestStreamingCollector(t *testing.T) {
+	outputPath := filepath.Join(t.TempDir(), "out.json")
+	collector, err := NewStreamingCollector(outputPath, "aws", false)
+	assert.NoError(t, err)
+
+	collector.Add(JSONData{Command: "first"}, JSONData{Command: "second"})
+	assert.Equal(t, 2, collector.Len())
+	assert.Empty(t, collector.Results())
+
+	_, err = os.Stat(outputPath)
+	assert.True(t, os.IsNotExist(err), "output should not exist until WriteFile")
+
+	assert.NoError(t, collector.WriteFile(outputPath, "aws", false))
+
+	file, err := os.Open(outputPath)
+	assert.NoError(t, err)
+	defer file.Close()
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	assert.Len(t, lines, 3)
+
+	var header EnvelopeHeader
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &header))
+	assert.Equal(t, RunID, header.RunID)
+	var result JSONData
+	assert.NoError(t, json.Unmarshal([]byte(lines[2]), &result))
+	assert.Equal(t, "second", result.Command)
+}
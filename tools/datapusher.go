@@ -1,11 +1,17 @@
 package tools
 
 import (
-	"bytes"
 	"command-runner/schema"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,65 +22,271 @@ const (
 	//http constants
 	// TODO tidy this stuff up laters
 	maxIterations = 5
-	//autoCloudTimeout = 5 * time.Second // assuming 5 seconds for the timeout
 )
 
-func PushToDataPushGateway(OutputJSONFilePath string, configFilePath string) error {
+// Retry backoff bounds (variables so tests can shorten them)
+var (
+	pushBackoffBase = 1 * time.Second
+	pushBackoffMax  = 30 * time.Second
+)
+
+// ErrPayloadSpooled is returned (wrapped) when a push failed but the payload was saved for a later run
+var ErrPayloadSpooled = errors.New("payload spooled for retry")
+
+// PushError is a push the datapushgateway answered with a non-success HTTP status
+type PushError struct {
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration
+}
+
+func (e *PushError) Error() string {
+	return fmt.Sprintf("datapushgateway returned %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), strings.TrimSpace(e.Body))
+}
+
+// Retryable reports whether the same push may succeed later. 401 is included because the gateway
+// briefly rejects credentials while it reloads them.
+func (e *PushError) Retryable() bool {
+	switch {
+	case e.StatusCode == http.StatusUnauthorized,
+		e.StatusCode == http.StatusRequestTimeout,
+		e.StatusCode == http.StatusTooManyRequests,
+		e.StatusCode >= 500:
+		return true
+	}
+	return false
+}
+
+// IsRetryablePushError reports whether err is worth retrying: transport errors and retryable HTTP statuses
+func IsRetryablePushError(err error) bool {
+	var pushErr *PushError
+	if errors.As(err, &pushErr) {
+		return pushErr.Retryable()
+	}
+	return err != nil
+}
+
+var backoffRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// pushBackoff returns the delay before retry number attempt (1 based): exponential from pushBackoffBase,
+// capped at pushBackoffMax, with jitter so many hosts do not retry in lockstep.
+func pushBackoff(attempt int) time.Duration {
+	backoff := pushBackoffBase << uint(attempt-1)
+	if backoff <= 0 || backoff > pushBackoffMax {
+		backoff = pushBackoffMax
+	}
+	half := backoff / 2
+	return half + time.Duration(backoffRand.Int63n(int64(half)+1))
+}
+
+// PushToDataPushGateway pushes the payload, of the given content type, to the datapushgateway. Payloads
+// spooled by earlier runs are replayed first, and the payload is pushed even if that fails. If the push
+// fails with a retryable error after all attempts, the payload is spooled (when spool is not nil) and an
+// error wrapping ErrPayloadSpooled is returned.
+func PushToDataPushGateway(payload *io.SectionReader, contentType string, configFilePath string, spool *Spool) error {
 	config, err := schema.ParseMetricsConfig(configFilePath)
 	if err != nil {
 		return fmt.Errorf("error parsing metrics config: %w", err)
 	}
-	client := &http.Client{
-		Timeout: autoCloudTimeout,
-	}
-	// Change the port from :9091 to :9092
-	parsedURL := strings.Replace(config.Host, ":9091", ":9092", 1)
-	config.Host = parsedURL
 
-	iterations := 0
-	STATUS := 1
-	for STATUS != 0 {
-		time.Sleep(1 * time.Second)
-		iterations++
+	if spool != nil {
+		if err := spool.Replay(func(spooled *io.SectionReader, spooledType string) error {
+			return pushWithRetry(config, spooled, spooledType)
+		}); err != nil {
+			// The new payload may still get through, e.g. when only an old payload is failing
+			logrus.Warnf("Replaying spooled payloads failed: %v", err)
+		}
+	}
 
-		logrus.Info("Pushing Support data")
+	err = pushWithRetry(config, payload, contentType)
+	if err != nil && IsRetryablePushError(err) && spool != nil {
+		return spoolPayload(spool, payload, contentType, err)
+	}
+	return err
+}
 
-		data, err := ioutil.ReadFile(OutputJSONFilePath)
-		if err != nil {
-			return fmt.Errorf("error reading tempLog: %w", err)
-		}
+// FlushSpool replays spooled payloads without collecting or pushing anything new
+func FlushSpool(configFilePath string, spool *Spool) error {
+	config, err := schema.ParseMetricsConfig(configFilePath)
+	if err != nil {
+		return fmt.Errorf("error parsing metrics config: %w", err)
+	}
+	return spool.Replay(func(payload *io.SectionReader, contentType string) error {
+		return pushWithRetry(config, payload, contentType)
+	})
+}
 
-		req, err := http.NewRequest("POST", fmt.Sprintf("%s/json/?customer=%s&instance=%s", config.Host, config.Customer, config.Instance), bytes.NewBuffer(data))
+func spoolPayload(spool *Spool, payload *io.SectionReader, contentType string, pushErr error) error {
+	if err := spool.Save(payload, contentType); err != nil {
+		return fmt.Errorf("push failed (%v) and the payload could not be spooled: %w", pushErr, err)
+	}
+	return fmt.Errorf("%w: %v", ErrPayloadSpooled, pushErr)
+}
 
+// newPushClient builds the HTTP client for the datapushgateway from the TLS and proxy settings in config
+func newPushClient(config schema.MetricsConfig) (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	if config.InsecureSkipVerify {
+		logrus.Warn("metrics_insecure_skip_verify is set, the datapushgateway certificate will not be verified")
+	}
+	if config.CAFile != "" {
+		caPEM, err := ioutil.ReadFile(config.CAFile)
 		if err != nil {
-			return fmt.Errorf("error creating request: %w", err)
+			return nil, fmt.Errorf("error reading metrics_ca_file: %w", err)
 		}
-		req.SetBasicAuth(config.User, config.Passwd)
-		resp, err := client.Do(req)
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in metrics_ca_file %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(config.ClientCert, config.ClientKey)
 		if err != nil {
-			return fmt.Errorf("error making request: %w", err)
+			return nil, fmt.Errorf("error loading metrics_client_cert/metrics_client_key: %w", err)
 		}
-		defer resp.Body.Close()
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
 
-		body, err := ioutil.ReadAll(resp.Body)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if config.Proxy != "" {
+		proxyURL, err := url.Parse(config.Proxy)
 		if err != nil {
-			return fmt.Errorf("error reading response body: %w", err)
+			return nil, fmt.Errorf("invalid metrics_proxy: %w", err)
 		}
-		result := string(body)
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
 
-		logrus.Infof("Checking result: %s", result)
+	return &http.Client{
+		Timeout:   config.PushTimeout,
+		Transport: transport,
+	}, nil
+}
 
-		if result == `{"message":"invalid username or password"}` {
-			STATUS = 1
-			logrus.Warn("Retrying due to temporary password failure")
-		} else {
-			STATUS = 0
+// pushWithRetry posts the payload as one or more requests (see buildPushParts), retrying each retryable
+// failure with exponential backoff and jitter
+func pushWithRetry(config schema.MetricsConfig, payload *io.SectionReader, contentType string) error {
+	client, err := newPushClient(config)
+	if err != nil {
+		return err
+	}
+	target, err := pushURL(config)
+	if err != nil {
+		return err
+	}
+	parts, err := buildPushParts(config, payload, contentType)
+	if err != nil {
+		return err
+	}
+
+	for _, part := range parts {
+		if len(parts) > 1 {
+			logrus.Infof("Pushing Support data %s (%d bytes)", part.description, part.body.Size())
+		}
+		if err := pushPartWithRetry(client, config, target, part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pushPartWithRetry(client *http.Client, config schema.MetricsConfig, target string, part pushPart) error {
+	var err error
+	for attempt := 1; attempt <= maxIterations; attempt++ {
+		logrus.Info("Pushing Support data")
+		err = pushOnce(client, config, target, part)
+		if err == nil {
+			return nil
+		}
+		if !IsRetryablePushError(err) {
+			return err
+		}
+		if attempt == maxIterations {
+			break
+		}
+
+		wait := pushBackoff(attempt)
+		var pushErr *PushError
+		if errors.As(err, &pushErr) && pushErr.RetryAfter > wait {
+			wait = pushErr.RetryAfter
+		}
+		logrus.Warnf("Push attempt %d of %d failed, retrying in %s: %v", attempt, maxIterations, wait.Round(time.Millisecond), err)
+		time.Sleep(wait)
+	}
+	logrus.Error("Push loop iterations exceeded")
+	return fmt.Errorf("push failed after %d attempts: %w", maxIterations, err)
+}
+
+// pushURL returns the JSON endpoint URL with the customer and instance query parameters.
+// metrics_json_url is used as is; without it the endpoint is derived from metrics_host,
+// rewriting the Prometheus pushgateway port :9091 to the JSON port :9092 for older configs.
+func pushURL(config schema.MetricsConfig) (string, error) {
+	endpoint := config.JSONURL
+	if endpoint == "" {
+		host := strings.TrimRight(config.Host, "/")
+		if strings.Contains(host, ":9091") {
+			logrus.Warn("Deriving the push URL by rewriting :9091 to :9092 in metrics_host is deprecated, set metrics_json_url instead")
+			host = strings.Replace(host, ":9091", ":9092", 1)
 		}
+		endpoint = host + "/json/"
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid datapushgateway URL %q: %w", endpoint, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("invalid datapushgateway URL %q: scheme and host are required", endpoint)
+	}
+	query := u.Query()
+	query.Set("customer", config.Customer)
+	query.Set("instance", config.Instance)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+func pushOnce(client *http.Client, config schema.MetricsConfig, target string, part pushPart) error {
+	req, err := http.NewRequest("POST", target, part.open())
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	req.GetBody = func() (io.ReadCloser, error) { return part.open(), nil }
+	if !part.gzip {
+		req.ContentLength = part.body.Size()
+	}
+	for key, values := range part.header {
+		req.Header[key] = values
+	}
+	if config.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+config.BearerToken)
+	} else {
+		req.SetBasicAuth(config.User, config.Passwd)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error making request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading response body: %w", err)
+	}
+	logrus.Infof("Checking result: %d %s", resp.StatusCode, string(body))
 
-		if iterations >= maxIterations {
-			logrus.Error("Push loop iterations exceeded")
-			return fmt.Errorf("push loop iterations exceeded")
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		pushErr := &PushError{StatusCode: resp.StatusCode, Body: string(body)}
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+			pushErr.RetryAfter = time.Duration(secs) * time.Second
 		}
+		return pushErr
 	}
 	return nil
 }
@@ -0,0 +1,293 @@
+package tools
+
+import (
+	"bytes"
+	"command-runner/schema"
+	"compress/gzip"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeGateway answers with the queued status codes in turn (200 once they run out) and records bodies it accepted
+type fakeGateway struct {
+	mu       sync.Mutex
+	statuses []int
+	received []string
+	requests int
+}
+
+func (g *fakeGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.requests++
+	status := http.StatusOK
+	if len(g.statuses) > 0 {
+		status, g.statuses = g.statuses[0], g.statuses[1:]
+	}
+	if status == http.StatusOK {
+		body, _ := io.ReadAll(r.Body)
+		g.received = append(g.received, string(body))
+	}
+	w.WriteHeader(status)
+	fmt.Fprint(w, `{"message":"test"}`)
+}
+
+// sectionOf returns s as a payload
+func sectionOf(s string) *io.SectionReader {
+	return io.NewSectionReader(strings.NewReader(s), 0, int64(len(s)))
+}
+
+func setupPushTest(t *testing.T, gateway *fakeGateway) (configPath string) {
+	pushBackoffBase, pushBackoffMax = time.Millisecond, 5*time.Millisecond
+	t.Cleanup(func() { pushBackoffBase, pushBackoffMax = time.Second, 30*time.Second })
+
+	server := httptest.NewServer(gateway)
+	t.Cleanup(server.Close)
+
+	dir := t.TempDir()
+	configPath = filepath.Join(dir, ".push_metrics.cfg")
+	os.WriteFile(configPath, []byte(fmt.Sprintf("metrics_host=%s\nmetrics_customer=cust\nmetrics_instance=inst\nmetrics_user=u\nmetrics_passwd=p\n", server.URL)), 0600)
+	return configPath
+}
+
+func TestPushRetriesRetryableStatus(t *testing.T) {
+	gateway := &fakeGateway{statuses: []int{http.StatusUnauthorized, http.StatusServiceUnavailable}}
+	configPath := setupPushTest(t, gateway)
+
+	assert.NoError(t, PushToDataPushGateway(sectionOf("payload"), ContentTypeJSON, configPath, nil))
+	assert.Equal(t, 3, gateway.requests)
+	assert.Equal(t, []string{"payload"}, gateway.received)
+}
+
+func TestPushDoesNotRetryClientError(t *testing.T) {
+	gateway := &fakeGateway{statuses: []int{http.StatusBadRequest}}
+	configPath := setupPushTest(t, gateway)
+	spool := NewSpool(filepath.Join(t.TempDir(), "spool"), 0, 0)
+
+	err := PushToDataPushGateway(sectionOf("payload"), ContentTypeJSON, configPath, spool)
+	var pushErr *PushError
+	assert.True(t, errors.As(err, &pushErr))
+	assert.Equal(t, http.StatusBadRequest, pushErr.StatusCode)
+	assert.Equal(t, 1, gateway.requests)
+	pending, _ := spool.Pending()
+	assert.Empty(t, pending, "rejected payloads are not spooled")
+}
+
+func TestPushSpoolsAndReplaysOldestFirst(t *testing.T) {
+	// The first run's push, and the second run's replay and push
+	statuses := make([]int, 3*maxIterations)
+	for i := range statuses {
+		statuses[i] = http.StatusBadGateway
+	}
+	gateway := &fakeGateway{statuses: statuses}
+	configPath := setupPushTest(t, gateway)
+	spool := NewSpool(filepath.Join(t.TempDir(), "spool"), 0, 0)
+
+	// Two runs while the gateway is down
+	for _, payload := range []string{"first", "second"} {
+		err := PushToDataPushGateway(sectionOf(payload), ContentTypeJSON, configPath, spool)
+		assert.True(t, errors.Is(err, ErrPayloadSpooled), "got %v", err)
+	}
+	pending, _ := spool.Pending()
+	assert.Len(t, pending, 2)
+
+	// The gateway is back: spooled payloads go first, oldest first
+	assert.NoError(t, PushToDataPushGateway(sectionOf("third"), ContentTypeJSON, configPath, spool))
+	assert.Equal(t, []string{"first", "second", "third"}, gateway.received)
+	pending, _ = spool.Pending()
+	assert.Empty(t, pending)
+}
+
+func TestPushKeepsContentTypeThroughSpool(t *testing.T) {
+	statuses := make([]int, maxIterations)
+	for i := range statuses {
+		statuses[i] = http.StatusBadGateway
+	}
+	gateway := &fakeGateway{statuses: statuses}
+	configPath := setupPushTest(t, gateway)
+	var contentTypes []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentTypes = append(contentTypes, r.Header.Get("Content-Type"))
+		gateway.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	os.WriteFile(configPath, []byte(fmt.Sprintf("metrics_host=%s\nmetrics_customer=cust\nmetrics_instance=inst\n", server.URL)), 0600)
+	spool := NewSpool(filepath.Join(t.TempDir(), "spool"), 0, 0)
+
+	ndjson := "{\"command\":\"p4 info\"}\n{\"command\":\"uptime\"}\n"
+	assert.ErrorIs(t, PushToDataPushGateway(sectionOf(ndjson), ContentTypeNDJSON, configPath, spool), ErrPayloadSpooled)
+	contentTypes = nil
+	assert.NoError(t, PushToDataPushGateway(sectionOf(`{"results":[]}`), ContentTypeJSON, configPath, spool))
+
+	assert.Equal(t, []string{ndjson, `{"results":[]}`}, gateway.received)
+	assert.Equal(t, []string{ContentTypeNDJSON, ContentTypeJSON}, contentTypes)
+}
+
+func TestPushAfterFailedReplay(t *testing.T) {
+	gateway := &fakeGateway{}
+	configPath := setupPushTest(t, gateway)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) == "stuck" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		gateway.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	os.WriteFile(configPath, []byte(fmt.Sprintf("metrics_host=%s\nmetrics_customer=cust\nmetrics_instance=inst\n", server.URL)), 0600)
+	spool := NewSpool(filepath.Join(t.TempDir(), "spool"), 0, 0)
+	assert.NoError(t, spool.Save(sectionOf("stuck"), ContentTypeJSON))
+
+	assert.NoError(t, PushToDataPushGateway(sectionOf("new"), ContentTypeJSON, configPath, spool))
+	assert.Equal(t, []string{"new"}, gateway.received, "the new payload is pushed although the replay failed")
+	pending, _ := spool.Pending()
+	assert.Len(t, pending, 1, "the failed payload stays in the spool")
+}
+
+func TestSpoolRejectsPayloadLargerThanMaxBytes(t *testing.T) {
+	spool := NewSpool(t.TempDir(), 10, time.Hour)
+	assert.NoError(t, spool.Save(sectionOf("aaaaaa"), ContentTypeJSON))
+
+	err := spool.Save(sectionOf("larger than ten bytes"), ContentTypeJSON)
+	assert.ErrorIs(t, err, ErrPayloadTooLarge)
+	assert.ErrorContains(t, err, "21 bytes, the spool holds at most 10 bytes")
+	pending, _ := spool.Pending()
+	assert.Len(t, pending, 1, "the spooled payloads are kept")
+}
+
+func TestSpoolPruneBySize(t *testing.T) {
+	spool := NewSpool(t.TempDir(), 10, time.Hour)
+	for _, payload := range []string{"aaaaaa", "bbbbbb", "cccccc"} {
+		assert.NoError(t, spool.Save(sectionOf(payload), ContentTypeJSON))
+	}
+	pending, _ := spool.Pending()
+	assert.Len(t, pending, 1)
+	data, _ := os.ReadFile(pending[0])
+	assert.Equal(t, "cccccc", string(data))
+}
+
+func TestPushOverTLSWithCAFileAndBearerToken(t *testing.T) {
+	setupPushTest(t, &fakeGateway{})
+	var auth string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	caPath := filepath.Join(dir, "ca.pem")
+	os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+	base := fmt.Sprintf("metrics_host=%s\nmetrics_customer=cust\nmetrics_instance=inst\nmetrics_bearer_token=secret\n", server.URL)
+
+	untrusted := filepath.Join(dir, "untrusted.cfg")
+	os.WriteFile(untrusted, []byte(base), 0600)
+	assert.Error(t, PushToDataPushGateway(sectionOf("payload"), ContentTypeJSON, untrusted, nil), "self-signed server is rejected without metrics_ca_file")
+
+	trusted := filepath.Join(dir, "trusted.cfg")
+	os.WriteFile(trusted, []byte(base+"metrics_ca_file="+caPath+"\n"), 0600)
+	assert.NoError(t, PushToDataPushGateway(sectionOf("payload"), ContentTypeJSON, trusted, nil))
+	assert.Equal(t, "Bearer secret", auth)
+}
+
+func TestPushTimeout(t *testing.T) {
+	setupPushTest(t, &fakeGateway{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	configPath := filepath.Join(t.TempDir(), ".push_metrics.cfg")
+	os.WriteFile(configPath, []byte(fmt.Sprintf("metrics_host=%s\nmetrics_customer=cust\nmetrics_push_timeout=50ms\n", server.URL)), 0600)
+
+	start := time.Now()
+	err := PushToDataPushGateway(sectionOf("payload"), ContentTypeJSON, configPath, nil)
+	assert.ErrorContains(t, err, "Client.Timeout exceeded")
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestPushURL(t *testing.T) {
+	tests := []struct {
+		name   string
+		config schema.MetricsConfig
+		want   string
+	}{
+		{
+			name:   "explicit json url",
+			config: schema.MetricsConfig{Host: "http://gw:9091", JSONURL: "https://gw:8443/json/", Customer: "a&b", Instance: "my inst"},
+			want:   "https://gw:8443/json/?customer=a%26b&instance=my+inst",
+		},
+		{
+			name:   "legacy port rewrite",
+			config: schema.MetricsConfig{Host: "http://gw:9091", Customer: "c", Instance: "i"},
+			want:   "http://gw:9092/json/?customer=c&instance=i",
+		},
+		{
+			name:   "host without rewrite",
+			config: schema.MetricsConfig{Host: "https://gw.example.com/", Customer: "c", Instance: "i"},
+			want:   "https://gw.example.com/json/?customer=c&instance=i",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := pushURL(tt.config)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err := pushURL(schema.MetricsConfig{Host: "gw:9092"})
+	assert.Error(t, err)
+}
+
+func TestPushChunksGzipPayload(t *testing.T) {
+	gateway := &fakeGateway{}
+	setupPushTest(t, gateway)
+
+	var headers []http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = append(headers, r.Header.Clone())
+		zr, err := gzip.NewReader(r.Body)
+		assert.NoError(t, err)
+		body, _ := io.ReadAll(zr)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		gateway.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	configPath := filepath.Join(t.TempDir(), ".push_metrics.cfg")
+	os.WriteFile(configPath, []byte(fmt.Sprintf("metrics_json_url=%s/json/\nmetrics_customer=cust\nmetrics_instance=inst\nmetrics_gzip=1\nmetrics_chunk_size=10\n", server.URL)), 0600)
+
+	payload := `{"results":["0123456789abcdef"]}`
+	assert.NoError(t, PushToDataPushGateway(sectionOf(payload), ContentTypeJSON, configPath, nil))
+
+	assert.Len(t, gateway.received, 5, "4 chunks and a manifest")
+	assert.Equal(t, payload, strings.Join(gateway.received[:4], ""))
+	var manifest chunkManifest
+	assert.NoError(t, json.Unmarshal([]byte(gateway.received[4]), &manifest))
+	assert.Equal(t, 4, manifest.Chunks)
+	assert.Equal(t, len(payload), manifest.TotalSize)
+	for i, h := range headers {
+		assert.Equal(t, "gzip", h.Get("Content-Encoding"))
+		assert.Equal(t, manifest.UploadID, h.Get(headerUploadID))
+		if i < 4 {
+			assert.Equal(t, fmt.Sprint(i), h.Get(headerChunkIndex))
+		}
+	}
+	assert.Equal(t, "1", headers[4].Get(headerManifest))
+}
@@ -0,0 +1,135 @@
+// envelope.go
+package tools
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/perforce/p4prometheus/version"
+	"github.com/sirupsen/logrus"
+)
+
+// EnvelopeSchemaVersion is bumped whenever the layout of Envelope or JSONData changes incompatibly
+const EnvelopeSchemaVersion = 1
+
+// RunID identifies this invocation of command-runner across every result it produces
+var RunID = newRunID()
+
+// Envelope is the top level document sent to the datapushgateway
+type Envelope struct {
+	EnvelopeHeader
+	Results []JSONData `json:"results"`
+}
+
+// EnvelopeHeader is everything in the envelope except the results. In NDJSON output it is the first line.
+type EnvelopeHeader struct {
+	SchemaVersion int       `json:"schema_version"`
+	RunID         string    `json:"run_id"`
+	Version       string    `json:"command_runner_version"`
+	GeneratedAt   time.Time `json:"generated_at"`
+	Host          HostFacts `json:"host"`
+}
+
+// HostFacts describes the machine the results were collected on
+type HostFacts struct {
+	Hostname      string `json:"hostname"`
+	OS            string `json:"os"`
+	Arch          string `json:"arch"`
+	KernelRelease string `json:"kernel_release,omitempty"`
+	NumCPU        int    `json:"num_cpu"`
+	CloudProvider string `json:"cloud_provider"`
+	// Platform is the cloud, hypervisor and container detected locally, omitted when nothing was found
+	Platform *PlatformFacts `json:"platform,omitempty"`
+}
+
+// LegacyJSONData is the flat entry understood by older datapushgateway receivers
+type LegacyJSONData struct {
+	Command     string `json:"command"`
+	Description string `json:"description"`
+	Output      string `json:"output"`
+	MonitorTag  string `json:"monitor_tag"`
+}
+
+func newRunID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		logrus.Warnf("Unable to generate run id: %v", err)
+		return time.Now().UTC().Format("20060102T150405.000000000")
+	}
+	return hex.EncodeToString(b)
+}
+
+// GetHostFacts gathers the host details included in the envelope
+func GetHostFacts(cloudProvider string) HostFacts {
+	facts := HostFacts{
+		Hostname:      hostname,
+		OS:            runtime.GOOS,
+		Arch:          runtime.GOARCH,
+		NumCPU:        runtime.NumCPU(),
+		CloudProvider: cloudProvider,
+	}
+	if release, err := os.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		facts.KernelRelease = strings.TrimSpace(string(release))
+	}
+	if platform := DetectPlatform(); platform != (PlatformFacts{}) {
+		facts.Platform = &platform
+	}
+	return facts
+}
+
+// NewEnvelope wraps results with the run id, version and host facts
+func NewEnvelope(results []JSONData, cloudProvider string) Envelope {
+	if results == nil {
+		results = []JSONData{}
+	}
+	return Envelope{
+		EnvelopeHeader: EnvelopeHeader{
+			SchemaVersion: EnvelopeSchemaVersion,
+			RunID:         RunID,
+			Version:       version.Version,
+			GeneratedAt:   time.Now(),
+			Host:          GetHostFacts(cloudProvider),
+		},
+		Results: results,
+	}
+}
+
+// ToLegacy converts results to the flat array format. Errors and stderr are folded back into the output
+// text the way older versions reported them.
+func ToLegacy(results []JSONData) []LegacyJSONData {
+	legacy := make([]LegacyJSONData, 0, len(results))
+	for _, result := range results {
+		output := result.Output
+		if result.Error != "" {
+			text := decodeBase64(result.Output)
+			if text != "" {
+				text += "\n"
+			}
+			text += result.Error
+			if stderr := decodeBase64(result.Stderr); stderr != "" {
+				text += "\n" + stderr
+			}
+			output = EncodeToBase64(text)
+		}
+		legacy = append(legacy, LegacyJSONData{
+			Command:     result.Command,
+			Description: result.Description,
+			Output:      output,
+			MonitorTag:  result.MonitorTag,
+		})
+	}
+	return legacy
+}
+
+func decodeBase64(encoded string) string {
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return encoded
+	}
+	return string(decoded)
+}
@@ -4,28 +4,150 @@ package tools
 import (
 	"bytes"
 	"command-runner/schema"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+// ErrCommandTimeout is returned (wrapped) when a command is killed for exceeding its timeout
+var ErrCommandTimeout = errors.New("command timed out")
+
+// pipeWaitDelay is how long runWithTimeout waits, once the command has exited, for the rest of its output.
+// A process it left in the background outside its process group (e.g. with setsid) may hold the pipes open.
+var pipeWaitDelay = 2 * time.Second
+
+// runWithTimeout starts cmd and waits for it to finish. If the timeout expires first the whole
+// process group is killed and an error wrapping ErrCommandTimeout is returned. Any output written
+// before the kill is left in the command's buffers.
+func runWithTimeout(cmd *exec.Cmd, timeout time.Duration) error {
+	release := acquireExecSlot()
+	defer release()
+
+	setProcessGroup(cmd)
+	output, err := pipeOutput(cmd)
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		output.closeWriters()
+		output.wait(0)
+		return err
+	}
+	output.closeWriters() // The command has its own copies
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		if err := killProcessGroup(cmd); err != nil {
+			logrus.Warnf("Failed to kill process group for %s: %v", cmd, err)
+		}
+		<-done
+		err = fmt.Errorf("%w after %s", ErrCommandTimeout, timeout)
+	}
+	if !output.wait(pipeWaitDelay) {
+		logrus.Warnf("Output of %s still open %s after it exited, a background process may hold it", cmd, pipeWaitDelay)
+	}
+	return err
+}
+
+// outputPipes copy a command's output to its Stdout and Stderr writers. Unlike the pipes of os/exec,
+// which Wait waits for until every process holding them has exited, they can be closed at any time.
+type outputPipes struct {
+	readers []*os.File
+	writers []*os.File
+	copied  sync.WaitGroup
+}
+
+// pipeOutput replaces the Stdout and Stderr writers of cmd, other than files, with outputPipes.
+// The same writer for both gets one pipe, as with os/exec.
+func pipeOutput(cmd *exec.Cmd) (*outputPipes, error) {
+	pipes := &outputPipes{}
+	stdout := cmd.Stdout
+	for _, target := range []*io.Writer{&cmd.Stdout, &cmd.Stderr} {
+		w := *target
+		if _, isFile := w.(*os.File); w == nil || isFile {
+			continue
+		}
+		if target == &cmd.Stderr && w == stdout && len(pipes.writers) > 0 {
+			*target = pipes.writers[0]
+			continue
+		}
+		r, pw, err := os.Pipe()
+		if err != nil {
+			pipes.closeWriters()
+			pipes.wait(0)
+			return nil, err
+		}
+		pipes.readers = append(pipes.readers, r)
+		pipes.writers = append(pipes.writers, pw)
+		*target = pw
+		pipes.copied.Add(1)
+		go func() {
+			defer pipes.copied.Done()
+			io.Copy(w, r)
+		}()
+	}
+	return pipes, nil
+}
+
+func (p *outputPipes) closeWriters() {
+	for _, w := range p.writers {
+		w.Close()
+	}
+}
+
+// wait waits up to delay for the output to be copied, then closes the pipes. It reports whether the
+// output was complete.
+func (p *outputPipes) wait(delay time.Duration) bool {
+	copied := make(chan struct{})
+	go func() {
+		p.copied.Wait()
+		close(copied)
+	}()
+	complete := true
+	select {
+	case <-copied:
+	case <-time.After(delay):
+		complete = false
+	}
+	for _, r := range p.readers {
+		r.Close()
+	}
+	<-copied
+	return complete
+}
+
 // Function to execute a shell command and capture its output and error streams
-func ExecuteShellCommand(command string, prependSource bool, instanceArg string) (string, string, error) {
+func ExecuteShellCommand(command string, prependSource bool, instanceArg string, timeout time.Duration) (string, string, error) {
 	if prependSource {
-		//		command = fmt.Sprintf("source %sp4_%s.vars; %s", schema.DefaultP4VarDir, instanceArg, command)
-		schema.ReSetVars2SourceFilePath(instanceArg)
-		command = fmt.Sprintf("source %s; %s", schema.Vars2SourceFilePath, command)
+		command = fmt.Sprintf("source %s; %s", schema.VarsFilePath(instanceArg), command)
 	}
 
-	logrus.Debugf("Executing shell command: %s", command)
+	logrus.Debugf("Executing shell command: %s (timeout %s)", command, timeout)
 	cmd := exec.Command("bash", "-c", command)
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
-	err := cmd.Run()
+	err := runWithTimeout(cmd, timeout)
 	if err != nil {
 		logrus.Errorf("Failed to execute command: %s", command)
 		logrus.Debugf("--Failed with error %s", err)
@@ -46,61 +168,69 @@ func ExecuteShellCommand(command string, prependSource bool, instanceArg string)
 }
 
 // runCommand runs the given command and returns its output
+// On timeout the partial output is returned along with the error.
 // TODO combine with above ExecuteShellCommand later
 func RunAutoBotCommand(cmdPath string, instanceArg string, prepend bool) (string, error) {
 	prependSourceCmd := ""
 	if prepend {
-		//prependSourceCmd = fmt.Sprintf("source %sp4_%s.vars; ", schema.DefaultP4VarDir, instanceArg) //TODO CLEAN UP
-		schema.ReSetVars2SourceFilePath(instanceArg)
-		prependSourceCmd = fmt.Sprintf("source %s; ", schema.Vars2SourceFilePath) //TODO CLEAN UP
+		prependSourceCmd = fmt.Sprintf("source %s; ", schema.VarsFilePath(instanceArg))
 	}
 	cmd := exec.Command("/bin/bash", "-c", prependSourceCmd+cmdPath)
-	output, err := cmd.CombinedOutput()
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := runWithTimeout(cmd, schema.CommandTimeout)
 	logrus.Debugf("Running script like so: %s", cmd)
 	if err != nil {
 		logrus.Errorf("Failed to execute %s: %s", cmdPath, err)
+		if errors.Is(err, ErrCommandTimeout) {
+			return output.String(), err
+		}
 		return "", err
 	}
-	logrus.Debugf("Output of script %s", output)
-	return string(output), nil
+	logrus.Debugf("Output of script %s", output.String())
+	return output.String(), nil
 }
 
-// Function to execute commands and encode output to Base64
-func ExecuteAndEncodeCommands(commands []schema.Command, prependSource bool, instanceArg string) ([]string, error) {
-	var base64Outputs []string
+// Function to execute commands and encode their output to Base64 entries
+// Commands run concurrently (bounded by schema.MaxParallel) and results keep the order of commands.
+func ExecuteAndEncodeCommands(commands []schema.Command, prependSource bool, instanceArg string) ([]JSONData, error) {
+	results := make([]JSONData, len(commands))
 
-	for _, cmd := range commands {
-		logrus.Debugf("Execute And Encode Command: %s", cmd.Command)
-		output, stderrOutput, err := ExecuteShellCommand(cmd.Command, prependSource, instanceArg)
-		if err != nil {
-			logrus.Errorf("Error executing and encoding command %s: %s", cmd.Command, err)
-
-			// Create a formatted error message string that includes the stderr output
-			//errorMsg := fmt.Sprintf("[Instance: %s] Error processing %s: %s\n%s", instanceArg, cmd.Command, err, stderrOutput)
-			var errorMsg string
-			if instanceArg != "" {
-				errorMsg = fmt.Sprintf("[Instance: %s] Error processing %s: %s\n%s", instanceArg, cmd.Command, err, stderrOutput)
-			} else {
-				errorMsg = fmt.Sprintf("Error processing %s: %s\n%s", cmd.Command, err, stderrOutput)
-			}
-			logrus.Errorf("errorMsg: %s", errorMsg)
-			// Encode the error message string
-			base64ErrorOutput := EncodeToBase64(errorMsg)
-
-			// Append the encoded error message to the outputs
-			base64Outputs = append(base64Outputs, base64ErrorOutput)
-
-			continue // Move on to the next command
-		}
+	runParallel(len(commands), func(i int) {
+		results[i] = executeAndEncodeCommand(commands[i], prependSource, instanceArg)
+	})
 
-		// For successful command execution, encode the output
+	logrus.Debug("ExecuteAndEncodeCommand completed")
+	return results, nil
+}
 
-		successMsg := output
+// executeAndEncodeCommand runs a single command and records its stdout, stderr, exit code and timing
+func executeAndEncodeCommand(cmd schema.Command, prependSource bool, instanceArg string) JSONData {
+	logrus.Debugf("Execute And Encode Command: %s", cmd.Command)
+	source := SourceOSCommand
+	if prependSource {
+		source = SourceP4Command
+	}
 
-		base64Output := EncodeToBase64(successMsg)
-		base64Outputs = append(base64Outputs, base64Output)
+	start := time.Now()
+	output, stderrOutput, err := ExecuteShellCommand(cmd.Command, prependSource, instanceArg, cmd.GetTimeout())
+	result := newResult(source, instanceArg, start)
+	result.Command = cmd.Command
+	result.Description = cmd.Description
+	result.MonitorTag = cmd.MonitorTag
+	result.Output = EncodeToBase64(output)
+	result.Stderr = EncodeToBase64(stderrOutput)
 
+	if err != nil {
+		logrus.Errorf("Error executing and encoding command %s: %s", cmd.Command, err)
+		result.setError(err)
+		if instanceArg != "" {
+			result.Error = fmt.Sprintf("[Instance: %s] Error processing %s: %s", instanceArg, cmd.Command, err)
+		} else {
+			result.Error = fmt.Sprintf("Error processing %s: %s", cmd.Command, err)
+		}
+		logrus.Errorf("errorMsg: %s", result.Error)
 	}
-	logrus.Debug("ExecuteAndEncodeCommand completed")
-	return base64Outputs, nil
+	return result
 }
@@ -0,0 +1,93 @@
+//go:build linux
+
+package tools
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readPid reads the pid a test command wrote to path, waiting for it to be written
+func readPid(t *testing.T, path string) int {
+	var pid int
+	assert.Eventually(t, func() bool {
+		data, err := os.ReadFile(path)
+		pid, err = strconv.Atoi(strings.TrimSpace(string(data)))
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	return pid
+}
+
+// processGone reports whether pid has exited: it no longer exists or is a zombie waiting to be reaped
+func processGone(pid int) bool {
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return true
+	}
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	return len(fields) == 0 || fields[0] == "Z"
+}
+
+func TestRunWithTimeoutKillsBackgroundChildren(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	cmd := exec.Command("sh", "-c", "sleep 30 & echo $! > "+pidFile+"; echo started; sleep 30")
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	start := time.Now()
+	err := runWithTimeout(cmd, 200*time.Millisecond)
+	assert.ErrorIs(t, err, ErrCommandTimeout)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Equal(t, "started\n", output.String(), "output written before the kill is kept")
+
+	pid := readPid(t, pidFile)
+	assert.Eventually(t, func() bool { return processGone(pid) }, 5*time.Second, 10*time.Millisecond,
+		"the background child is killed with the process group")
+}
+
+func TestRunWithTimeoutDoesNotWaitForDetachedProcesses(t *testing.T) {
+	waitDelay := pipeWaitDelay
+	pipeWaitDelay = 100 * time.Millisecond
+	t.Cleanup(func() { pipeWaitDelay = waitDelay })
+
+	tests := []struct {
+		name    string
+		script  string
+		timeout time.Duration
+		wantErr error
+	}{
+		{"command exits", "echo done", 10 * time.Second, nil},
+		{"command times out", "echo done; sleep 30", 200 * time.Millisecond, ErrCommandTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The detached process is in its own session, so it survives the kill and keeps stdout open
+			pidFile := filepath.Join(t.TempDir(), "pid")
+			cmd := exec.Command("sh", "-c", "setsid sh -c 'echo $$ > "+pidFile+"; exec sleep 30' & "+tt.script)
+			var stdout, stderr bytes.Buffer
+			cmd.Stdout = &stdout
+			cmd.Stderr = &stderr
+			t.Cleanup(func() { syscall.Kill(readPid(t, pidFile), syscall.SIGKILL) })
+
+			start := time.Now()
+			err := runWithTimeout(cmd, tt.timeout)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Less(t, time.Since(start), 5*time.Second)
+			assert.Equal(t, "done\n", stdout.String())
+		})
+	}
+}
@@ -0,0 +1,181 @@
+// Package fakemetadata serves fake AWS, GCP and Azure instance metadata services for tests. Each server
+// checks the headers its real counterpart requires (an IMDSv2 token, Metadata-Flavor: Google or
+// Metadata: true) and answers with realistic documents, which may be replaced. Any path can be made to
+// fail with a status code, and every answer can be delayed to test timeouts.
+package fakemetadata
+
+import (
+	"embed"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// AWSToken is the IMDSv2 session token the fake AWS service hands out and expects
+const AWSToken = "AQAEAFakeIMDSv2SessionToken=="
+
+// Paths of the documents served
+const (
+	AWSTokenPath          = "/latest/api/token"
+	AWSDocumentPath       = "/latest/dynamic/instance-identity/document"
+	AWSTagsPath           = "/latest/meta-data/tags/instance/"
+	GCPInstancePath       = "/computeMetadata/v1/instance/"
+	AzureInstancePath     = "/metadata/instance"
+	AzureAttestedPath     = "/metadata/attested/document"
+	AzureAttestedDocument = `{"encoding":"pkcs7","signature":"MIIKWAYJKoZIhvcNAQcCoIIKSTCCCkUCAQEx"}`
+)
+
+//go:embed testdata
+var testdata embed.FS
+
+// Server is a fake metadata service. Its URL is the base URL to use as the metadata endpoint.
+type Server struct {
+	*httptest.Server
+	mu       sync.Mutex
+	bodies   map[string]string
+	statuses map[string]int
+	delay    time.Duration
+	imdsv1   bool
+	requests []string
+}
+
+// NewAWS starts a fake AWS IMDS requiring IMDSv2 tokens (unless AllowIMDSv1 is called), with an instance
+// identity document and three instance tags: Name, Owner and Cost Center. It is closed when the test ends.
+func NewAWS(t testing.TB) *Server {
+	return newServer(t, map[string]string{
+		AWSDocumentPath:             readTestdata(t, "aws_document.json"),
+		AWSTagsPath:                 "Name\nOwner\nCost Center",
+		AWSTagsPath + "Name":        "perforce-commit",
+		AWSTagsPath + "Owner":       "perforce-admins",
+		AWSTagsPath + "Cost Center": "1234",
+	}, func(s *Server, r *http.Request) (int, string) {
+		if r.Method == http.MethodPut && r.URL.Path == AWSTokenPath {
+			if r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+				return http.StatusBadRequest, "Bad Request"
+			}
+			return http.StatusOK, AWSToken
+		}
+		token := r.Header.Get("X-aws-ec2-metadata-token")
+		if token != AWSToken && (token != "" || !s.allowsIMDSv1()) {
+			return http.StatusUnauthorized, "Unauthorized"
+		}
+		return s.document(r.URL.Path)
+	})
+}
+
+// NewGCP starts a fake GCP metadata server, whose recursive instance metadata includes ssh-keys. It is
+// closed when the test ends.
+func NewGCP(t testing.TB) *Server {
+	return newServer(t, map[string]string{
+		GCPInstancePath: readTestdata(t, "gcp_instance.json"),
+	}, func(s *Server, r *http.Request) (int, string) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			return http.StatusForbidden, "Missing Metadata-Flavor:Google header."
+		}
+		return s.document(r.URL.Path)
+	})
+}
+
+// NewAzure starts a fake Azure IMDS, whose instance metadata includes publicKeys, customData and userData,
+// and which serves an attested document. It is closed when the test ends.
+func NewAzure(t testing.TB) *Server {
+	return newServer(t, map[string]string{
+		AzureInstancePath: readTestdata(t, "azure_instance.json"),
+		AzureAttestedPath: AzureAttestedDocument,
+	}, func(s *Server, r *http.Request) (int, string) {
+		if r.Header.Get("Metadata") != "true" {
+			return http.StatusBadRequest, `{"error":"Bad request. Required metadata header not specified"}`
+		}
+		return s.document(r.URL.Path)
+	})
+}
+
+// SetBody replaces the document served at path, or adds one
+func (s *Server) SetBody(path, body string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bodies[path] = body
+}
+
+// SetStatus makes requests for path fail with status
+func (s *Server) SetStatus(path string, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statuses[path] = status
+}
+
+// AllowIMDSv1 makes the fake AWS IMDS answer requests without a token, as IMDS does when IMDSv2 is optional
+func (s *Server) AllowIMDSv1() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.imdsv1 = true
+}
+
+func (s *Server) allowsIMDSv1() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.imdsv1
+}
+
+// SetDelay delays every answer by d, or until the client gives up
+func (s *Server) SetDelay(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delay = d
+}
+
+// Requests returns the requests received so far, as "METHOD /path?query"
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// newServer starts a server serving bodies. Each request is recorded and waits for the delay, then fails
+// with the status set for its path, or else gets what answer returns.
+func newServer(t testing.TB, bodies map[string]string, answer func(s *Server, r *http.Request) (int, string)) *Server {
+	s := &Server{bodies: bodies, statuses: map[string]int{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests = append(s.requests, r.Method+" "+r.URL.RequestURI())
+		delay := s.delay
+		status, failed := s.statuses[r.URL.Path]
+		s.mu.Unlock()
+
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		body := http.StatusText(status)
+		if !failed {
+			status, body = answer(s, r)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// document returns the document at path, or 404
+func (s *Server) document(path string) (int, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if body, ok := s.bodies[path]; ok {
+		return http.StatusOK, body
+	}
+	return http.StatusNotFound, "Not Found"
+}
+
+func readTestdata(t testing.TB, name string) string {
+	data, err := testdata.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatalf("reading fake metadata %s: %v", name, err)
+	}
+	return string(data)
+}
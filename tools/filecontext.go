@@ -0,0 +1,123 @@
+package tools
+
+import (
+	"command-runner/schema"
+	"fmt"
+	"regexp"
+)
+
+// contextSeparator separates groups of lines that are not next to each other, as in grep output
+const contextSeparator = "--"
+
+// numberedLine is a line of a file with its line number, and whether it matched the keywords
+type numberedLine struct {
+	number int
+	text   string
+	match  bool
+}
+
+// matchSelector picks the matching lines of a file with before and after lines of context, and writes
+// them to out numbered like grep -n: "12:match" for a match, "11-context" for context. With max_matches
+// only the first (or with keep: last, the last) matches are written. Redactions are applied to the lines
+// written.
+type matchSelector struct {
+	before, after, maxMatches int
+	keepLast                  bool
+	redactions                []*regexp.Regexp
+	out                       *limitedOutput
+
+	recent    []numberedLine   // Up to before lines preceding the current one
+	afterLeft int              // Lines of context still to write after the last match
+	matches   int              // Matches seen so far
+	groups    [][]numberedLine // keep: last: the last maxMatches matches, each with its context
+	written   int              // Number of the last line written
+}
+
+// usesContext reports whether fileConfig asks for context or match limits, and so numbered output
+func usesContext(fileConfig schema.FileConfig) bool {
+	return fileConfig.Before > 0 || fileConfig.After > 0 || fileConfig.MaxMatches > 0 || fileConfig.Keep != ""
+}
+
+func newMatchSelector(fileConfig schema.FileConfig, redactions []*regexp.Regexp, out *limitedOutput) *matchSelector {
+	return &matchSelector{
+		before:     fileConfig.Before,
+		after:      fileConfig.After,
+		maxMatches: fileConfig.MaxMatches,
+		keepLast:   fileConfig.Keep == schema.FileKeepLast,
+		redactions: redactions,
+		out:        out,
+	}
+}
+
+// add takes the next line of the file and reports whether more lines are wanted
+func (m *matchSelector) add(line numberedLine) bool {
+	if line.match && !m.keepLast && m.maxMatches > 0 && m.matches >= m.maxMatches {
+		line.match = false // Past max_matches a matching line is only written as context of an earlier match
+	}
+	switch {
+	case line.match:
+		m.matches++
+		group := append(append([]numberedLine{}, m.recent...), line)
+		m.recent = m.recent[:0]
+		m.afterLeft = m.after
+		if m.keepLast {
+			m.groups = append(m.groups, group)
+			if m.maxMatches > 0 && len(m.groups) > m.maxMatches {
+				m.groups = m.groups[1:]
+			}
+		} else if !m.writeAll(group) {
+			return false
+		}
+	case m.afterLeft > 0:
+		m.afterLeft--
+		if m.keepLast {
+			last := len(m.groups) - 1
+			m.groups[last] = append(m.groups[last], line)
+		} else if !m.write(line) {
+			return false
+		}
+	}
+
+	if m.before > 0 {
+		m.recent = append(m.recent, line)
+		if len(m.recent) > m.before {
+			m.recent = m.recent[1:]
+		}
+	}
+	// Once the first max_matches matches and their context are written the rest of the file is not needed
+	return m.keepLast || m.maxMatches == 0 || m.matches < m.maxMatches || m.afterLeft > 0
+}
+
+// finish writes the matches kept with keep: last
+func (m *matchSelector) finish() {
+	for _, group := range m.groups {
+		if !m.writeAll(group) {
+			return
+		}
+	}
+}
+
+func (m *matchSelector) writeAll(lines []numberedLine) bool {
+	for _, line := range lines {
+		if !m.write(line) {
+			return false
+		}
+	}
+	return true
+}
+
+// write adds line to the output unless it was already written as part of an overlapping group
+func (m *matchSelector) write(line numberedLine) bool {
+	if line.number <= m.written {
+		return true
+	}
+	if m.written > 0 && line.number > m.written+1 && !m.out.add(contextSeparator) {
+		return false
+	}
+	m.written = line.number
+	separator := "-"
+	if line.match {
+		separator = ":"
+	}
+	return m.out.add(fmt.Sprintf("%d%s%s", line.number, separator, redactLine(line.text, m.redactions)))
+}
@@ -0,0 +1,87 @@
+package tools
+
+import (
+	"command-runner/schema"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseContentContext(t *testing.T) {
+	tests := []struct {
+		name   string
+		config schema.FileConfig
+		want   string
+	}{
+		{
+			name:   "after",
+			config: schema.FileConfig{Keywords: []string{"error"}, After: 3},
+			want: "3:Perforce server error:\n" +
+				"4-\tDate 2024/05/01 10:00:05:\n" +
+				"5-\tOperation: user-sync\n" +
+				"6-\tLibrarian checkout depot/main/a.c failed.",
+		},
+		{
+			name:   "separator between groups",
+			config: schema.FileConfig{Keywords: []string{"Perforce server"}, After: 1},
+			want: "1:Perforce server info:\n" +
+				"2-\t2024/05/01 10:00:00 pid 101 super@ws 127.0.0.1 [p4/2023.2] 'user-info'\n" +
+				"3:Perforce server error:\n" +
+				"4-\tDate 2024/05/01 10:00:05:\n" +
+				"--\n" +
+				"7:Perforce server info:\n" +
+				"8-\t2024/05/01 10:00:09 pid 102 build@ci 10.0.0.2 [p4/2023.2] 'user-changes'",
+		},
+		{
+			name:   "overlapping context is written once",
+			config: schema.FileConfig{Keywords: []string{"Operation", "failed"}, Before: 2},
+			want: "3-Perforce server error:\n" +
+				"4-\tDate 2024/05/01 10:00:05:\n" +
+				"5:\tOperation: user-sync\n" +
+				"6:\tLibrarian checkout depot/main/a.c failed.",
+		},
+		{
+			name:   "max_matches keeps the first",
+			config: schema.FileConfig{Keywords: []string{"Perforce server"}, MaxMatches: 2},
+			want:   "1:Perforce server info:\n--\n3:Perforce server error:",
+		},
+		{
+			name:   "matches after max_matches are context",
+			config: schema.FileConfig{Keywords: []string{"Perforce", "2024"}, MaxMatches: 1, After: 2},
+			want: "1:Perforce server info:\n" +
+				"2-\t2024/05/01 10:00:00 pid 101 super@ws 127.0.0.1 [p4/2023.2] 'user-info'\n" +
+				"3-Perforce server error:",
+		},
+		{
+			name:   "matches after max_matches do not extend the context",
+			config: schema.FileConfig{Keywords: []string{"Operation", "failed"}, MaxMatches: 1, After: 1},
+			want:   "5:\tOperation: user-sync\n6-\tLibrarian checkout depot/main/a.c failed.",
+		},
+		{
+			name:   "keep last",
+			config: schema.FileConfig{Keywords: []string{"Perforce server"}, MaxMatches: 1, Keep: schema.FileKeepLast, Before: 1},
+			want:   "6-\tLibrarian checkout depot/main/a.c failed.\n7:Perforce server info:",
+		},
+		{
+			name:   "redactions apply to context",
+			config: schema.FileConfig{Keywords: []string{"failed"}, Before: 1, Redactions: []string{`Operation: (\S+)`}},
+			want:   "5-\tOperation: ****\n6:\tLibrarian checkout depot/main/a.c failed.",
+		},
+		{
+			name:   "max_lines still applies",
+			config: schema.FileConfig{Keywords: []string{"error"}, After: 3, MaxLines: 2},
+			want: "3:Perforce server error:\n" +
+				"4-\tDate 2024/05/01 10:00:05:\n" +
+				"[command-runner: output truncated, max_lines (2) reached]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseContent(filepath.Join("testfiles", "p4d.log"), tt.config)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
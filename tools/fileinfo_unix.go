@@ -0,0 +1,26 @@
+//go:build !windows
+
+package tools
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// fileInode returns the inode of the file, used to notice a log that was rotated
+func fileInode(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
+
+// fileOwnerIDs returns the numeric owner and group of the file
+func fileOwnerIDs(fi os.FileInfo) (uid, gid string, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", "", false
+	}
+	return strconv.FormatUint(uint64(st.Uid), 10), strconv.FormatUint(uint64(st.Gid), 10), true
+}
@@ -0,0 +1,15 @@
+//go:build windows
+
+package tools
+
+import "os"
+
+// fileInode is not available on Windows; rotation is then only noticed when the file shrinks
+func fileInode(fi os.FileInfo) uint64 {
+	return 0
+}
+
+// fileOwnerIDs is not available on Windows
+func fileOwnerIDs(fi os.FileInfo) (uid, gid string, ok bool) {
+	return "", "", false
+}
@@ -0,0 +1,84 @@
+package tools
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"time"
+)
+
+// FileMetadata is what collect: metadata records about a file instead of its content
+type FileMetadata struct {
+	Path          string    `json:"path"`
+	Size          int64     `json:"size"`
+	Mode          string    `json:"mode"`        // e.g. -rw-r--r--
+	Permissions   string    `json:"permissions"` // Octal, e.g. 0644
+	Owner         string    `json:"owner,omitempty"`
+	Group         string    `json:"group,omitempty"`
+	UID           string    `json:"uid,omitempty"`
+	GID           string    `json:"gid,omitempty"`
+	ModTime       time.Time `json:"mtime"`
+	SHA256        string    `json:"sha256,omitempty"`
+	SymlinkTarget string    `json:"symlink_target,omitempty"`
+}
+
+// collectMetadata returns the metadata of filePath as a JSON object. For a symbolic link the target is
+// recorded and the size, mode, owner and checksum are those of the file it points to.
+func collectMetadata(filePath string) (string, error) {
+	lfi, err := os.Lstat(filePath)
+	if err != nil {
+		return "", err // Keep the original error so a missing file is reported as such
+	}
+	meta := FileMetadata{Path: filePath}
+	fi := lfi
+	if lfi.Mode()&os.ModeSymlink != 0 {
+		if meta.SymlinkTarget, err = os.Readlink(filePath); err != nil {
+			return "", fmt.Errorf("error reading symlink %s: %w", filePath, err)
+		}
+		if fi, err = os.Stat(filePath); err != nil {
+			return "", fmt.Errorf("error following symlink %s: %w", filePath, err)
+		}
+	}
+
+	meta.Size = fi.Size()
+	meta.Mode = fi.Mode().String()
+	meta.Permissions = fmt.Sprintf("%04o", fi.Mode().Perm())
+	meta.ModTime = fi.ModTime().UTC()
+	if uid, gid, ok := fileOwnerIDs(fi); ok {
+		meta.UID, meta.GID = uid, gid
+		if u, err := user.LookupId(uid); err == nil {
+			meta.Owner = u.Username
+		}
+		if g, err := user.LookupGroupId(gid); err == nil {
+			meta.Group = g.Name
+		}
+	}
+	if fi.Mode().IsRegular() {
+		if meta.SHA256, err = fileSHA256(filePath); err != nil {
+			return "", err
+		}
+	}
+
+	out, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+func fileSHA256(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("error hashing %s: %w", filePath, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
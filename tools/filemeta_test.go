@@ -0,0 +1,42 @@
+package tools
+
+import (
+	"command-runner/schema"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollectMetadata(t *testing.T) {
+	dir := t.TempDir()
+	license := filepath.Join(dir, "license")
+	os.WriteFile(license, []byte("secret license\n"), 0640)
+	os.Chmod(license, 0640)
+	link := filepath.Join(dir, "license.link")
+	if err := os.Symlink(license, link); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+
+	out, err := parseContent(link, schema.FileConfig{Collect: schema.FileCollectMetadata})
+	assert.NoError(t, err)
+	assert.NotContains(t, out, "secret license", "content is never sent")
+
+	var meta FileMetadata
+	assert.NoError(t, json.Unmarshal([]byte(out), &meta))
+	assert.Equal(t, link, meta.Path)
+	assert.Equal(t, license, meta.SymlinkTarget)
+	assert.Equal(t, int64(15), meta.Size)
+	assert.Equal(t, "0734659f74b9841f9b64d6a16b0db306cddf6e5b0f178e5f0f8441efd2640c99", meta.SHA256)
+	if runtime.GOOS != "windows" {
+		assert.Equal(t, "0640", meta.Permissions)
+		assert.Equal(t, "-rw-r-----", meta.Mode)
+		assert.NotEmpty(t, meta.UID)
+	}
+
+	_, err = parseContent(filepath.Join(dir, "missing"), schema.FileConfig{Collect: schema.FileCollectMetadata})
+	assert.True(t, os.IsNotExist(err))
+}
@@ -1,21 +1,25 @@
 package tools
 
 import (
+	"bufio"
 	"command-runner/schema"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 )
 
 // TODO Description for instance file parsed FIX
-// FileParserFromYAMLConfigOs reads a YAML configuration, parses the specified files at server level, and appends the
-// results to the output JSON file.
+// FileParserFromYAMLConfigOs reads a YAML configuration, parses the specified files at server level, and adds the
+// results to the collector.
 // Returns an error if any issues arise during the parsing process.
-func FileParserFromYAMLConfigOs(configFilePath string, OutputJSONFilePath string) error {
+func FileParserFromYAMLConfigOs(configFilePath string, collector *Collector) error {
 	config, err := readYAMLConfig(configFilePath)
 	if err != nil {
 		logrus.Errorf("error reading YAML config: %v", err)
@@ -24,12 +28,13 @@ func FileParserFromYAMLConfigOs(configFilePath string, OutputJSONFilePath string
 
 	var hadError bool
 	for _, file := range config.Files {
-		filePath := file.PathToFile
 		if file.ParsingLevel == "server" {
-			if err := parseAndAppendAtOsLevel(filePath, file, OutputJSONFilePath); err != nil {
-				logrus.Errorf("error parsing file %s: %v", filePath, err)
-				hadError = true
-				// don't return, continue with the next file
+			for _, filePath := range resolveFilePaths(file.PathToFile, file, collector, "") {
+				if err := parseAndAppendAtOsLevel(filePath, file, collector); err != nil {
+					logrus.Errorf("error parsing file %s: %v", filePath, err)
+					hadError = true
+					// don't return, continue with the next file
+				}
 			}
 		}
 	}
@@ -41,10 +46,10 @@ func FileParserFromYAMLConfigOs(configFilePath string, OutputJSONFilePath string
 }
 
 // FileParserFromYAMLConfigP4 reads a YAML configuration, parses the specified files at instance level
-// (replacing the instance placeholder in the file path with the provided instance name) and appends the results
-// to the output file.
+// (replacing every instance placeholder in the file path with the provided instance name) and adds the results
+// to the collector.
 // Returns an error if any issues arise during the parsing process.
-func FileParserFromYAMLConfigP4(configFilePath, OutputJSONFilePath, instance string) error {
+func FileParserFromYAMLConfigP4(configFilePath string, collector *Collector, instance string) error {
 	config, err := readYAMLConfig(configFilePath)
 	if err != nil {
 		return fmt.Errorf("error reading YAML config: %w", err)
@@ -52,17 +57,18 @@ func FileParserFromYAMLConfigP4(configFilePath, OutputJSONFilePath, instance str
 
 	var hadError bool
 	for _, file := range config.Files {
-		filePath := file.PathToFile
 		if file.ParsingLevel == "instance" {
-			filePath = strings.Replace(filePath, "%INSTANCE%", instance, 1)
-			err := parseAndAppendAtP4Level(filePath, file, OutputJSONFilePath, instance)
-			if err != nil {
-				if os.IsNotExist(err) { // Check if error is because file does not exist
-					logrus.Warnf("file %s does not exist: %v", filePath, err)
-					hadError = true
-				} else {
-					logrus.Errorf("error parsing file %s: %v", filePath, err)
-					hadError = true
+			pathToFile := strings.ReplaceAll(file.PathToFile, "%INSTANCE%", instance)
+			for _, filePath := range resolveFilePaths(pathToFile, file, collector, instance) {
+				err := parseAndAppendAtP4Level(filePath, file, collector, instance)
+				if err != nil {
+					if os.IsNotExist(err) { // Check if error is because file does not exist
+						logrus.Warnf("file %s does not exist: %v", filePath, err)
+						hadError = true
+					} else {
+						logrus.Errorf("error parsing file %s: %v", filePath, err)
+						hadError = true
+					}
 				}
 			}
 		}
@@ -73,111 +79,230 @@ func FileParserFromYAMLConfigP4(configFilePath, OutputJSONFilePath, instance str
 	return nil
 }
 
-// parseAndAppendAtOsLevel is an internal function that takes in a filePath, its configuration and an output path.
-// It parses the content based on the configuration and appends the result to the output file.
+// parseAndAppendAtOsLevel is an internal function that takes in a filePath, its configuration and a collector.
+// It parses the content based on the configuration and adds the result to the collector.
 // TODO Refactor possibly
-func parseAndAppendAtOsLevel(filePath string, fileConfig schema.FileConfig, OutputJSONFilePath string) error {
+func parseAndAppendAtOsLevel(filePath string, fileConfig schema.FileConfig, collector *Collector) error {
+	start := time.Now()
 	parsedContent, err := parseContent(filePath, fileConfig)
 	if err != nil {
 		// If there's an error reading the file, handle it
 		if os.IsNotExist(err) {
 			logrus.Errorf("[OS] creating failed to parse for json")
 			// File does not exist, append specific message to JSON
-			message := fmt.Sprintf("File: %s was not found", filePath)
-			jsonData := JSONData{
-				Command:     "[OS] Failed to parse: " + filePath,
-				Description: fmt.Sprintf("File: %v", filePath),
-				Output:      EncodeToBase64(message),
-				MonitorTag:  fileConfig.MonitorTag,
-			}
-			if err := AppendParsedDataToFile([]JSONData{jsonData}, OutputJSONFilePath); err != nil {
-				logrus.Errorf("[OS] error appending not found file data to output: %v", err)
-			}
+			appendSkippedFile("[OS] ", filePath, fmt.Sprintf("File: %s was not found", filePath), fileConfig, collector, "", start)
 			// Now continue with the loop
 			return nil
 		}
+		if errors.Is(err, errBinaryFile) {
+			logrus.Warnf("[OS] not sending binary file %s", filePath)
+			appendSkippedFile("[OS] ", filePath, fmt.Sprintf("File: %s is binary, its content was not sent", filePath), fileConfig, collector, "", start)
+			return nil
+		}
 		return err
 	}
-	return appendParsedData(filePath, parsedContent, fileConfig, OutputJSONFilePath)
+	return appendParsedData(filePath, parsedContent, fileConfig, collector, "", start)
+}
+
+// appendSkippedFile adds a skipped entry for a file that could not be parsed, with reason as its error
+func appendSkippedFile(prefix, filePath, reason string, fileConfig schema.FileConfig, collector *Collector, instanceArg string, start time.Time) {
+	jsonData := newResult(SourceFile, instanceArg, start)
+	jsonData.Command = prefix + "Failed to parse: " + filePath
+	jsonData.Description = fmt.Sprintf("File: %v", filePath)
+	jsonData.MonitorTag = fileConfig.MonitorTag
+	jsonData.Status = StatusSkipped
+	jsonData.Error = reason
+	collector.Add(jsonData)
 }
 
 // parseAndAppendAtP4Level is similar to parseAndAppendAtOsLevel, but it's specifically for parsing at the instance level.
 // TODO Refactor possibly
-func parseAndAppendAtP4Level(filePath string, fileConfig schema.FileConfig, OutputJSONFilePath, instanceArg string) error {
+func parseAndAppendAtP4Level(filePath string, fileConfig schema.FileConfig, collector *Collector, instanceArg string) error {
+	start := time.Now()
 	parsedContent, err := parseContent(filePath, fileConfig)
 	if err != nil {
 		// If there's an error reading the file, handle it
 		if os.IsNotExist(err) {
 			logrus.Errorf("[P4] creating failed to parse for json")
 			// File does not exist, append specific message to JSON
-			message := fmt.Sprintf("File: %s was not found", filePath)
-			jsonData := JSONData{
-				Command:     "[P4] Failed to parse: " + filePath,
-				Description: fmt.Sprintf("File: %v", filePath),
-				Output:      EncodeToBase64(message),
-				MonitorTag:  fileConfig.MonitorTag,
-			}
-			if err := AppendParsedDataToFile([]JSONData{jsonData}, OutputJSONFilePath); err != nil {
-				logrus.Errorf("[P4] error appending not found file data to output: %v", err)
-			}
+			appendSkippedFile("[P4] ", filePath, fmt.Sprintf("File: %s was not found", filePath), fileConfig, collector, instanceArg, start)
 			// Now continue with the loop
 			return nil
 		}
+		if errors.Is(err, errBinaryFile) {
+			logrus.Warnf("[P4] not sending binary file %s", filePath)
+			appendSkippedFile("[P4] ", filePath, fmt.Sprintf("File: %s is binary, its content was not sent", filePath), fileConfig, collector, instanceArg, start)
+			return nil
+		}
 		return err
 	}
-	return appendParsedData(filePath, parsedContent, fileConfig, OutputJSONFilePath)
+	return appendParsedData(filePath, parsedContent, fileConfig, collector, instanceArg, start)
 }
 
 // parseContent is an internal function that reads the content from a file based on the provided configuration.
 // It looks for specific keywords to parse the content or returns the entire content if ParseAll is true.
+// The file is read line by line, decompressing gzip, bzip2 and zstd files (see openFileReader), and
+// binary files are refused. At most max_bytes and max_lines are returned, followed by a truncation marker if
+// there was more (see limitedOutput). Lines matching keywords can come with context lines, numbered
+// (see matchSelector).
+// In tail mode only the lines added since the last run are read (see readTail), and all of them are parsed
+// unless keywords are given. With a format the file is returned as a JSON object (see parseStructured).
+// Redactions are applied to the result in every case. With collect: metadata only the file's metadata is
+// returned (see collectMetadata).
 func parseContent(filePath string, fileConfig schema.FileConfig) (string, error) {
-	fileContent, err := ioutil.ReadFile(filePath)
+	if fileConfig.Collect == schema.FileCollectMetadata {
+		logrus.Infof("Collecting metadata of file: %q", filePath)
+		return collectMetadata(filePath)
+	}
+
+	regexKeywords, err := compilePatterns(fileConfig.RegexKeywords)
+	if err != nil {
+		return "", fmt.Errorf("invalid regexKeywords for %s: %w", filePath, err)
+	}
+	redactions, err := compilePatterns(fileConfig.Redactions)
+	if err != nil {
+		return "", fmt.Errorf("invalid redactions for %s: %w", filePath, err)
+	}
+
+	parseAll := fileConfig.ParseAll
+	maxBytes := fileConfig.MaxBytes
+	var reader *bufio.Reader
+	if fileConfig.Mode == schema.FileModeTail {
+		var content string
+		content, err = readTail(filePath, fileConfig.MonitorTag, fileConfig.MaxBytes)
+		if err == nil {
+			reader = bufio.NewReader(strings.NewReader(content))
+			if err = checkText(reader); err != nil {
+				err = fmt.Errorf("%s: %w", filePath, err)
+			}
+		}
+		parseAll = len(fileConfig.Keywords) == 0 && len(regexKeywords) == 0
+	} else {
+		var file *fileReader
+		file, err = openFileReader(filePath)
+		if err == nil {
+			defer file.Close()
+			reader = file.Reader
+		}
+		if maxBytes <= 0 {
+			maxBytes = schema.DefaultFileMaxBytes
+		}
+	}
 	if err != nil {
 		logrus.Errorf("failed to read file: %q: %v", filePath, err)
 		//	return "", fmt.Errorf("failed to read file %q: %w", filePath, err)
 		return "", err // Return the original error
 
 	}
-	content := string(fileContent)
 
-	// If ParseAll is true, return the full content (but still sanitize if needed)
-	if fileConfig.ParseAll {
+	if fileConfig.Format != "" {
+		logrus.Infof("Parsing %s content of file: %q", fileConfig.Format, filePath)
+		content, err := readAllLimited(reader, maxBytes)
+		if err != nil {
+			return "", fmt.Errorf("error reading %s: %w", filePath, err)
+		}
+		structured, err := parseStructured(content, fileConfig)
+		if err != nil {
+			return "", err
+		}
+		return redactOutput(structured, redactions), nil
+	}
+
+	// If ParseAll is true, keep every line (but still sanitize if needed)
+	if parseAll {
 		logrus.Infof("Parsing entire content of file: %q", filePath)
-		return sanitizeOutput(content, fileConfig.SanitizationKeywords), nil
 	}
+	output := &limitedOutput{maxBytes: maxBytes, maxLines: fileConfig.MaxLines}
+	var selector *matchSelector
+	if !parseAll && usesContext(fileConfig) {
+		selector = newMatchSelector(fileConfig, redactions, output)
+	}
+	number := 0
+	endsWithNewline, err := scanLines(reader, func(line string) bool {
+		number++
+		match := parseAll || matchesKeyword(line, fileConfig.Keywords, regexKeywords)
+		if isSanitized(line, fileConfig.SanitizationKeywords) {
+			return true
+		}
+		if selector != nil {
+			return selector.add(numberedLine{number: number, text: line, match: match})
+		}
+		if !match {
+			return true
+		}
+		return output.add(redactLine(line, redactions))
+	})
+	if err != nil {
+		return "", fmt.Errorf("error reading %s: %w", filePath, err)
+	}
+	if selector != nil {
+		selector.finish()
+	}
+	output.newlineAtEnd = parseAll && endsWithNewline
+	if output.truncated != "" {
+		logrus.Warnf("Output of file %q truncated, %s reached", filePath, output.truncated)
+	}
+	if !parseAll {
+		logrus.Infof("Parsed content from file: %q based on provided keywords", filePath)
+	}
+	return output.String(), nil
+}
 
-	var outputLines []string
-	lines := strings.Split(content, "\n")
-	for _, line := range lines {
-		for _, keyword := range fileConfig.Keywords {
-			if strings.Contains(line, keyword) {
-				outputLines = append(outputLines, line)
-				break
-			}
+// matchesKeyword reports whether line contains any of the keywords or matches any of the regexKeywords
+func matchesKeyword(line string, keywords []string, regexKeywords []*regexp.Regexp) bool {
+	for _, keyword := range keywords {
+		if strings.Contains(line, keyword) {
+			return true
 		}
 	}
-	logrus.Infof("Parsed content from file: %q based on provided keywords", filePath)
+	for _, re := range regexKeywords {
+		if re.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
 
-	return sanitizeOutput(strings.Join(outputLines, "\n"), fileConfig.SanitizationKeywords), nil
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
 }
 
-// sanitizeOutput removes lines containing any of the provided sanitization keywords from the output.
-func sanitizeOutput(output string, sanitizationKeywords []string) string {
-	var sanitizedOutputLines []string
+// redactOutput masks secrets line by line (see maskMatches), so ^ and $ in a redaction match the start and
+// end of a line.
+func redactOutput(output string, redactions []*regexp.Regexp) string {
+	if len(redactions) == 0 {
+		return output
+	}
 	lines := strings.Split(output, "\n")
-	for _, line := range lines {
-		isSanitized := false
-		for _, keyword := range sanitizationKeywords {
-			if strings.Contains(line, keyword) {
-				isSanitized = true
-				break
-			}
-		}
-		if !isSanitized {
-			sanitizedOutputLines = append(sanitizedOutputLines, line)
+	for i, line := range lines {
+		lines[i] = redactLine(line, redactions)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func redactLine(line string, redactions []*regexp.Regexp) string {
+	for _, re := range redactions {
+		line, _ = maskMatches(line, re)
+	}
+	return line
+}
+
+// isSanitized reports whether line contains any of the sanitization keywords
+func isSanitized(line string, sanitizationKeywords []string) bool {
+	for _, keyword := range sanitizationKeywords {
+		if strings.Contains(line, keyword) {
+			return true
 		}
 	}
-	return strings.Join(sanitizedOutputLines, "\n")
+	return false
 }
 
 // readYAMLConfig is an internal function to read and unmarshal the YAML configuration from a given file path.
@@ -197,18 +322,15 @@ func readYAMLConfig(configFilePath string) (*schema.FileParserConfig, error) {
 	return &config, nil
 }
 
-// appendParsedData takes the parsed content and appends it in a structured format to the provided output file.
-func appendParsedData(filePath string, parsedContent string, fileConfig schema.FileConfig, OutputJSONFilePath string) error {
-	// Now sanitize the parsed content
-	sanitizedOutput := sanitizeOutput(parsedContent, fileConfig.SanitizationKeywords)
-
-	jsonData := JSONData{
-		Command:     "File parsed: " + filePath,
-		Description: fmt.Sprintf("File: %v", filePath),
-		Output:      EncodeToBase64(sanitizedOutput),
-		MonitorTag:  fileConfig.MonitorTag,
-	}
-
-	return AppendParsedDataToFile([]JSONData{jsonData}, OutputJSONFilePath)
+// appendParsedData takes the parsed content and adds it in a structured format to the collector.
+// The content was already sanitized by parseContent.
+func appendParsedData(filePath string, parsedContent string, fileConfig schema.FileConfig, collector *Collector, instanceArg string, start time.Time) error {
+	jsonData := newResult(SourceFile, instanceArg, start)
+	jsonData.Command = "File parsed: " + filePath
+	jsonData.Description = fmt.Sprintf("File: %v", filePath)
+	jsonData.Output = EncodeToBase64(parsedContent)
+	jsonData.MonitorTag = fileConfig.MonitorTag
 
+	collector.Add(jsonData)
+	return nil
 }
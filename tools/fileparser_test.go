@@ -0,0 +1,82 @@
+package tools
+
+import (
+	"command-runner/schema"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// swarmRedactions are the redactions of the swarm config.php entry in configs/cmd_config.yaml
+var swarmRedactions = []string{
+	`(?i)['"][^'"]*(?:password|secret|token)[^'"]*['"]\s*=>\s*'((?:[^'\\]|\\.)*)'`,
+	`(?i)['"][^'"]*(?:password|secret|token)[^'"]*['"]\s*=>\s*"((?:[^"\\]|\\.)*)"`,
+}
+
+func TestParseContentRedactions(t *testing.T) {
+	tests := []struct {
+		name   string
+		file   string
+		config schema.FileConfig
+		want   string
+	}{
+		{
+			name: "swarm config.php parseAll keeps context lines",
+			file: "swarm_config.php",
+			config: schema.FileConfig{
+				ParseAll:   true,
+				Redactions: swarmRedactions,
+			},
+			want: "        'password' => '****',",
+		},
+		{
+			name: "swarm config.php regex keywords",
+			file: "swarm_config.php",
+			config: schema.FileConfig{
+				RegexKeywords: []string{`^\s*'(user|password)'\s*=>`},
+				Redactions:    []string{`'password'\s*=>\s*'([^']*)'`},
+			},
+			want: "        'user'     => 'swarm',\n" +
+				"        'password' => '****',\n" +
+				"                'password' => '****',\n" +
+				"        'user'     => 'jira-bot',\n" +
+				"        'password' => '****',",
+		},
+		{
+			name: "HAS .env keywords with whole match redaction",
+			file: "has.env",
+			config: schema.FileConfig{
+				Keywords:   []string{"OIDC_", "SESSION_"},
+				Redactions: []string{`[0-9a-f]{32}`, `^SESSION_SECRET=(.*)$`},
+			},
+			want: "OIDC_CLIENT_ID=helix-auth\n" +
+				"OIDC_CLIENT_SECRET=****\n" +
+				"OIDC_ISSUER_URI=https://idp.example.com/\n" +
+				"SESSION_SECRET=****",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseContent(filepath.Join("testfiles", tt.file), tt.config)
+			assert.NoError(t, err)
+			if tt.config.ParseAll {
+				assert.Contains(t, got, tt.want)
+				assert.Contains(t, got, "'user'     => 'swarm',")
+				assert.NotContains(t, got, "s3cret")
+				assert.NotContains(t, got, "A1B2C3D4")
+				assert.Contains(t, got, `"token"          => "****",`)
+				assert.Contains(t, got, `'signing_secret' => "****",`)
+				assert.Contains(t, got, "'bot_name'       => 'swarm',")
+			} else {
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseContentInvalidRegex(t *testing.T) {
+	_, err := parseContent(filepath.Join("testfiles", "has.env"), schema.FileConfig{ParseAll: true, Redactions: []string{"("}})
+	assert.Error(t, err)
+}
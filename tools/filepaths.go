@@ -0,0 +1,157 @@
+package tools
+
+import (
+	"command-runner/schema"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// resolveFilePaths returns the files to parse for a files entry. When a glob or directory matches nothing, a
+// skipped entry is added to the collector instead.
+func resolveFilePaths(pathToFile string, fileConfig schema.FileConfig, collector *Collector, instanceArg string) []string {
+	start := time.Now()
+	paths, err := expandPathToFile(pathToFile, fileConfig)
+	if err == nil && len(paths) > 0 {
+		return paths
+	}
+
+	jsonData := newResult(SourceFile, instanceArg, start)
+	jsonData.Command = "Failed to parse: " + pathToFile
+	jsonData.Description = fmt.Sprintf("File: %v", pathToFile)
+	jsonData.MonitorTag = fileConfig.MonitorTag
+	if err != nil {
+		logrus.Errorf("error expanding %s: %v", pathToFile, err)
+		jsonData.setError(err)
+	} else {
+		logrus.Warnf("no files matched %s", pathToFile)
+		jsonData.Status = StatusSkipped
+		jsonData.Error = fmt.Sprintf("No files matched %s", pathToFile)
+	}
+	collector.Add(jsonData)
+	return nil
+}
+
+// expandPathToFile returns the files pathToFile refers to. A literal file path is returned as is, even if it
+// does not exist, so that the parser reports it missing. A glob or a directory is expanded into the regular
+// files it contains (searching max_depth levels of subdirectories), filtered by include and exclude, sorted
+// and capped at max_files.
+func expandPathToFile(pathToFile string, fileConfig schema.FileConfig) ([]string, error) {
+	var roots []string
+	if hasGlobMeta(pathToFile) {
+		matches, err := filepath.Glob(pathToFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %w", pathToFile, err)
+		}
+		roots = matches
+	} else {
+		fi, err := os.Stat(pathToFile)
+		if err != nil || !fi.IsDir() {
+			return []string{pathToFile}, nil
+		}
+		roots = []string{pathToFile}
+	}
+
+	seen := map[string]bool{}
+	var files []string
+	for _, root := range roots {
+		found, err := filesUnder(root, fileConfig.MaxDepth)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range found {
+			if !seen[file] && matchesFileFilters(filepath.Base(file), fileConfig.Include, fileConfig.Exclude) {
+				seen[file] = true
+				files = append(files, file)
+			}
+		}
+	}
+	sort.Strings(files)
+
+	maxFiles := fileConfig.MaxFiles
+	if maxFiles <= 0 {
+		maxFiles = schema.DefaultMaxFiles
+	}
+	if len(files) > maxFiles {
+		logrus.Warnf("%d files match %s, only collecting the first %d (max_files)", len(files), pathToFile, maxFiles)
+		files = files[:maxFiles]
+	}
+	return files, nil
+}
+
+// filesUnder returns root if it is a regular file, or the regular files in the directory root and in its
+// subdirectories down to maxDepth levels. Symbolic links to regular files are included; symbolic links to
+// directories are not followed.
+func filesUnder(root string, maxDepth int) ([]string, error) {
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		if fi.Mode().IsRegular() {
+			return []string{root}, nil
+		}
+		return nil, nil
+	}
+
+	var files []string
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			logrus.Warnf("error reading %s: %v", path, err)
+			return nil
+		}
+		if d.IsDir() {
+			if path != root && dirDepth(root, path) > maxDepth {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() {
+			files = append(files, path)
+		} else if d.Type()&fs.ModeSymlink != 0 {
+			if target, err := os.Stat(path); err == nil && target.Mode().IsRegular() {
+				files = append(files, path)
+			}
+		}
+		return nil
+	})
+	return files, err
+}
+
+// dirDepth is how many levels below root the directory path is, 1 for a direct subdirectory
+func dirDepth(root, path string) int {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return 0
+	}
+	return strings.Count(rel, string(filepath.Separator)) + 1
+}
+
+// matchesFileFilters reports whether a file's base name matches one of the include patterns (or there are
+// none) and none of the exclude patterns
+func matchesFileFilters(name string, include, exclude []string) bool {
+	for _, pattern := range exclude {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return false
+		}
+	}
+	if len(include) == 0 {
+		return true
+	}
+	for _, pattern := range include {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func hasGlobMeta(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
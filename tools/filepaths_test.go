@@ -0,0 +1,75 @@
+package tools
+
+import (
+	"command-runner/schema"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandPathToFile(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.csv", "b.csv", "c.log", "sub/d.csv", "sub/deeper/e.csv"} {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0700)
+		os.WriteFile(path, []byte("x\n"), 0600)
+	}
+	rel := func(paths []string) []string {
+		var out []string
+		for _, p := range paths {
+			r, _ := filepath.Rel(dir, p)
+			out = append(out, filepath.ToSlash(r))
+		}
+		return out
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		config schema.FileConfig
+		want   []string
+	}{
+		{"literal file", filepath.Join(dir, "a.csv"), schema.FileConfig{}, []string{"a.csv"}},
+		{"missing literal file kept", filepath.Join(dir, "missing"), schema.FileConfig{}, []string{"missing"}},
+		{"glob", filepath.Join(dir, "*.csv"), schema.FileConfig{}, []string{"a.csv", "b.csv"}},
+		{"directory top level only", dir, schema.FileConfig{}, []string{"a.csv", "b.csv", "c.log"}},
+		{"directory with depth", dir, schema.FileConfig{MaxDepth: 1}, []string{"a.csv", "b.csv", "c.log", "sub/d.csv"}},
+		{"include and exclude", dir, schema.FileConfig{MaxDepth: 2, Include: []string{"*.csv"}, Exclude: []string{"b.*"}}, []string{"a.csv", "sub/d.csv", "sub/deeper/e.csv"}},
+		{"max files", filepath.Join(dir, "*"), schema.FileConfig{MaxFiles: 2}, []string{"a.csv", "b.csv"}},
+		{"no match", filepath.Join(dir, "*.txt"), schema.FileConfig{}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandPathToFile(tt.path, tt.config)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, rel(got))
+		})
+	}
+
+	// Created after the cases above so they do not see them
+	t.Run("symlinks to regular files", func(t *testing.T) {
+		links := filepath.Join(dir, "links")
+		os.Mkdir(links, 0700)
+		if err := os.Symlink(filepath.Join(dir, "a.csv"), filepath.Join(links, "file.csv")); err != nil {
+			t.Skipf("symlinks not supported: %v", err)
+		}
+		os.Symlink(filepath.Join(dir, "sub"), filepath.Join(links, "dir"))
+		os.Symlink(filepath.Join(dir, "missing"), filepath.Join(links, "dangling.csv"))
+
+		got, err := expandPathToFile(links, schema.FileConfig{MaxDepth: 1})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"links/file.csv"}, rel(got), "links to directories are not followed")
+	})
+}
+
+func TestResolveFilePathsRecordsNoMatch(t *testing.T) {
+	collector := NewCollector()
+	paths := resolveFilePaths(filepath.Join(t.TempDir(), "*.log"), schema.FileConfig{MonitorTag: "logs"}, collector, "1")
+	assert.Empty(t, paths)
+	results := collector.Results()
+	assert.Len(t, results, 1)
+	assert.Equal(t, StatusSkipped, results[0].Status)
+	assert.Equal(t, "1", results[0].Instance)
+}
@@ -0,0 +1,241 @@
+package tools
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// binarySniffBytes is how much of a file is checked for NUL bytes to tell binary files from text
+	binarySniffBytes = 8000
+	// maxLineBytes is the longest line kept; the rest of a longer line is dropped
+	maxLineBytes = 64 * 1024
+	// truncationMarker ends the output of a file that was cut short by max_bytes or max_lines
+	truncationMarker = "[command-runner: output truncated, %s reached]"
+)
+
+// errBinaryFile is returned for files whose content looks binary, which is never sent
+var errBinaryFile = errors.New("binary file")
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// fileReader is a file being read, possibly through a decompressor
+type fileReader struct {
+	*bufio.Reader
+	closers []func() error
+}
+
+func (r *fileReader) Close() error {
+	var firstErr error
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		if err := r.closers[i](); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// openFileReader opens filePath for reading line by line. gzip, bzip2 and zstd files are decompressed
+// transparently; they are recognised by their magic bytes, or else by a .gz, .bz2 or .zst extension.
+// errBinaryFile is returned if the (decompressed) content is binary.
+func openFileReader(filePath string) (*fileReader, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err // Keep the original error so a missing file is reported as such
+	}
+	r := &fileReader{Reader: bufio.NewReader(f), closers: []func() error{f.Close}}
+
+	header, _ := r.Peek(len(zstdMagic))
+	var decompressed io.Reader
+	switch compression := compressionOf(filePath, header); compression {
+	case "gzip":
+		gz, err := gzip.NewReader(r.Reader)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("error reading gzip file %s: %w", filePath, err)
+		}
+		decompressed = gz
+		r.closers = append(r.closers, gz.Close)
+	case "bzip2":
+		decompressed = bzip2.NewReader(r.Reader)
+	case "zstd":
+		zr, err := zstd.NewReader(r.Reader)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("error reading zstd file %s: %w", filePath, err)
+		}
+		decompressed = zr
+		r.closers = append(r.closers, func() error { zr.Close(); return nil })
+	}
+	if decompressed != nil {
+		r.Reader = bufio.NewReader(decompressed)
+	}
+
+	if err := checkText(r.Reader); err != nil {
+		r.Close()
+		return nil, fmt.Errorf("%s: %w", filePath, err)
+	}
+	return r, nil
+}
+
+// compressionOf returns the compression of a file from its first bytes, or from its extension if they are
+// not recognised, or "" for an uncompressed file
+func compressionOf(filePath string, header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return "gzip"
+	case bytes.HasPrefix(header, bzip2Magic):
+		return "bzip2"
+	case bytes.HasPrefix(header, zstdMagic):
+		return "zstd"
+	}
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".gz":
+		return "gzip"
+	case ".bz2":
+		return "bzip2"
+	case ".zst":
+		return "zstd"
+	}
+	return ""
+}
+
+// checkText returns errBinaryFile if the start of r contains a NUL byte, as git does to spot binary files.
+// Errors reading are left for the caller to find.
+func checkText(r *bufio.Reader) error {
+	head, err := r.Peek(binarySniffBytes)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return err
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		return errBinaryFile
+	}
+	return nil
+}
+
+// readLine returns the next line of r without its newline, and whether it had one. Lines longer than
+// maxLineBytes are cut. io.EOF is returned once there are no more lines.
+func readLine(r *bufio.Reader) (string, bool, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		newline := err == nil
+		if newline {
+			chunk = chunk[:len(chunk)-1]
+		}
+		if room := maxLineBytes - len(line); room > 0 {
+			if len(chunk) > room {
+				chunk = chunk[:room]
+			}
+			line = append(line, chunk...)
+		}
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err == io.EOF && len(line) > 0:
+			return string(line), false, nil
+		case err != nil:
+			return "", false, err
+		}
+		return string(line), true, nil
+	}
+}
+
+// scanLines calls fn with every line of r until fn returns false, and reports whether the last line
+// read ended with a newline
+func scanLines(r *bufio.Reader, fn func(line string) bool) (bool, error) {
+	endsWithNewline := false
+	for {
+		line, newline, err := readLine(r)
+		if err == io.EOF {
+			return endsWithNewline, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		endsWithNewline = newline
+		if !fn(line) {
+			return false, nil
+		}
+	}
+}
+
+// limitedOutput collects the lines parsed from a file, up to maxBytes bytes and maxLines lines
+// (no limit if 0). Once a limit is reached no more lines are taken and a truncation marker is added.
+type limitedOutput struct {
+	b         strings.Builder
+	lines     int
+	maxBytes  int64
+	maxLines  int
+	truncated string
+	// newlineAtEnd keeps the file's final newline when the whole file is collected
+	newlineAtEnd bool
+}
+
+// add appends line to the output and reports whether more lines may be added
+func (o *limitedOutput) add(line string) bool {
+	if o.truncated != "" {
+		return false
+	}
+	size := int64(o.b.Len() + len(line))
+	if o.lines > 0 {
+		size++ // The newline separating it from the previous line
+	}
+	switch {
+	case o.maxLines > 0 && o.lines >= o.maxLines:
+		o.truncated = fmt.Sprintf("max_lines (%d)", o.maxLines)
+		return false
+	case o.maxBytes > 0 && size > o.maxBytes:
+		o.truncated = fmt.Sprintf("max_bytes (%d)", o.maxBytes)
+		return false
+	}
+	if o.lines > 0 {
+		o.b.WriteByte('\n')
+	}
+	o.b.WriteString(line)
+	o.lines++
+	return true
+}
+
+// String returns the lines joined by newlines, followed by the truncation marker if a limit was reached
+func (o *limitedOutput) String() string {
+	switch {
+	case o.truncated == "" && o.newlineAtEnd && o.lines > 0:
+		return o.b.String() + "\n"
+	case o.truncated == "":
+		return o.b.String()
+	case o.lines == 0:
+		return fmt.Sprintf(truncationMarker, o.truncated)
+	}
+	return o.b.String() + "\n" + fmt.Sprintf(truncationMarker, o.truncated)
+}
+
+// readAllLimited reads the rest of r, failing if it is longer than maxBytes (no limit if 0)
+func readAllLimited(r io.Reader, maxBytes int64) (string, error) {
+	if maxBytes <= 0 {
+		data, err := io.ReadAll(r)
+		return string(data), err
+	}
+	data, err := io.ReadAll(io.LimitReader(r, maxBytes+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(data)) > maxBytes {
+		return "", fmt.Errorf("larger than max_bytes (%d)", maxBytes)
+	}
+	return string(data), nil
+}
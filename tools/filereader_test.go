@@ -0,0 +1,117 @@
+package tools
+
+import (
+	"command-runner/schema"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseContentCompressedFiles(t *testing.T) {
+	plain, err := os.ReadFile(filepath.Join("testfiles", "p4d.log"))
+	assert.NoError(t, err)
+	gz, err := os.ReadFile(filepath.Join("testfiles", "p4d.log.gz"))
+	assert.NoError(t, err)
+	// A rotated log without a compression extension is recognised by its magic bytes
+	rotated := filepath.Join(t.TempDir(), "log.1")
+	assert.NoError(t, os.WriteFile(rotated, gz, 0600))
+
+	for _, file := range []string{
+		filepath.Join("testfiles", "p4d.log"),
+		filepath.Join("testfiles", "p4d.log.gz"),
+		filepath.Join("testfiles", "p4d.log.bz2"),
+		filepath.Join("testfiles", "p4d.log.zst"),
+		rotated,
+	} {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			got, err := parseContent(file, schema.FileConfig{ParseAll: true})
+			assert.NoError(t, err)
+			assert.Equal(t, string(plain), got)
+
+			got, err = parseContent(file, schema.FileConfig{Keywords: []string{"Operation:", "failed"}})
+			assert.NoError(t, err)
+			assert.Equal(t, "\tOperation: user-sync\n\tLibrarian checkout depot/main/a.c failed.", got)
+		})
+	}
+}
+
+func TestParseContentCorruptCompressedFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "log.gz")
+	assert.NoError(t, os.WriteFile(file, []byte("not gzip\n"), 0600))
+	_, err := parseContent(file, schema.FileConfig{ParseAll: true})
+	assert.Error(t, err)
+}
+
+func TestParseContentBinaryFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "p4d")
+	assert.NoError(t, os.WriteFile(file, []byte("\x7fELF\x02\x01\x01\x00\x00\x00password=abc\n"), 0600))
+
+	_, err := parseContent(file, schema.FileConfig{ParseAll: true})
+	assert.True(t, errors.Is(err, errBinaryFile))
+
+	collector := NewCollector()
+	assert.NoError(t, parseAndAppendAtOsLevel(file, schema.FileConfig{ParseAll: true, MonitorTag: "binary"}, collector))
+	results := collector.Results()
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, StatusSkipped, results[0].Status)
+		assert.Empty(t, results[0].Output)
+		assert.Contains(t, results[0].Error, "is binary")
+	}
+}
+
+func TestParseContentLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		config schema.FileConfig
+		want   string
+	}{
+		{
+			name:   "max_lines",
+			config: schema.FileConfig{ParseAll: true, MaxLines: 2},
+			want:   "Perforce server info:\n\t2024/05/01 10:00:00 pid 101 super@ws 127.0.0.1 [p4/2023.2] 'user-info'\n[command-runner: output truncated, max_lines (2) reached]",
+		},
+		{
+			name:   "max_lines counts matching lines only",
+			config: schema.FileConfig{Keywords: []string{"Perforce server"}, MaxLines: 2},
+			want:   "Perforce server info:\nPerforce server error:\n[command-runner: output truncated, max_lines (2) reached]",
+		},
+		{
+			name:   "max_bytes keeps whole lines",
+			config: schema.FileConfig{Keywords: []string{"Perforce server"}, MaxBytes: 50},
+			want:   "Perforce server info:\nPerforce server error:\n[command-runner: output truncated, max_bytes (50) reached]",
+		},
+		{
+			name:   "no marker when everything fits",
+			config: schema.FileConfig{Keywords: []string{"Perforce server"}, MaxLines: 3},
+			want:   "Perforce server info:\nPerforce server error:\nPerforce server info:",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseContent(filepath.Join("testfiles", "p4d.log.gz"), tt.config)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParseContentLongLinesAreCut(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "long.log")
+	long := strings.Repeat("x", maxLineBytes+100)
+	assert.NoError(t, os.WriteFile(file, []byte("first\n"+long+"\nlast\n"), 0600))
+
+	got, err := parseContent(file, schema.FileConfig{ParseAll: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "first\n"+long[:maxLineBytes]+"\nlast\n", got)
+}
+
+func TestParseContentStructuredMaxBytes(t *testing.T) {
+	_, err := parseContent(filepath.Join("testfiles", "has.env"), schema.FileConfig{Format: schema.FileFormatEnv, MaxBytes: 10})
+	assert.ErrorContains(t, err, "larger than max_bytes")
+}
@@ -8,8 +8,8 @@ import (
 )
 
 // HandleOsCommands handles execution of OS level commands and file parsing
-func HandleOsCommands(cloudProvider, OutputJSONFilePath string) error {
-	err := HandleCloudProviders(cloudProvider, OutputJSONFilePath)
+func HandleOsCommands(cloudProvider string, collector *Collector) error {
+	err := HandleCloudProviders(cloudProvider, collector)
 	if err != nil {
 		// Log the error but continue
 		logrus.Errorf("Error handling cloud provider %s: %v", cloudProvider, err)
@@ -23,22 +23,16 @@ func HandleOsCommands(cloudProvider, OutputJSONFilePath string) error {
 		return fmt.Errorf("failed to read OS commands from YAML: %w", err)
 	}
 
-	base64OScmdsOutputs, err := ExecuteAndEncodeCommands(osCommands, false, "")
+	osResults, err := ExecuteAndEncodeCommands(osCommands, false, "")
 	if err != nil {
 		return fmt.Errorf("failed to execute and encode commands: %w", err)
 	}
+	collector.Add(osResults...)
 
-	osJSONData := createJSONDataForCommands(osCommands, base64OScmdsOutputs)
-	allJSONData := appendExistingJSONData(osJSONData, OutputJSONFilePath)
-
-	if err := WriteJSONToFile(allJSONData, OutputJSONFilePath); err != nil {
-		return fmt.Errorf("failed to write JSON to file: %w", err)
-	}
-
-	if err := FileParserFromYAMLConfigOs(schema.DefaultCmdConfigYAMLPath, OutputJSONFilePath); err != nil { //TODO FIX THIS
+	if err := FileParserFromYAMLConfigOs(schema.DefaultCmdConfigYAMLPath, collector); err != nil { //TODO FIX THIS
 		return fmt.Errorf("failed to parse file from YAML config: %w", err)
 	}
 
-	logrus.Infof("OS commands executed and output appended to %s.", OutputJSONFilePath)
+	logrus.Infof("OS commands executed and %d results collected.", collector.Len())
 	return nil
 }
@@ -6,25 +6,19 @@ import (
 )
 
 // HandleInstanceCommands handles execution of instance commands and file parsing
-func HandleP4Commands(instanceArg, OutputJSONFilePath string) error {
+func HandleP4Commands(instanceArg string, collector *Collector) error {
 	p4Commands, err := ReadP4CommandsFromYAML(schema.DefaultCmdConfigYAMLPath, instanceArg) //TODO fix this
 	if err != nil {
 		return fmt.Errorf("failed to read P4 commands from YAML: %w", err)
 	}
 
-	base64P4Outputs, err := ExecuteAndEncodeCommands(p4Commands, true, instanceArg)
+	p4Results, err := ExecuteAndEncodeCommands(p4Commands, true, instanceArg)
 	if err != nil {
 		return fmt.Errorf("failed to execute and encode P4 commands: %w", err)
 	}
+	collector.Add(p4Results...)
 
-	p4JSONData := createJSONDataForCommands(p4Commands, base64P4Outputs)
-	allJSONData := appendExistingJSONData(p4JSONData, OutputJSONFilePath)
-
-	if err := WriteJSONToFile(allJSONData, OutputJSONFilePath); err != nil {
-		return fmt.Errorf("failed to write JSON to file: %w", err)
-	}
-
-	if err := FileParserFromYAMLConfigP4(schema.DefaultCmdConfigYAMLPath, OutputJSONFilePath, instanceArg); err != nil { //TODO fix this
+	if err := FileParserFromYAMLConfigP4(schema.DefaultCmdConfigYAMLPath, collector, instanceArg); err != nil { //TODO fix this
 		return fmt.Errorf("failed to parse file from YAML config (instance): %w", err)
 	}
 
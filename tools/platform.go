@@ -0,0 +1,137 @@
+package tools
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// platformRoot is where the /sys, /proc and container marker files are read from, replaced in tests
+var platformRoot = "/"
+
+// azureChassisAssetTag is the DMI chassis asset tag of every Azure virtual machine
+const azureChassisAssetTag = "7783-7084-3265-9085-8269-3286-77"
+
+// PlatformFacts describes what the host runs on, from its DMI data, /proc/cpuinfo and container markers
+type PlatformFacts struct {
+	Cloud           string `json:"cloud,omitempty"`          // aws, gcp, azure or oracle
+	Virtualization  string `json:"virtualization,omitempty"` // kvm, xen, vmware, hyper-v, virtualbox, or unknown for another hypervisor
+	Container       string `json:"container,omitempty"`      // docker, podman or kubernetes
+	SysVendor       string `json:"sys_vendor,omitempty"`
+	ProductName     string `json:"product_name,omitempty"`
+	BoardAssetTag   string `json:"board_asset_tag,omitempty"`
+	ChassisAssetTag string `json:"chassis_asset_tag,omitempty"`
+	BIOSVersion     string `json:"bios_version,omitempty"`
+	Hypervisor      bool   `json:"hypervisor"` // The hypervisor CPU flag is set
+}
+
+// DetectPlatform reads the local signals of the cloud, hypervisor and container the host runs on
+func DetectPlatform() PlatformFacts {
+	return detectPlatform(platformRoot)
+}
+
+func detectPlatform(root string) PlatformFacts {
+	dmi := func(name string) string {
+		data, err := os.ReadFile(filepath.Join(root, "sys/class/dmi/id", name))
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(data))
+	}
+	facts := PlatformFacts{
+		SysVendor:       dmi("sys_vendor"),
+		ProductName:     dmi("product_name"),
+		BoardAssetTag:   dmi("board_asset_tag"),
+		ChassisAssetTag: dmi("chassis_asset_tag"),
+		BIOSVersion:     dmi("bios_version"),
+		Hypervisor:      hasHypervisorFlag(filepath.Join(root, "proc/cpuinfo")),
+	}
+
+	vendor, product, bios := strings.ToLower(facts.SysVendor), strings.ToLower(facts.ProductName), strings.ToLower(facts.BIOSVersion)
+	switch {
+	case strings.Contains(vendor, "amazon"):
+		facts.Cloud, facts.Virtualization = "aws", "kvm" // Nitro
+	case strings.Contains(bios, "amazon"):
+		facts.Cloud, facts.Virtualization = "aws", "xen"
+	case strings.Contains(vendor, "google") || strings.Contains(product, "google compute engine"):
+		facts.Cloud, facts.Virtualization = "gcp", "kvm"
+	case facts.ChassisAssetTag == azureChassisAssetTag:
+		facts.Cloud, facts.Virtualization = "azure", "hyper-v"
+	case facts.ChassisAssetTag == "OracleCloud.com":
+		facts.Cloud, facts.Virtualization = "oracle", "kvm"
+	case strings.Contains(vendor, "vmware") || strings.Contains(product, "vmware"):
+		facts.Virtualization = "vmware"
+	case strings.Contains(vendor, "microsoft") && strings.Contains(product, "virtual machine"):
+		facts.Virtualization = "hyper-v"
+	case strings.Contains(product, "virtualbox"):
+		facts.Virtualization = "virtualbox"
+	case strings.Contains(vendor, "qemu") || strings.Contains(product, "kvm") || strings.Contains(product, "openstack"):
+		facts.Virtualization = "kvm"
+	case strings.Contains(vendor, "xen") || strings.Contains(product, "hvm domu"):
+		facts.Virtualization = "xen"
+	case facts.Hypervisor:
+		facts.Virtualization = "unknown"
+	}
+
+	facts.Container = detectContainer(root)
+	return facts
+}
+
+// hasHypervisorFlag reports whether the CPU flags in cpuinfo include hypervisor, as they do in a virtual machine
+func hasHypervisorFlag(cpuinfo string) bool {
+	f, err := os.Open(cpuinfo)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || strings.TrimSpace(name) != "flags" {
+			continue
+		}
+		for _, flag := range strings.Fields(value) {
+			if flag == "hypervisor" {
+				return true
+			}
+		}
+		return false // Every CPU has the same flags
+	}
+	return false
+}
+
+// detectContainer returns the container runtime the host process runs in, if any
+func detectContainer(root string) string {
+	exists := func(path string) bool {
+		_, err := os.Stat(filepath.Join(root, path))
+		return err == nil
+	}
+	cgroup, _ := os.ReadFile(filepath.Join(root, "proc/1/cgroup"))
+	switch {
+	case os.Getenv("KUBERNETES_SERVICE_HOST") != "" || exists("var/run/secrets/kubernetes.io/serviceaccount") ||
+		strings.Contains(string(cgroup), "kubepods"):
+		return "kubernetes"
+	case exists(".dockerenv") || strings.Contains(string(cgroup), "docker"):
+		return "docker"
+	case exists("run/.containerenv"):
+		return "podman"
+	}
+	return ""
+}
+
+// needsProbing reports whether the local signals are not enough to tell whether the host is in a cloud: the DMI
+// data could not be read, or the hypervisor is one that both clouds and private data centres use
+func (f PlatformFacts) needsProbing() bool {
+	if f.Cloud != "" {
+		return false
+	}
+	if f.SysVendor == "" && f.ProductName == "" {
+		return true
+	}
+	switch f.Virtualization {
+	case "kvm", "xen", "unknown":
+		return true
+	}
+	return false
+}
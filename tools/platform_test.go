@@ -0,0 +1,165 @@
+package tools
+
+import (
+	"command-runner/schema"
+	"command-runner/tools/fakemetadata"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setPlatformRoot makes platform detection read root instead of /, without the Kubernetes environment of
+// the host running the tests
+func setPlatformRoot(t *testing.T, root string) {
+	saved := platformRoot
+	platformRoot = root
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	t.Cleanup(func() { platformRoot = saved })
+}
+
+// writeHostFiles creates files, given by path relative to root, with their content
+func writeHostFiles(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	}
+}
+
+const (
+	dmiDir         = "sys/class/dmi/id/"
+	cpuinfoVM      = "processor\t: 0\nflags\t\t: fpu vme de pse tsc msr hypervisor lahf_lm\n"
+	cpuinfoMachine = "processor\t: 0\nflags\t\t: fpu vme de pse tsc msr lahf_lm\n"
+)
+
+func TestDetectPlatform(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  PlatformFacts
+	}{
+		{
+			name:  "aws nitro",
+			files: map[string]string{dmiDir + "sys_vendor": "Amazon EC2\n", dmiDir + "product_name": "m5.large\n", "proc/cpuinfo": cpuinfoVM},
+			want:  PlatformFacts{Cloud: "aws", Virtualization: "kvm", SysVendor: "Amazon EC2", ProductName: "m5.large", Hypervisor: true},
+		},
+		{
+			name:  "aws xen",
+			files: map[string]string{dmiDir + "sys_vendor": "Xen\n", dmiDir + "product_name": "HVM domU\n", dmiDir + "bios_version": "4.11.amazon\n"},
+			want:  PlatformFacts{Cloud: "aws", Virtualization: "xen", SysVendor: "Xen", ProductName: "HVM domU", BIOSVersion: "4.11.amazon"},
+		},
+		{
+			name:  "gcp",
+			files: map[string]string{dmiDir + "sys_vendor": "Google\n", dmiDir + "product_name": "Google Compute Engine\n"},
+			want:  PlatformFacts{Cloud: "gcp", Virtualization: "kvm", SysVendor: "Google", ProductName: "Google Compute Engine"},
+		},
+		{
+			name: "azure",
+			files: map[string]string{dmiDir + "sys_vendor": "Microsoft Corporation\n", dmiDir + "product_name": "Virtual Machine\n",
+				dmiDir + "chassis_asset_tag": azureChassisAssetTag + "\n"},
+			want: PlatformFacts{Cloud: "azure", Virtualization: "hyper-v", SysVendor: "Microsoft Corporation", ProductName: "Virtual Machine",
+				ChassisAssetTag: azureChassisAssetTag},
+		},
+		{
+			name:  "hyper-v",
+			files: map[string]string{dmiDir + "sys_vendor": "Microsoft Corporation\n", dmiDir + "product_name": "Virtual Machine\n"},
+			want:  PlatformFacts{Virtualization: "hyper-v", SysVendor: "Microsoft Corporation", ProductName: "Virtual Machine"},
+		},
+		{
+			name:  "oracle",
+			files: map[string]string{dmiDir + "sys_vendor": "QEMU\n", dmiDir + "product_name": "Standard PC (i440FX + PIIX, 1996)\n", dmiDir + "chassis_asset_tag": "OracleCloud.com\n"},
+			want:  PlatformFacts{Cloud: "oracle", Virtualization: "kvm", SysVendor: "QEMU", ProductName: "Standard PC (i440FX + PIIX, 1996)", ChassisAssetTag: "OracleCloud.com"},
+		},
+		{
+			name:  "vmware",
+			files: map[string]string{dmiDir + "sys_vendor": "VMware, Inc.\n", dmiDir + "product_name": "VMware Virtual Platform\n", "proc/cpuinfo": cpuinfoVM},
+			want:  PlatformFacts{Virtualization: "vmware", SysVendor: "VMware, Inc.", ProductName: "VMware Virtual Platform", Hypervisor: true},
+		},
+		{
+			name:  "kvm",
+			files: map[string]string{dmiDir + "sys_vendor": "QEMU\n", dmiDir + "product_name": "Standard PC (Q35 + ICH9, 2009)\n"},
+			want:  PlatformFacts{Virtualization: "kvm", SysVendor: "QEMU", ProductName: "Standard PC (Q35 + ICH9, 2009)"},
+		},
+		{
+			name:  "unknown hypervisor",
+			files: map[string]string{dmiDir + "sys_vendor": "Nutanix\n", dmiDir + "product_name": "AHV\n", "proc/cpuinfo": cpuinfoVM},
+			want:  PlatformFacts{Virtualization: "unknown", SysVendor: "Nutanix", ProductName: "AHV", Hypervisor: true},
+		},
+		{
+			name:  "bare metal",
+			files: map[string]string{dmiDir + "sys_vendor": "Dell Inc.\n", dmiDir + "product_name": "PowerEdge R650\n", dmiDir + "board_asset_tag": "P4-01\n", "proc/cpuinfo": cpuinfoMachine},
+			want:  PlatformFacts{SysVendor: "Dell Inc.", ProductName: "PowerEdge R650", BoardAssetTag: "P4-01"},
+		},
+		{
+			name:  "docker",
+			files: map[string]string{".dockerenv": "", "proc/cpuinfo": cpuinfoMachine},
+			want:  PlatformFacts{Container: "docker"},
+		},
+		{
+			name:  "podman",
+			files: map[string]string{"run/.containerenv": ""},
+			want:  PlatformFacts{Container: "podman"},
+		},
+		{
+			name:  "kubernetes",
+			files: map[string]string{".dockerenv": "", "proc/1/cgroup": "0::/kubepods/besteffort/pod1234/abcd\n"},
+			want:  PlatformFacts{Container: "kubernetes"},
+		},
+		{
+			name: "nothing readable",
+			want: PlatformFacts{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			setPlatformRoot(t, root)
+			writeHostFiles(t, root, tt.files)
+			got := DetectPlatform()
+			assert.Equal(t, tt.want, got)
+			if got.Cloud != "" {
+				assert.True(t, schema.IsValidCloudProvider(got.Cloud), "--cloud would reject %s", got.Cloud)
+			}
+		})
+	}
+}
+
+func TestDetectPlatformKubernetesEnv(t *testing.T) {
+	setPlatformRoot(t, t.TempDir())
+	t.Setenv("KUBERNETES_SERVICE_HOST", "10.96.0.1")
+	assert.Equal(t, "kubernetes", DetectPlatform().Container)
+}
+
+func TestDetectCloudProviderFromPlatform(t *testing.T) {
+	tests := []struct {
+		name       string
+		files      map[string]string
+		want       string
+		wantProbes bool
+	}{
+		{"aws from dmi", map[string]string{dmiDir + "sys_vendor": "Amazon EC2\n"}, "aws", false},
+		{"oracle from dmi", map[string]string{dmiDir + "chassis_asset_tag": "OracleCloud.com\n"}, "oracle", false},
+		{"vmware is onprem", map[string]string{dmiDir + "sys_vendor": "VMware, Inc.\n", dmiDir + "product_name": "VMware7,1\n"}, "onprem", false},
+		{"bare metal is onprem", map[string]string{dmiDir + "sys_vendor": "Dell Inc.\n", dmiDir + "product_name": "PowerEdge R650\n"}, "onprem", false},
+		{"kvm is probed", map[string]string{dmiDir + "sys_vendor": "QEMU\n", dmiDir + "product_name": "KVM\n"}, "gcp", true},
+		{"no dmi is probed", nil, "gcp", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := fakemetadata.NewGCP(t)
+			setupCloudTest(t, server.URL)
+			root := t.TempDir()
+			setPlatformRoot(t, root)
+			writeHostFiles(t, root, tt.files)
+
+			got, err := DetectCloudProvider()
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantProbes, len(server.Requests()) > 0)
+		})
+	}
+}
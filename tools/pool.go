@@ -0,0 +1,70 @@
+package tools
+
+import (
+	"command-runner/schema"
+	"sync"
+)
+
+var (
+	execSlotsMu sync.Mutex
+	execSlots   chan struct{}
+)
+
+// runParallel calls fn for every index in [0, n) using at most schema.MaxParallel workers.
+// Callers write results into slots of a pre-sized slice by index, which keeps output order deterministic.
+func runParallel(n int, fn func(i int)) {
+	workers := schema.MaxParallel
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > n {
+		workers = n
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// SetExecSlots sets how many child processes may run at once, normally schema.MaxParallel. Call it once
+// the configuration is final; slots acquired before keep their place in the old limit.
+func SetExecSlots(n int) {
+	if n < 1 {
+		n = 1
+	}
+	execSlotsMu.Lock()
+	defer execSlotsMu.Unlock()
+	execSlots = make(chan struct{}, n)
+}
+
+// acquireExecSlot blocks until fewer than the limit set by SetExecSlots (schema.MaxParallel if it was not
+// called) child processes are running. Nested pools (instances running commands) therefore never exceed
+// the configured limit overall. The returned function releases the slot.
+func acquireExecSlot() func() {
+	execSlotsMu.Lock()
+	if execSlots == nil {
+		slots := schema.MaxParallel
+		if slots < 1 {
+			slots = 1
+		}
+		execSlots = make(chan struct{}, slots)
+	}
+	slots := execSlots
+	execSlotsMu.Unlock()
+
+	slots <- struct{}{}
+	return func() { <-slots }
+}
@@ -0,0 +1,116 @@
+package tools
+
+import (
+	"command-runner/schema"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setMaxParallel sets schema.MaxParallel and the exec slots for a test
+func setMaxParallel(t *testing.T, n int) {
+	maxParallel := schema.MaxParallel
+	schema.MaxParallel = n
+	SetExecSlots(n)
+	t.Cleanup(func() {
+		schema.MaxParallel = maxParallel
+		SetExecSlots(maxParallel)
+	})
+}
+
+// concurrency records the most calls running at the same time
+type concurrency struct {
+	running int32
+	max     int32
+}
+
+func (c *concurrency) run(d time.Duration) {
+	running := atomic.AddInt32(&c.running, 1)
+	for {
+		max := atomic.LoadInt32(&c.max)
+		if running <= max || atomic.CompareAndSwapInt32(&c.max, max, running) {
+			break
+		}
+	}
+	time.Sleep(d)
+	atomic.AddInt32(&c.running, -1)
+}
+
+func TestRunParallelKeepsOrder(t *testing.T) {
+	setMaxParallel(t, 4)
+	const n = 12
+	results := make([]int, n)
+	var mu sync.Mutex
+	var finished []int
+
+	// Later indexes finish first
+	runParallel(n, func(i int) {
+		time.Sleep(time.Duration(n-i) * 2 * time.Millisecond)
+		results[i] = i * i
+		mu.Lock()
+		finished = append(finished, i)
+		mu.Unlock()
+	})
+
+	for i, got := range results {
+		assert.Equal(t, i*i, got)
+	}
+	assert.Len(t, finished, n)
+	assert.NotEqual(t, 0, finished[0], "the jobs ran concurrently")
+}
+
+func TestRunParallelBoundedByMaxParallel(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxParallel int
+		jobs        int
+		want        int32
+	}{
+		{"one at a time", 1, 6, 1},
+		{"bounded", 3, 9, 3},
+		{"fewer jobs than workers", 8, 2, 2},
+		{"unset", 0, 4, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setMaxParallel(t, tt.maxParallel)
+			var c concurrency
+			runParallel(tt.jobs, func(int) { c.run(20 * time.Millisecond) })
+			assert.Equal(t, tt.want, c.max)
+		})
+	}
+}
+
+func TestExecSlotsBoundNestedPools(t *testing.T) {
+	setMaxParallel(t, 2)
+	var c concurrency
+
+	// Instances running commands: up to 2 instances each running 2 commands, yet at most 2 processes
+	runParallel(3, func(int) {
+		runParallel(4, func(int) {
+			release := acquireExecSlot()
+			defer release()
+			c.run(10 * time.Millisecond)
+		})
+	})
+	assert.Equal(t, int32(2), c.max)
+}
+
+func TestSetExecSlotsAfterFirstUse(t *testing.T) {
+	setMaxParallel(t, 1)
+	acquireExecSlot()()
+
+	// The configuration raised the limit after a command already ran
+	schema.MaxParallel = 3
+	SetExecSlots(3)
+	var c concurrency
+	runParallel(3, func(int) {
+		release := acquireExecSlot()
+		defer release()
+		c.run(20 * time.Millisecond)
+	})
+	assert.Equal(t, int32(3), c.max)
+}
@@ -0,0 +1,16 @@
+//go:build windows
+
+package tools
+
+import "os/exec"
+
+// setProcessGroup is a no-op on Windows
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills the command process; Windows has no process groups to signal
+func killProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return cmd.Process.Kill()
+}
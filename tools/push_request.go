@@ -0,0 +1,141 @@
+package tools
+
+import (
+	"bytes"
+	"command-runner/schema"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// Receiver contract for pushes to the datapushgateway JSON endpoint.
+//
+// Every request is a POST to the push URL (see pushURL) with the Content-Type of the payload:
+// application/json, or application/x-ndjson for --ndjson output. When metrics_gzip is set the body
+// is gzip compressed and sent with Content-Encoding: gzip; the receiver must decompress it before use.
+//
+// A payload no larger than metrics_chunk_size (or any payload when chunking is off) is sent as a
+// single request whose body is the whole payload.
+//
+// A larger payload is split into byte ranges of at most metrics_chunk_size bytes (measured before
+// compression) and sent as one request per chunk, in order, followed by a manifest request:
+//
+//	X-Command-Runner-Upload-Id     hex SHA-256 of the complete payload, identical on every retry or
+//	                               spool replay so the receiver can discard duplicates
+//	X-Command-Runner-Chunk-Index   0 based chunk number (chunk requests only)
+//	X-Command-Runner-Chunk-Count   total number of chunks
+//	X-Command-Runner-Chunk-Sha256  hex SHA-256 of the uncompressed chunk (chunk requests only)
+//	X-Command-Runner-Manifest      "1" on the final manifest request
+//
+// Chunk bodies are raw byte ranges and are not valid JSON on their own. The manifest body is a
+// chunkManifest JSON object, always sent as application/json; on receiving it the receiver
+// concatenates the chunks by index, checks the total size and SHA-256, and processes the result
+// as if it had arrived in a single request.
+// A chunk that fails is retried on its own; if the upload is abandoned the whole payload is spooled
+// and uploaded again from chunk 0 on a later run.
+const (
+	headerUploadID    = "X-Command-Runner-Upload-Id"
+	headerChunkIndex  = "X-Command-Runner-Chunk-Index"
+	headerChunkCount  = "X-Command-Runner-Chunk-Count"
+	headerChunkSHA256 = "X-Command-Runner-Chunk-Sha256"
+	headerManifest    = "X-Command-Runner-Manifest"
+)
+
+// chunkManifest is the body of the final request of a chunked upload
+type chunkManifest struct {
+	UploadID     string   `json:"upload_id"`
+	Chunks       int      `json:"chunks"`
+	TotalSize    int      `json:"total_size"`
+	SHA256       string   `json:"sha256"`
+	ChunkSHA256s []string `json:"chunk_sha256"`
+}
+
+// pushPart is one request of a push: a section of the payload (or the manifest) and the contract headers
+type pushPart struct {
+	description string
+	body        *io.SectionReader // Uncompressed
+	header      http.Header
+	gzip        bool
+}
+
+// buildPushParts splits the payload into the requests described by the receiver contract. The payload is
+// read once, to compute the checksums of a chunked upload, and again as each request is sent.
+func buildPushParts(config schema.MetricsConfig, payload *io.SectionReader, contentType string) ([]pushPart, error) {
+	size := payload.Size()
+	if config.ChunkSize <= 0 || size <= config.ChunkSize {
+		return []pushPart{newPushPart(config, "payload", payload, contentType, http.Header{})}, nil
+	}
+
+	count := int((size + config.ChunkSize - 1) / config.ChunkSize)
+	manifest := chunkManifest{Chunks: count, TotalSize: int(size)}
+	total := sha256.New()
+	chunks := make([]*io.SectionReader, 0, count)
+	for i := 0; i < count; i++ {
+		start := int64(i) * config.ChunkSize
+		end := start + config.ChunkSize
+		if end > size {
+			end = size
+		}
+		chunk := io.NewSectionReader(payload, start, end-start)
+		chunkSum := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(total, chunkSum), chunk); err != nil {
+			return nil, fmt.Errorf("error reading payload: %w", err)
+		}
+		manifest.ChunkSHA256s = append(manifest.ChunkSHA256s, hex.EncodeToString(chunkSum.Sum(nil)))
+		chunks = append(chunks, chunk)
+	}
+	uploadID := hex.EncodeToString(total.Sum(nil))
+	manifest.UploadID, manifest.SHA256 = uploadID, uploadID
+
+	parts := make([]pushPart, 0, count+1)
+	for i, chunk := range chunks {
+		header := http.Header{}
+		header.Set(headerUploadID, uploadID)
+		header.Set(headerChunkIndex, strconv.Itoa(i))
+		header.Set(headerChunkCount, strconv.Itoa(count))
+		header.Set(headerChunkSHA256, manifest.ChunkSHA256s[i])
+		parts = append(parts, newPushPart(config, fmt.Sprintf("chunk %d of %d", i+1, count), chunk, contentType, header))
+	}
+
+	manifestJSON, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding chunk manifest: %w", err)
+	}
+	header := http.Header{}
+	header.Set(headerUploadID, uploadID)
+	header.Set(headerChunkCount, strconv.Itoa(count))
+	header.Set(headerManifest, "1")
+	body := io.NewSectionReader(bytes.NewReader(manifestJSON), 0, int64(len(manifestJSON)))
+	return append(parts, newPushPart(config, "manifest", body, ContentTypeJSON, header)), nil
+}
+
+func newPushPart(config schema.MetricsConfig, description string, body *io.SectionReader, contentType string, header http.Header) pushPart {
+	header.Set("Content-Type", contentType)
+	if config.Gzip {
+		header.Set("Content-Encoding", "gzip")
+	}
+	return pushPart{description: description, body: body, header: header, gzip: config.Gzip}
+}
+
+// open returns a new reader of the request body, compressed as it is read when gzip is set
+func (p pushPart) open() io.ReadCloser {
+	body := io.NewSectionReader(p.body, 0, p.body.Size())
+	if !p.gzip {
+		return io.NopCloser(body)
+	}
+	r, w := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(w)
+		_, err := io.Copy(zw, body)
+		if closeErr := zw.Close(); err == nil {
+			err = closeErr
+		}
+		w.CloseWithError(err)
+	}()
+	return r
+}
@@ -0,0 +1,155 @@
+package tools
+
+import (
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// redactionMask replaces every secret that is scrubbed or redacted
+const redactionMask = "****"
+
+// Built-in secret detectors. Patterns with capture groups only mask the groups, so the key or header
+// name stays visible; the rest mask the whole match.
+var builtinRedactions = []string{
+	// P4 tickets where tickets appear: host=user:ticket lines of a tickets file, host (user) ticket lines of
+	// p4 tickets, a ticket alone on its line as printed by p4 login -p, and p4 -P. P4PASSWD=ticket is masked
+	// as a password assignment. Other 32 hex digit values, such as the MD5 digests of p4 verify and p4 fstat,
+	// are left alone.
+	`(?m)^[^\s=]+=[^\s:=]+:([0-9A-F]{32})\s*$`,
+	`(?m)^\S+ \([^\s()]+\) ([0-9A-F]{32})\s*$`,
+	`(?m)^\s*([0-9A-F]{32})\s*$`,
+	`(?:^|\s)-P\s*["']?([0-9A-F]{32})\b`,
+	// AWS access key ids and secret access keys
+	`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`,
+	`(?i)aws_secret_access_key["']?\s*[:=]\s*["']?([A-Za-z0-9/+=]{40})`,
+	// PEM private keys, which span lines
+	`(?s)-----BEGIN [A-Z ]*PRIVATE KEY-----(.+?)-----END [A-Z ]*PRIVATE KEY-----`,
+	// JSON Web Tokens
+	`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`,
+	// password=..., "passwd": "...", 'password' => '...' and similar assignments
+	`(?i)[\w.-]*(?:password|passwd|pwd)[\w.-]*["']?\s*(?::|=>|=)\s*["']?([^\s"',;]+)`,
+	// HTTP Authorization headers
+	`(?i)authorization["']?\s*[:=]\s*["']?(?:(?:bearer|basic|token)\s+)?([^\s"',;]+)`,
+}
+
+// Scrubber masks secrets in every result before it is written or pushed
+type Scrubber struct {
+	patterns []*regexp.Regexp
+}
+
+// NewScrubber compiles the user patterns from cmd_config.yaml, preceded by the built-in detectors if builtins is set
+func NewScrubber(patterns []string, builtins bool) (*Scrubber, error) {
+	var all []string
+	if builtins {
+		all = append(all, builtinRedactions...)
+	}
+	all = append(all, patterns...)
+	compiled, err := compilePatterns(all)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redactions: %w", err)
+	}
+	return &Scrubber{patterns: compiled}, nil
+}
+
+// Scrub returns text with every secret masked and the number of secrets masked
+func (s *Scrubber) Scrub(text string) (string, int) {
+	total := 0
+	for _, re := range s.patterns {
+		var n int
+		text, n = maskMatches(text, re)
+		total += n
+	}
+	return text, total
+}
+
+// ScrubResult masks secrets in the command, description, decoded output and stderr, and error of result,
+// adding the number masked to its Redactions count
+func (s *Scrubber) ScrubResult(result JSONData) JSONData {
+	var n int
+	result.Command, n = s.Scrub(result.Command)
+	result.Redactions += n
+	result.Description, n = s.Scrub(result.Description)
+	result.Redactions += n
+	result.Error, n = s.Scrub(result.Error)
+	result.Redactions += n
+	result.Output, n = s.scrubBase64(result.Output)
+	result.Redactions += n
+	result.Stderr, n = s.scrubBase64(result.Stderr)
+	result.Redactions += n
+	return result
+}
+
+func (s *Scrubber) scrubBase64(encoded string) (string, int) {
+	if encoded == "" {
+		return encoded, 0
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return encoded, 0
+	}
+	scrubbed, n := s.Scrub(string(decoded))
+	if n == 0 {
+		return encoded, 0
+	}
+	return EncodeToBase64(scrubbed), n
+}
+
+var (
+	scrubberMu     sync.RWMutex
+	activeScrubber *Scrubber
+)
+
+// SetScrubber sets the scrubber the collectors apply to every result they are given. nil disables scrubbing.
+func SetScrubber(s *Scrubber) {
+	scrubberMu.Lock()
+	defer scrubberMu.Unlock()
+	activeScrubber = s
+}
+
+func scrubResults(results []JSONData) []JSONData {
+	scrubberMu.RLock()
+	s := activeScrubber
+	scrubberMu.RUnlock()
+	if s == nil {
+		return results
+	}
+	scrubbed := make([]JSONData, len(results))
+	for i, result := range results {
+		scrubbed[i] = s.ScrubResult(result)
+	}
+	return scrubbed
+}
+
+// maskMatches replaces what re matches in text with redactionMask and returns the number of secrets masked.
+// A pattern with capture groups masks only what the groups matched, keeping the rest of the match:
+// password=(\S+) turns "password=abc" into "password=****". Without groups the whole match is masked.
+// Values that are already masked are left alone and not counted.
+func maskMatches(text string, re *regexp.Regexp) (string, int) {
+	groups := re.NumSubexp()
+	var b strings.Builder
+	last, count := 0, 0
+	for _, match := range re.FindAllStringSubmatchIndex(text, -1) {
+		for group := 0; group <= groups; group++ {
+			if groups > 0 && group == 0 {
+				continue
+			}
+			start, end := match[2*group], match[2*group+1]
+			// Skip groups that did not take part in the match, or are nested in one already masked
+			if start < last || start == end || text[start:end] == redactionMask {
+				continue
+			}
+			b.WriteString(text[last:start])
+			b.WriteString(redactionMask)
+			last = end
+			count++
+		}
+	}
+	if count == 0 {
+		return text, 0
+	}
+	b.WriteString(text[last:])
+	return b.String(), count
+}
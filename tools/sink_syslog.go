@@ -0,0 +1,22 @@
+//go:build !windows
+
+package tools
+
+import (
+	"log/syslog"
+)
+
+// writeSyslog sends each line to syslog, either the local daemon or network/address when set
+func writeSyslog(network, address, tag string, lines []string) error {
+	writer, err := syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+	for _, line := range lines {
+		if err := writer.Info(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package tools
+
+import "errors"
+
+// writeSyslog is not available on Windows
+func writeSyslog(network, address, tag string, lines []string) error {
+	return errors.New("the syslog sink is not supported on windows")
+}
@@ -0,0 +1,303 @@
+// sinks.go
+package tools
+
+import (
+	"command-runner/helpers"
+	"command-runner/schema"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultWebhookTimeout applies to webhook sinks that do not set a timeout
+const defaultWebhookTimeout = 30 * time.Second
+
+// Content types of the output payload, JSON or NDJSON (--ndjson)
+const (
+	ContentTypeJSON   = "application/json"
+	ContentTypeNDJSON = "application/x-ndjson"
+)
+
+// OutputSink is a destination for the finished output payload. The payload is read from the output file,
+// which may be too large to hold in memory.
+type OutputSink interface {
+	Name() string
+	Send(payload *io.SectionReader) error
+}
+
+// SinkResult is the outcome of sending the payload to one sink
+type SinkResult struct {
+	Name string
+	Err  error
+}
+
+// NewSinks builds the sinks described by configs. With no configs the payload only goes to the
+// datapushgateway, as it always has. contentType is that of the payload, ContentTypeJSON or ContentTypeNDJSON.
+func NewSinks(configs []schema.SinkConfig, metricsConfigFile string, spool *Spool, contentType string) ([]OutputSink, error) {
+	if len(configs) == 0 {
+		configs = []schema.SinkConfig{{Type: schema.SinkDataPushGateway}}
+	}
+	var sinks []OutputSink
+	for _, config := range configs {
+		name := config.Name
+		if name == "" {
+			name = config.Type
+		}
+		switch config.Type {
+		case schema.SinkDataPushGateway:
+			sinks = append(sinks, &DataPushGatewaySink{name: name, MetricsConfigFile: metricsConfigFile, Spool: spool,
+				ContentType: contentType})
+		case schema.SinkFile:
+			sinks = append(sinks, &FileSink{name: name, Path: config.Path, ContentType: contentType})
+		case schema.SinkStdout:
+			sinks = append(sinks, &StdoutSink{name: name})
+		case schema.SinkWebhook:
+			timeout, err := schema.ParseTimeout(config.Timeout)
+			if err != nil {
+				return nil, fmt.Errorf("sink %s: %w", name, err)
+			}
+			if timeout == 0 {
+				timeout = defaultWebhookTimeout
+			}
+			sinks = append(sinks, &WebhookSink{name: name, URL: config.URL, Method: config.Method, Headers: config.Headers,
+				ContentType: contentType, Timeout: timeout})
+		case schema.SinkSyslog:
+			tag := config.Tag
+			if tag == "" {
+				tag = "command-runner"
+			}
+			sinks = append(sinks, &SyslogSink{name: name, Network: config.Network, Address: config.Address, Tag: tag,
+				ContentType: contentType})
+		default:
+			return nil, fmt.Errorf("unknown sink type %q", config.Type)
+		}
+	}
+	return sinks, nil
+}
+
+// SendToSinks sends payload to every sink in turn, each reading it from the start. A failing sink is logged
+// and does not stop the others.
+func SendToSinks(sinks []OutputSink, payload *io.SectionReader) []SinkResult {
+	results := make([]SinkResult, 0, len(sinks))
+	for _, sink := range sinks {
+		err := sink.Send(io.NewSectionReader(payload, 0, payload.Size()))
+		if err != nil {
+			logrus.Errorf("Output sink %s failed: %v", sink.Name(), err)
+		} else {
+			logrus.Infof("Output sink %s succeeded", sink.Name())
+		}
+		results = append(results, SinkResult{Name: sink.Name(), Err: err})
+	}
+	return results
+}
+
+// DataPushGatewaySink pushes to the datapushgateway JSON endpoint, spooling the payload if it is unavailable
+type DataPushGatewaySink struct {
+	name              string
+	MetricsConfigFile string
+	Spool             *Spool
+	ContentType       string
+}
+
+func (s *DataPushGatewaySink) Name() string { return s.name }
+
+func (s *DataPushGatewaySink) Send(payload *io.SectionReader) error {
+	return PushToDataPushGateway(payload, s.ContentType, s.MetricsConfigFile, s.Spool)
+}
+
+// FileSink writes the payload to Path. When Path is a directory (or ends in /) each run is archived as a new
+// timestamped file in it, named .ndjson rather than .json when ContentType is ContentTypeNDJSON.
+type FileSink struct {
+	name        string
+	Path        string
+	ContentType string
+}
+
+func (s *FileSink) Name() string { return s.name }
+
+func (s *FileSink) Send(payload *io.SectionReader) error {
+	path := s.Path
+	if info, err := os.Stat(path); strings.HasSuffix(path, "/") || (err == nil && info.IsDir()) {
+		if err := os.MkdirAll(path, 0700); err != nil {
+			return fmt.Errorf("error creating archive directory %s: %w", path, err)
+		}
+		ext := ".json"
+		if s.ContentType == ContentTypeNDJSON {
+			ext = ".ndjson"
+		}
+		path = filepath.Join(path, fmt.Sprintf("command-runner-%s-%s%s", time.Now().UTC().Format("20060102T150405.000000000Z"), RunID, ext))
+	}
+	if err := helpers.CopyFileAtomic(path, payload, outputFilePerm); err != nil {
+		return fmt.Errorf("error writing %s: %w", path, err)
+	}
+	logrus.Debugf("Wrote output to %s", path)
+	return nil
+}
+
+// StdoutSink writes the payload to standard output
+type StdoutSink struct {
+	name string
+}
+
+func (s *StdoutSink) Name() string { return s.name }
+
+func (s *StdoutSink) Send(payload *io.SectionReader) error {
+	if _, err := io.Copy(os.Stdout, payload); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(os.Stdout)
+	return err
+}
+
+// WebhookSink sends the payload to an arbitrary HTTP endpoint with configurable headers
+type WebhookSink struct {
+	name        string
+	URL         string
+	Method      string
+	Headers     map[string]string
+	ContentType string
+	Timeout     time.Duration
+}
+
+func (s *WebhookSink) Name() string { return s.name }
+
+func (s *WebhookSink) Send(payload *io.SectionReader) error {
+	method := s.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequest(method, s.URL, payload)
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	req.ContentLength = payload.Size()
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(io.NewSectionReader(payload, 0, payload.Size())), nil
+	}
+	if s.ContentType != "" {
+		req.Header.Set("Content-Type", s.ContentType)
+	}
+	for key, value := range s.Headers {
+		req.Header.Set(key, value)
+	}
+	client := &http.Client{Timeout: s.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error making request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &PushError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	return nil
+}
+
+// SyslogSink logs one summary line per result (without the output itself, which is too large for syslog)
+type SyslogSink struct {
+	name        string
+	Network     string
+	Address     string
+	Tag         string
+	ContentType string
+}
+
+func (s *SyslogSink) Name() string { return s.name }
+
+func (s *SyslogSink) Send(payload *io.SectionReader) error {
+	results, err := resultsFromPayload(payload, s.ContentType)
+	if err != nil {
+		return fmt.Errorf("error reading results: %w", err)
+	}
+	var lines []string
+	for _, result := range results {
+		line := fmt.Sprintf("run_id=%s monitor_tag=%q status=%s exit_code=%d duration_ms=%d source=%s", RunID, result.MonitorTag,
+			result.Status, result.ExitCode, result.DurationMs, result.Source)
+		if result.Instance != "" {
+			line += fmt.Sprintf(" instance=%s", result.Instance)
+		}
+		if result.Error != "" {
+			line += fmt.Sprintf(" error=%q", result.Error)
+		}
+		lines = append(lines, line)
+	}
+	return writeSyslog(s.Network, s.Address, s.Tag, lines)
+}
+
+// resultSummary is the part of a result the syslog sink logs
+type resultSummary struct {
+	Command    string `json:"command"`
+	MonitorTag string `json:"monitor_tag"`
+	Error      string `json:"error"`
+	Status     string `json:"status"`
+	ExitCode   int    `json:"exit_code"`
+	DurationMs int64  `json:"duration_ms"`
+	Instance   string `json:"instance"`
+	Source     string `json:"source"`
+}
+
+// resultsFromPayload extracts the results from any of the output formats: an envelope, the legacy flat
+// array, or NDJSON. Results are decoded one at a time, so only their summaries are held in memory.
+func resultsFromPayload(payload io.Reader, contentType string) ([]resultSummary, error) {
+	decoder := json.NewDecoder(payload)
+	var results []resultSummary
+	if contentType == ContentTypeNDJSON {
+		for {
+			var result resultSummary
+			if err := decoder.Decode(&result); err == io.EOF {
+				return results, nil
+			} else if err != nil {
+				return results, err
+			}
+			if result.Command != "" { // Not a result, e.g. the header line
+				results = append(results, result)
+			}
+		}
+	}
+
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	if token == json.Delim('{') {
+		// The envelope: skip to its results
+		for {
+			key, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			if key == json.Delim('}') {
+				return nil, nil
+			}
+			if key == "results" {
+				break
+			}
+			var skipped json.RawMessage
+			if err := decoder.Decode(&skipped); err != nil {
+				return nil, err
+			}
+		}
+		if token, err = decoder.Token(); err != nil || token == nil {
+			return nil, err
+		}
+	}
+	if token != json.Delim('[') {
+		return nil, fmt.Errorf("unexpected %v, expecting an array of results", token)
+	}
+	for decoder.More() {
+		var result resultSummary
+		if err := decoder.Decode(&result); err != nil {
+			return results, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
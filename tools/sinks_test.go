@@ -0,0 +1,134 @@
+package tools
+
+import (
+	"command-runner/schema"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileSink(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "existing"), 0700))
+	tests := []struct {
+		name        string
+		path        string
+		contentType string
+		ext         string
+	}{
+		{"overwrites a file", filepath.Join(dir, "out.json"), ContentTypeJSON, ".json"},
+		{"archives into a new directory", filepath.Join(dir, "archive") + "/", ContentTypeJSON, ".json"},
+		{"archives into an existing directory", filepath.Join(dir, "existing"), ContentTypeJSON, ".json"},
+		{"archives NDJSON", filepath.Join(dir, "ndjson") + "/", ContentTypeNDJSON, ".ndjson"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &FileSink{name: "file", Path: tt.path, ContentType: tt.contentType}
+			assert.NoError(t, sink.Send(sectionOf(`{"run":1}`)))
+			assert.NoError(t, sink.Send(sectionOf(`{"run":2}`)))
+
+			if info, err := os.Stat(tt.path); err == nil && !info.IsDir() {
+				data, _ := os.ReadFile(tt.path)
+				assert.Equal(t, `{"run":2}`, string(data))
+				assert.Equal(t, os.FileMode(outputFilePerm), info.Mode().Perm())
+				return
+			}
+			entries, err := os.ReadDir(tt.path)
+			assert.NoError(t, err)
+			var archived []string
+			for _, entry := range entries {
+				assert.True(t, strings.HasPrefix(entry.Name(), "command-runner-"), entry.Name())
+				assert.True(t, strings.HasSuffix(entry.Name(), RunID+tt.ext), entry.Name())
+				data, _ := os.ReadFile(filepath.Join(tt.path, entry.Name()))
+				archived = append(archived, string(data))
+			}
+			assert.Equal(t, []string{`{"run":1}`, `{"run":2}`}, archived, "each send is archived, oldest first")
+		})
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	var method, contentType, auth, custom, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, contentType = r.Method, r.Header.Get("Content-Type")
+		auth, custom = r.Header.Get("Authorization"), r.Header.Get("X-Custom")
+		data, _ := io.ReadAll(r.Body)
+		body = string(data)
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	sinks, err := NewSinks([]schema.SinkConfig{{
+		Type:    schema.SinkWebhook,
+		URL:     server.URL + "/hook",
+		Method:  http.MethodPut,
+		Headers: map[string]string{"Authorization": "Bearer abc", "X-Custom": "1"},
+	}}, "", nil, ContentTypeNDJSON)
+	assert.NoError(t, err)
+	assert.NoError(t, sinks[0].Send(sectionOf("{}\n{}\n")))
+	assert.Equal(t, http.MethodPut, method)
+	assert.Equal(t, ContentTypeNDJSON, contentType)
+	assert.Equal(t, "Bearer abc", auth)
+	assert.Equal(t, "1", custom)
+	assert.Equal(t, "{}\n{}\n", body)
+
+	sinks, err = NewSinks([]schema.SinkConfig{{Type: schema.SinkWebhook, URL: server.URL + "/fail"}}, "", nil, ContentTypeJSON)
+	assert.NoError(t, err)
+	err = sinks[0].Send(sectionOf("{}"))
+	var pushErr *PushError
+	assert.True(t, errors.As(err, &pushErr))
+	assert.Equal(t, http.StatusForbidden, pushErr.StatusCode)
+	assert.Equal(t, http.MethodPost, method, "POST by default")
+}
+
+func TestWebhookSinkTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	sinks, err := NewSinks([]schema.SinkConfig{{Type: schema.SinkWebhook, URL: server.URL, Timeout: "100ms"}}, "", nil, ContentTypeJSON)
+	assert.NoError(t, err)
+	start := time.Now()
+	assert.Error(t, sinks[0].Send(sectionOf("{}")))
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	_, err = NewSinks([]schema.SinkConfig{{Type: schema.SinkWebhook, URL: server.URL, Timeout: "soon"}}, "", nil, ContentTypeJSON)
+	assert.Error(t, err)
+}
+
+// failingSink always fails
+type failingSink struct{}
+
+func (failingSink) Name() string                         { return "failing" }
+func (failingSink) Send(payload *io.SectionReader) error { return errors.New("unavailable") }
+
+func TestSendToSinksContinuesAfterFailure(t *testing.T) {
+	dir := t.TempDir()
+	first, last := filepath.Join(dir, "first.json"), filepath.Join(dir, "last.json")
+	sinks := []OutputSink{&FileSink{name: "first", Path: first}, failingSink{}, &FileSink{name: "last", Path: last}}
+
+	results := SendToSinks(sinks, sectionOf(`{"results":[]}`))
+	assert.Len(t, results, 3)
+	assert.NoError(t, results[0].Err)
+	assert.EqualError(t, results[1].Err, "unavailable")
+	assert.Equal(t, "failing", results[1].Name)
+	assert.NoError(t, results[2].Err)
+	for _, path := range []string{first, last} {
+		data, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"results":[]}`, string(data), "every sink reads the payload from the start")
+	}
+}
@@ -0,0 +1,169 @@
+// spool.go
+package tools
+
+import (
+	"command-runner/helpers"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	spoolExt         = ".payload"
+	spoolRejectedExt = ".rejected"
+	spoolNDJSONExt   = ".ndjson" // Before spoolExt in the names of NDJSON payloads
+)
+
+// ErrPayloadTooLarge is returned (wrapped) by Save for a payload that does not fit in the spool
+var ErrPayloadTooLarge = errors.New("payload too large to spool")
+
+// Spool is a directory of payloads that could not be pushed. Each run (or the flush subcommand) replays
+// them oldest-first before pushing new data. The directory is kept within MaxBytes and MaxAge by discarding
+// the oldest payloads.
+type Spool struct {
+	Dir      string
+	MaxBytes int64
+	MaxAge   time.Duration
+}
+
+// NewSpool returns a spool in dir, or nil (spooling disabled) when dir is empty
+func NewSpool(dir string, maxBytes int64, maxAge time.Duration) *Spool {
+	if dir == "" {
+		return nil
+	}
+	return &Spool{Dir: dir, MaxBytes: maxBytes, MaxAge: maxAge}
+}
+
+// Save copies payload, of the given content type, to the spool and then enforces the size and age limits.
+// A payload larger than MaxBytes is not spooled, as pruning would discard it straight away.
+func (s *Spool) Save(payload *io.SectionReader, contentType string) error {
+	if s.MaxBytes > 0 && payload.Size() > s.MaxBytes {
+		return fmt.Errorf("%w: %d bytes, the spool holds at most %d bytes (--spool-max-size)", ErrPayloadTooLarge, payload.Size(), s.MaxBytes)
+	}
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return fmt.Errorf("error creating spool directory %s: %w", s.Dir, err)
+	}
+	// Zero padded timestamps sort oldest-first by name
+	name := fmt.Sprintf("%020d-%s", time.Now().UnixNano(), RunID)
+	if contentType == ContentTypeNDJSON {
+		name += spoolNDJSONExt
+	}
+	path := filepath.Join(s.Dir, name+spoolExt)
+	if err := helpers.CopyFileAtomic(path, io.NewSectionReader(payload, 0, payload.Size()), 0600); err != nil {
+		return fmt.Errorf("error spooling payload to %s: %w", path, err)
+	}
+	logrus.Infof("Spooled %d byte payload to %s", payload.Size(), path)
+	return s.Prune()
+}
+
+// Pending returns the spooled payload files, oldest first
+func (s *Spool) Pending() ([]string, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var pending []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), spoolExt) {
+			pending = append(pending, filepath.Join(s.Dir, entry.Name()))
+		}
+	}
+	sort.Strings(pending)
+	return pending, nil
+}
+
+// Prune removes payloads older than MaxAge, then the oldest payloads until the spool fits in MaxBytes
+func (s *Spool) Prune() error {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	type spooled struct {
+		path string
+		size int64
+	}
+	var kept []spooled
+	var total int64
+	for _, entry := range entries {
+		if entry.IsDir() || (!strings.HasSuffix(entry.Name(), spoolExt) && !strings.HasSuffix(entry.Name(), spoolRejectedExt)) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(s.Dir, entry.Name())
+		if s.MaxAge > 0 && time.Since(info.ModTime()) > s.MaxAge {
+			logrus.Warnf("Discarding spooled payload %s older than %s", path, s.MaxAge)
+			os.Remove(path)
+			continue
+		}
+		kept = append(kept, spooled{path: path, size: info.Size()})
+		total += info.Size()
+	}
+
+	for i := 0; s.MaxBytes > 0 && total > s.MaxBytes && i < len(kept); i++ {
+		logrus.Warnf("Discarding spooled payload %s to keep the spool under %d bytes", kept[i].path, s.MaxBytes)
+		os.Remove(kept[i].path)
+		total -= kept[i].size
+	}
+	return nil
+}
+
+// Replay pushes every spooled payload oldest-first, with the content type it was saved with, removing each
+// once it is delivered. It stops at the first retryable failure (the gateway is presumably still unavailable)
+// and returns that error. Payloads rejected outright are renamed to *.rejected so they are not retried.
+func (s *Spool) Replay(push func(payload *io.SectionReader, contentType string) error) error {
+	if err := s.Prune(); err != nil {
+		logrus.Warnf("Error pruning spool %s: %v", s.Dir, err)
+	}
+	pending, err := s.Pending()
+	if err != nil {
+		return fmt.Errorf("error reading spool directory %s: %w", s.Dir, err)
+	}
+	if len(pending) > 0 {
+		logrus.Infof("Replaying %d spooled payloads from %s", len(pending), s.Dir)
+	}
+	for _, path := range pending {
+		contentType := ContentTypeJSON
+		if strings.HasSuffix(path, spoolNDJSONExt+spoolExt) {
+			contentType = ContentTypeNDJSON
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			logrus.Errorf("Error reading spooled payload %s: %v", path, err)
+			continue
+		}
+		info, err := file.Stat()
+		if err == nil {
+			err = push(io.NewSectionReader(file, 0, info.Size()), contentType)
+		}
+		file.Close() // Before the payload is renamed or removed
+		if err != nil {
+			if IsRetryablePushError(err) {
+				return err
+			}
+			logrus.Errorf("Spooled payload %s was rejected, not retrying: %v", path, err)
+			os.Rename(path, strings.TrimSuffix(path, spoolExt)+spoolRejectedExt)
+			continue
+		}
+		logrus.Infof("Delivered spooled payload %s", path)
+		os.Remove(path)
+	}
+	return nil
+}
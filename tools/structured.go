@@ -0,0 +1,421 @@
+package tools
+
+import (
+	"bufio"
+	"command-runner/schema"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// parseStructured parses content in the file's format, keeps only the select key paths (everything if none),
+// drops keys matching sanitizationKeywords and returns the result as a JSON object
+func parseStructured(content string, fileConfig schema.FileConfig) (string, error) {
+	var doc interface{}
+	var err error
+	switch fileConfig.Format {
+	case schema.FileFormatEnv:
+		doc = parseEnv(content)
+	case schema.FileFormatINI:
+		doc = parseINI(content)
+	case schema.FileFormatJSON:
+		err = json.Unmarshal([]byte(content), &doc)
+	case schema.FileFormatYAML:
+		err = yaml.Unmarshal([]byte(content), &doc)
+		doc = normalizeYAML(doc)
+	case schema.FileFormatPHPArray:
+		doc, err = parsePHPArray(content)
+	default:
+		return "", fmt.Errorf("unknown format '%s'", fileConfig.Format)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error parsing %s content: %w", fileConfig.Format, err)
+	}
+
+	if len(fileConfig.Select) > 0 {
+		doc = selectKeyPaths(doc, fileConfig.Select)
+	}
+	doc = dropSanitizedKeys(doc, fileConfig.SanitizationKeywords)
+
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return "", fmt.Errorf("error encoding %s content as JSON: %w", fileConfig.Format, err)
+	}
+	return string(out), nil
+}
+
+// parseEnv reads KEY=value lines as written in .env and SDP vars files. Comments, blank lines and the
+// export keyword are ignored, and quoted values are unquoted.
+func parseEnv(content string) map[string]interface{} {
+	values := map[string]interface{}{}
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		values[strings.TrimSpace(key)] = unquoteValue(strings.TrimSpace(value))
+	}
+	return values
+}
+
+// parseINI reads [section] headers and key = value (or key: value) lines. Keys before the first section are
+// kept at the top level.
+func parseINI(content string) map[string]interface{} {
+	values := map[string]interface{}{}
+	current := values
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			section, ok := values[name].(map[string]interface{})
+			if !ok {
+				section = map[string]interface{}{}
+				values[name] = section
+			}
+			current = section
+			continue
+		}
+		sep := strings.IndexAny(line, "=:")
+		if sep < 0 {
+			current[line] = ""
+			continue
+		}
+		current[strings.TrimSpace(line[:sep])] = unquoteValue(strings.TrimSpace(line[sep+1:]))
+	}
+	return values
+}
+
+// unquoteValue removes matching quotes around value, or a trailing " # comment" from an unquoted value
+func unquoteValue(value string) string {
+	if len(value) >= 2 {
+		switch {
+		case value[0] == '"' && value[len(value)-1] == '"':
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				return unquoted
+			}
+			return value[1 : len(value)-1]
+		case value[0] == '\'' && value[len(value)-1] == '\'':
+			return value[1 : len(value)-1]
+		}
+	}
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return value
+}
+
+// normalizeYAML converts the maps yaml.v3 decodes with non-string keys so the document can be encoded as JSON
+func normalizeYAML(node interface{}) interface{} {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = normalizeYAML(value)
+		}
+		return v
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = normalizeYAML(value)
+		}
+		return m
+	case []interface{}:
+		for i, value := range v {
+			v[i] = normalizeYAML(value)
+		}
+		return v
+	}
+	return node
+}
+
+// selectKeyPaths returns a document holding only the given dot separated key paths of doc, e.g. "p4.port".
+// A path segment may be a file name pattern such as "*" or "*_url" matching several keys.
+func selectKeyPaths(doc interface{}, paths []string) interface{} {
+	selected := map[string]interface{}{}
+	for _, path := range paths {
+		selectInto(doc, strings.Split(path, "."), selected)
+	}
+	return selected
+}
+
+func selectInto(node interface{}, segments []string, out map[string]interface{}) {
+	m, ok := node.(map[string]interface{})
+	if !ok {
+		return
+	}
+	for key, value := range m {
+		if ok, _ := filepath.Match(segments[0], key); !ok {
+			continue
+		}
+		if len(segments) == 1 {
+			out[key] = value
+			continue
+		}
+		child, ok := out[key].(map[string]interface{})
+		if !ok {
+			child = map[string]interface{}{}
+		}
+		selectInto(value, segments[1:], child)
+		if len(child) > 0 {
+			out[key] = child
+		}
+	}
+}
+
+// dropSanitizedKeys removes every key, at any depth, whose name matches one of the patterns: a file name
+// pattern such as "*password*", or a plain word contained in the key. Matching ignores case.
+func dropSanitizedKeys(node interface{}, patterns []string) interface{} {
+	if len(patterns) == 0 {
+		return node
+	}
+	switch v := node.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if keyMatches(key, patterns) {
+				delete(v, key)
+				continue
+			}
+			v[key] = dropSanitizedKeys(value, patterns)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = dropSanitizedKeys(value, patterns)
+		}
+	}
+	return node
+}
+
+func keyMatches(key string, patterns []string) bool {
+	key = strings.ToLower(key)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if hasGlobMeta(pattern) {
+			if ok, _ := filepath.Match(pattern, key); ok {
+				return true
+			}
+		} else if strings.Contains(key, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+var phpReturn = regexp.MustCompile(`\breturn\b`)
+
+// parsePHPArray reads the array returned by a PHP config file such as Swarm's config.php, written with
+// array(...) or [...]. Values that are PHP expressions (constants, concatenation) are kept as their source text.
+func parsePHPArray(content string) (interface{}, error) {
+	loc := phpReturn.FindStringIndex(content)
+	if loc == nil {
+		return nil, fmt.Errorf("no return statement found")
+	}
+	p := &phpParser{src: content, pos: loc[1]}
+	return p.value()
+}
+
+type phpParser struct {
+	src string
+	pos int
+}
+
+func (p *phpParser) errorf(format string, args ...interface{}) error {
+	line := strings.Count(p.src[:p.pos], "\n") + 1
+	return fmt.Errorf("line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+func (p *phpParser) skipSpace() {
+	for p.pos < len(p.src) {
+		rest := p.src[p.pos:]
+		switch {
+		case rest[0] == ' ' || rest[0] == '\t' || rest[0] == '\n' || rest[0] == '\r':
+			p.pos++
+		case strings.HasPrefix(rest, "//") || rest[0] == '#':
+			end := strings.IndexByte(rest, '\n')
+			if end < 0 {
+				end = len(rest)
+			}
+			p.pos += end
+		case strings.HasPrefix(rest, "/*"):
+			end := strings.Index(rest, "*/")
+			if end < 0 {
+				p.pos = len(p.src)
+			} else {
+				p.pos += end + 2
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *phpParser) value() (interface{}, error) {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return nil, p.errorf("unexpected end of file")
+	}
+	rest := p.src[p.pos:]
+	switch {
+	case len(rest) >= 5 && strings.EqualFold(rest[:5], "array") && strings.HasPrefix(strings.TrimLeft(rest[5:], " \t\r\n"), "("):
+		p.pos += 5
+		p.skipSpace()
+		p.pos++
+		return p.array(')')
+	case rest[0] == '[':
+		p.pos++
+		return p.array(']')
+	case rest[0] == '\'' || rest[0] == '"':
+		start := p.pos
+		s, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		// A string followed by more of an expression, e.g. 'a' . 'b', is kept as source text
+		p.skipSpace()
+		if p.pos < len(p.src) && !strings.ContainsRune(",)];", rune(p.src[p.pos])) && !strings.HasPrefix(p.src[p.pos:], "=>") {
+			p.pos = start
+			return p.expression(), nil
+		}
+		return s, nil
+	}
+	return scalarFromPHP(p.expression()), nil
+}
+
+func (p *phpParser) array(closing byte) (interface{}, error) {
+	var keys []string
+	var values []interface{}
+	list := true
+	for next := 0; ; {
+		p.skipSpace()
+		if p.pos >= len(p.src) {
+			return nil, p.errorf("unterminated array")
+		}
+		if p.src[p.pos] == closing {
+			p.pos++
+			break
+		}
+		first, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if strings.HasPrefix(p.src[p.pos:], "=>") {
+			p.pos += 2
+			value, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, fmt.Sprint(first))
+			values = append(values, value)
+			list = false
+		} else {
+			keys = append(keys, strconv.Itoa(next))
+			values = append(values, first)
+			next++
+		}
+		p.skipSpace()
+		if p.pos < len(p.src) && p.src[p.pos] == ',' {
+			p.pos++
+		} else if p.pos >= len(p.src) || p.src[p.pos] != closing {
+			return nil, p.errorf("expected ',' or '%c'", closing)
+		}
+	}
+	if list {
+		return append([]interface{}{}, values...), nil
+	}
+	m := make(map[string]interface{}, len(keys))
+	for i, key := range keys {
+		m[key] = values[i]
+	}
+	return m, nil
+}
+
+// str reads a single or double quoted PHP string
+func (p *phpParser) str() (string, error) {
+	quote := p.src[p.pos]
+	p.pos++
+	var b strings.Builder
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		p.pos++
+		switch {
+		case c == quote:
+			return b.String(), nil
+		case c == '\\' && p.pos < len(p.src):
+			next := p.src[p.pos]
+			p.pos++
+			switch {
+			case next == quote || next == '\\':
+				b.WriteByte(next)
+			case quote == '"' && next == 'n':
+				b.WriteByte('\n')
+			case quote == '"' && next == 't':
+				b.WriteByte('\t')
+			case quote == '"' && next == '$':
+				b.WriteByte('$')
+			default:
+				b.WriteByte('\\')
+				b.WriteByte(next)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+// expression returns the source text up to the next ',', '=>' or closing bracket outside of nested
+// brackets and strings
+func (p *phpParser) expression() string {
+	start, depth := p.pos, 0
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case c == '\'' || c == '"':
+			if _, err := p.str(); err != nil {
+				return strings.TrimSpace(p.src[start:])
+			}
+			continue
+		case c == '(' || c == '[':
+			depth++
+		case (c == ')' || c == ']') && depth > 0:
+			depth--
+		case depth == 0 && (c == ',' || c == ')' || c == ']' || c == ';' || strings.HasPrefix(p.src[p.pos:], "=>")):
+			return strings.TrimSpace(p.src[start:p.pos])
+		}
+		p.pos++
+	}
+	return strings.TrimSpace(p.src[start:])
+}
+
+// scalarFromPHP converts PHP literals to their JSON equivalent, leaving anything else as text
+func scalarFromPHP(text string) interface{} {
+	switch strings.ToLower(text) {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "null":
+		return nil
+	}
+	if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return i
+	}
+	if f, err := strconv.ParseFloat(text, 64); err == nil {
+		return f
+	}
+	return text
+}
@@ -0,0 +1,73 @@
+package tools
+
+import (
+	"command-runner/schema"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseStructuredSampleConfigs(t *testing.T) {
+	tests := []struct {
+		name   string
+		file   string
+		config schema.FileConfig
+		want   string
+	}{
+		{
+			name: "swarm config.php select and drop password keys",
+			file: "swarm_config.php",
+			config: schema.FileConfig{
+				Format:               schema.FileFormatPHPArray,
+				Select:               []string{"p4", "jira.*", "environment.hostname"},
+				SanitizationKeywords: []string{"*password*"},
+			},
+			want: `{"environment":{"hostname":"swarm.example.com"},"jira":{"host":"https://jira.example.com","user":"jira-bot"},"p4":{"port":"ssl:perforce.example.com:1666","user":"swarm"}}`,
+		},
+		{
+			name: "HAS .env",
+			file: "has.env",
+			config: schema.FileConfig{
+				Format:               schema.FileFormatEnv,
+				Select:               []string{"OIDC_*", "SESSION_SECRET", "NODE_ENV"},
+				SanitizationKeywords: []string{"secret"},
+			},
+			want: `{"NODE_ENV":"production","OIDC_CLIENT_ID":"helix-auth","OIDC_ISSUER_URI":"https://idp.example.com/"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.PathToFile = filepath.Join("testfiles", tt.file)
+			got, err := parseContent(tt.config.PathToFile, tt.config)
+			assert.NoError(t, err)
+			assert.JSONEq(t, tt.want, got)
+		})
+	}
+}
+
+func TestParseStructuredFormats(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		content string
+		want    string
+	}{
+		{"env quoting and export", schema.FileFormatEnv, "# comment\nexport A=\"x y\"\nB='z' \nC=plain # note\n", `{"A":"x y","B":"z","C":"plain"}`},
+		{"ini sections", schema.FileFormatINI, "top=1\n[server]\nport = 1666\n; comment\nname: \"main\"\n", `{"top":"1","server":{"port":"1666","name":"main"}}`},
+		{"json", schema.FileFormatJSON, `{"a":{"b":[1,2]}}`, `{"a":{"b":[1,2]}}`},
+		{"yaml", schema.FileFormatYAML, "a:\n  b: true\n  1: one\n", `{"a":{"b":true,"1":"one"}}`},
+		{"php short arrays and expressions", schema.FileFormatPHPArray, "<?php\n// comment\nreturn [\n  'list' => ['a', \"b\\n\"],\n  'path' => __DIR__ . '/data', /* note */\n  'n' => 5, 'on' => true,\n];\n",
+			`{"list":["a","b\n"],"path":"__DIR__ . '/data'","n":5,"on":true}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseStructured(tt.content, schema.FileConfig{Format: tt.format})
+			assert.NoError(t, err)
+			assert.JSONEq(t, tt.want, got)
+		})
+	}
+
+	_, err := parseStructured("<?php return array('a' => 'b'", schema.FileConfig{Format: schema.FileFormatPHPArray})
+	assert.Error(t, err)
+}
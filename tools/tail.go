@@ -0,0 +1,181 @@
+package tools
+
+import (
+	"bytes"
+	"command-runner/helpers"
+	"command-runner/schema"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// tailStateFile holds the offsets of every file parsed in tail mode, in the state directory
+const tailStateFile = "tail_offsets.json"
+
+// tailOffset is how far a file was read by the last run
+type tailOffset struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+// tailState is the persisted tail offsets, keyed by entry (see tailKey)
+type tailState struct {
+	mu      sync.Mutex
+	path    string
+	offsets map[string]tailOffset
+	changed bool // Offsets were read this run and are not saved yet
+}
+
+var (
+	tailStatesMu sync.Mutex
+	tailStates   = map[string]*tailState{}
+)
+
+// openTailState loads the offsets saved in dir, once per run
+func openTailState(dir string) (*tailState, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("tail mode needs a state directory (--state-dir)")
+	}
+	tailStatesMu.Lock()
+	defer tailStatesMu.Unlock()
+	if state, ok := tailStates[dir]; ok {
+		return state, nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating state directory: %w", err)
+	}
+	state := &tailState{path: filepath.Join(dir, tailStateFile), offsets: map[string]tailOffset{}}
+	data, err := os.ReadFile(state.path)
+	if err == nil {
+		if err := json.Unmarshal(data, &state.offsets); err != nil {
+			logrus.Warnf("Ignoring corrupt tail state %s, files will be read from the start: %v", state.path, err)
+			state.offsets = map[string]tailOffset{}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading tail state: %w", err)
+	}
+	tailStates[dir] = state
+	return state, nil
+}
+
+// SaveTailOffsets saves the offsets of the files read in tail mode this run. Call it once the output was
+// delivered (or spooled), so the lines are read again by the next run if it was lost.
+func SaveTailOffsets() error {
+	tailStatesMu.Lock()
+	defer tailStatesMu.Unlock()
+	for _, state := range tailStates {
+		state.mu.Lock()
+		err := state.save()
+		state.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("error saving tail state: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *tailState) save() error {
+	if !s.changed {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.offsets, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := helpers.WriteFileAtomic(s.path, data, 0600); err != nil {
+		return err
+	}
+	s.changed = false
+	return nil
+}
+
+// tailKey identifies the offset of a files entry, so entries with different monitor tags tailing the same
+// file each read every new line. Offsets of entries without a monitor tag, and those saved by versions
+// that only keyed them by path, are keyed by the path alone.
+func tailKey(monitorTag, filePath string) string {
+	if monitorTag == "" {
+		return filePath
+	}
+	return monitorTag + ":" + filePath
+}
+
+// readTail returns the complete lines appended to filePath since the files entry with monitorTag last read
+// it and records the new offset, which SaveTailOffsets saves.
+// The file is read from the start when it is new, was rotated (its inode changed) or was truncated.
+// When more than maxBytes is waiting, only the newest maxBytes are read and the older lines are skipped.
+// A partial last line is left for the next run, unless it alone fills maxBytes.
+func readTail(filePath, monitorTag string, maxBytes int64) (string, error) {
+	state, err := openTailState(schema.StateDir)
+	if err != nil {
+		return "", err
+	}
+	if maxBytes <= 0 {
+		maxBytes = schema.DefaultTailMaxBytes
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err // Keep the original error so a missing file is reported as such
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	inode, size := fileInode(fi), fi.Size()
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	key := tailKey(monitorTag, filePath)
+	prev, ok := state.offsets[key]
+	if !ok {
+		prev, ok = state.offsets[filePath] // Saved before offsets were kept per entry
+	}
+	start := int64(0)
+	if ok {
+		switch {
+		case prev.Inode != inode:
+			logrus.Infof("%s was rotated, reading it from the start", filePath)
+		case size < prev.Offset:
+			logrus.Infof("%s was truncated, reading it from the start", filePath)
+		default:
+			start = prev.Offset
+		}
+	}
+	skipped := false
+	if size-start > maxBytes {
+		logrus.Warnf("%d new bytes in %s, more than max_bytes: skipping the oldest %d", size-start, filePath, size-start-maxBytes)
+		start, skipped = size-maxBytes, true
+	}
+
+	buf := make([]byte, size-start)
+	n, err := f.ReadAt(buf, start)
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("error reading %s: %w", filePath, err)
+	}
+	buf = buf[:n]
+
+	if skipped {
+		// Drop the partial line the skip landed in
+		if i := bytes.IndexByte(buf, '\n'); i >= 0 {
+			buf = buf[i+1:]
+			start += int64(i + 1)
+		}
+	}
+	end := bytes.LastIndexByte(buf, '\n') + 1
+	if end == 0 && int64(len(buf)) >= maxBytes {
+		end = len(buf)
+	}
+
+	state.offsets[key] = tailOffset{Inode: inode, Offset: start + int64(end)}
+	state.changed = true
+	logrus.Debugf("Read %d new bytes from %s", end, filePath)
+	return string(buf[:end]), nil
+}
@@ -0,0 +1,141 @@
+package tools
+
+import (
+	"command-runner/schema"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setupTailTest(t *testing.T) (logPath string) {
+	stateDir := schema.StateDir
+	schema.StateDir = t.TempDir()
+	t.Cleanup(func() {
+		tailStatesMu.Lock()
+		delete(tailStates, schema.StateDir)
+		tailStatesMu.Unlock()
+		schema.StateDir = stateDir
+	})
+	return filepath.Join(t.TempDir(), "log")
+}
+
+func appendFile(t *testing.T, path, data string) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	assert.NoError(t, err)
+	f.WriteString(data)
+	f.Close()
+}
+
+func TestReadTailOnlyReturnsNewCompleteLines(t *testing.T) {
+	logPath := setupTailTest(t)
+
+	appendFile(t, logPath, "one\ntwo\nthr")
+	got, err := readTail(logPath, "", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "one\ntwo\n", got)
+
+	got, _ = readTail(logPath, "", 0)
+	assert.Equal(t, "", got, "the partial line waits until it is complete")
+
+	appendFile(t, logPath, "ee\nfour\n")
+	got, _ = readTail(logPath, "", 0)
+	assert.Equal(t, "three\nfour\n", got)
+}
+
+func TestReadTailOffsetsSavedOnlyWhenDelivered(t *testing.T) {
+	logPath := setupTailTest(t)
+	newRun := func() {
+		tailStatesMu.Lock()
+		delete(tailStates, schema.StateDir)
+		tailStatesMu.Unlock()
+	}
+
+	appendFile(t, logPath, "one\ntwo\n")
+	got, _ := readTail(logPath, "", 0)
+	assert.Equal(t, "one\ntwo\n", got)
+
+	// The output was not delivered: the next run reads the same lines again
+	newRun()
+	got, _ = readTail(logPath, "", 0)
+	assert.Equal(t, "one\ntwo\n", got)
+
+	assert.NoError(t, SaveTailOffsets())
+	newRun()
+	got, _ = readTail(logPath, "", 0)
+	assert.Equal(t, "", got)
+}
+
+func TestReadTailRotationAndTruncation(t *testing.T) {
+	logPath := setupTailTest(t)
+
+	appendFile(t, logPath, "old line one\nold line two\n")
+	readTail(logPath, "", 0)
+
+	// Truncated in place
+	os.WriteFile(logPath, []byte("new\n"), 0600)
+	got, _ := readTail(logPath, "", 0)
+	assert.Equal(t, "new\n", got)
+
+	// Rotated: renamed away and recreated, so the inode changes even though the new file is larger
+	os.Rename(logPath, logPath+".1")
+	appendFile(t, logPath, "rotated one\nrotated two\n")
+	got, _ = readTail(logPath, "", 0)
+	assert.Equal(t, "rotated one\nrotated two\n", got)
+}
+
+func TestReadTailMaxBytesKeepsNewestLines(t *testing.T) {
+	logPath := setupTailTest(t)
+
+	appendFile(t, logPath, "aaaa\nbbbb\ncccc\n")
+	got, _ := readTail(logPath, "", 8)
+	assert.Equal(t, "cccc\n", got)
+
+	appendFile(t, logPath, "dd\n")
+	got, _ = readTail(logPath, "", 8)
+	assert.Equal(t, "dd\n", got)
+}
+
+func TestParseContentTailModeWithKeywords(t *testing.T) {
+	logPath := setupTailTest(t)
+	config := schema.FileConfig{Mode: schema.FileModeTail, Keywords: []string{"error"}}
+
+	appendFile(t, logPath, "info started\nerror one\n")
+	got, err := parseContent(logPath, config)
+	assert.NoError(t, err)
+	assert.Equal(t, "error one", got)
+
+	appendFile(t, logPath, "error two\ninfo done\n")
+	got, _ = parseContent(logPath, config)
+	assert.Equal(t, "error two", got)
+}
+
+func TestParseContentTailModeEntriesOnOneFile(t *testing.T) {
+	logPath := setupTailTest(t)
+	errorEntry := schema.FileConfig{Mode: schema.FileModeTail, Keywords: []string{"error"}, MonitorTag: "log errors"}
+	warningEntry := schema.FileConfig{Mode: schema.FileModeTail, Keywords: []string{"warning"}, MonitorTag: "log warnings"}
+
+	appendFile(t, logPath, "error one\nwarning one\n")
+	got, _ := parseContent(logPath, errorEntry)
+	assert.Equal(t, "error one", got)
+	got, _ = parseContent(logPath, warningEntry)
+	assert.Equal(t, "warning one", got, "each entry has its own offset")
+
+	appendFile(t, logPath, "warning two\nerror two\n")
+	got, _ = parseContent(logPath, warningEntry)
+	assert.Equal(t, "warning two", got)
+	got, _ = parseContent(logPath, errorEntry)
+	assert.Equal(t, "error two", got)
+}
+
+func TestReadTailUsesOffsetSavedByPath(t *testing.T) {
+	logPath := setupTailTest(t)
+	appendFile(t, logPath, "old\n")
+	readTail(logPath, "", 0)
+	assert.NoError(t, SaveTailOffsets())
+
+	appendFile(t, logPath, "new\n")
+	got, _ := readTail(logPath, "log", 0)
+	assert.Equal(t, "new\n", got, "an offset saved by path is used by an entry with a monitor tag")
+}
@@ -0,0 +1,30 @@
+<?php
+return array(
+    'environment' => array(
+        'hostname' => 'swarm.example.com',
+    ),
+    'p4' => array(
+        'port'     => 'ssl:perforce.example.com:1666',
+        'user'     => 'swarm',
+        'password' => 'A1B2C3D4E5F6A7B8C9D0E1F2A3B4C5D6',
+    ),
+    'mail' => array(
+        'transport' => array(
+            'host' => 'smtp.example.com',
+            'connection_config' => array(
+                'username' => 'swarm@example.com',
+                'password' => 'smtp-s3cret',
+            ),
+        ),
+    ),
+    'jira' => array(
+        'host'     => 'https://jira.example.com',
+        'user'     => 'jira-bot',
+        'password' => 'jira-s3cret',
+    ),
+    'slack' => array(
+        "token"          => "xoxb-s3cret",
+        'signing_secret' => "slack-s3cret\"quoted",
+        'bot_name'       => 'swarm',
+    ),
+);
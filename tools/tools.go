@@ -3,22 +3,104 @@ package tools
 import (
 	"command-runner/schema"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 )
 
+// Result status values
+const (
+	StatusOK      = "ok"
+	StatusError   = "error"
+	StatusTimeout = "timeout"
+	StatusSkipped = "skipped"
+)
+
+// Result source kinds
+const (
+	SourceOSCommand = "os_command"
+	SourceP4Command = "p4_command"
+	SourceFile      = "file"
+	SourceCloud     = "cloud"
+	SourceAutobot   = "autobot"
+)
+
+// JSONData is a single collected result. Output and Stderr are Base64 encoded.
 type JSONData struct {
-	Command     string `json:"command"`
-	Description string `json:"description"`
-	Output      string `json:"output"`
-	MonitorTag  string `json:"monitor_tag"`
+	Command     string    `json:"command"`
+	Description string    `json:"description"`
+	Output      string    `json:"output"`
+	MonitorTag  string    `json:"monitor_tag"`
+	Stderr      string    `json:"stderr,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	Status      string    `json:"status"`
+	ExitCode    int       `json:"exit_code"`
+	StartTime   time.Time `json:"start_time"`
+	EndTime     time.Time `json:"end_time"`
+	DurationMs  int64     `json:"duration_ms"`
+	Hostname    string    `json:"hostname"`
+	Instance    string    `json:"instance,omitempty"`
+	Source      string    `json:"source"`
+	Redactions  int       `json:"redactions,omitempty"` // Number of secrets masked by the scrubber
+}
+
+var hostname = getHostname()
+
+func getHostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		logrus.Warnf("Unable to determine hostname: %v", err)
+		return ""
+	}
+	return name
+}
+
+// newResult returns an ok entry stamped with the host, source, SDP instance and timing common to every result.
+// The end time is taken as now.
+func newResult(source, instance string, start time.Time) JSONData {
+	end := time.Now()
+	return JSONData{
+		Status:     StatusOK,
+		StartTime:  start,
+		EndTime:    end,
+		DurationMs: end.Sub(start).Milliseconds(),
+		Hostname:   hostname,
+		Instance:   instance,
+		Source:     source,
+	}
+}
+
+// setError records err on the entry. Commands killed for running too long are marked as timed out.
+func (d *JSONData) setError(err error) {
+	if err == nil {
+		return
+	}
+	d.Status = StatusError
+	if errors.Is(err, ErrCommandTimeout) {
+		d.Status = StatusTimeout
+	}
+	d.Error = err.Error()
+	d.ExitCode = exitCode(err)
+}
+
+// exitCode returns the process exit code carried by err, 0 for no error or -1 when there is none
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
 }
 
 // Global variables to store the states
@@ -100,7 +182,7 @@ func EncodeToBase64(input string) string {
 }
 
 // TODO processSDP Instances or global ProcessALLSDP (spelling) but probably want to change this
-func GetSDPInstances(OutputJSONFilePath string, autobotsArg bool, processAllSDPInstances bool, debug bool) error {
+func GetSDPInstances(collector *Collector, autobotsArg bool, processAllSDPInstances bool, debug bool) error {
 
 	logrus.Debugf("Finding p4d instances")
 
@@ -130,21 +212,30 @@ func GetSDPInstances(OutputJSONFilePath string, autobotsArg bool, processAllSDPI
 	}
 	logrus.Debugf("Found %d SDP instances", instanceCount)
 
-	// Loop through each instance and call workSDPInstance function
-	for _, instanceArg := range sdpInstanceList {
-		if processAllSDPInstances {
-			HandleSDPInstance(OutputJSONFilePath, instanceArg, autobotsArg, debug)
-		}
+	if !processAllSDPInstances {
+		return nil
+	}
+
+	// Instances are processed concurrently. Each one collects into its own collector so their results
+	// cannot interleave, and those are merged in instance order afterwards.
+	instanceCollectors := make([]*Collector, instanceCount)
+	runParallel(instanceCount, func(i int) {
+		instanceCollectors[i] = NewCollector()
+		HandleSDPInstance(instanceCollectors[i], sdpInstanceList[i], autobotsArg, debug)
+	})
+
+	for _, instanceCollector := range instanceCollectors {
+		collector.Merge(instanceCollector)
 	}
 
 	return nil
 }
 
 // TODO probably doesn't need debug bool here any more
-func HandleSDPInstance(OutputJSONFilePath string, instanceArg string, autobotsArg bool, debug bool) error {
+func HandleSDPInstance(collector *Collector, instanceArg string, autobotsArg bool, debug bool) error {
 
 	// Pass the obtained instance to HandleP4Commands
-	if err := HandleP4Commands(instanceArg, OutputJSONFilePath); err != nil {
+	if err := HandleP4Commands(instanceArg, collector); err != nil {
 		logrus.Errorf("Error handling P4 commands for instance %s: %v", instanceArg, err)
 		// was fatal but changed to error
 	}
@@ -153,7 +244,7 @@ func HandleSDPInstance(OutputJSONFilePath string, instanceArg string, autobotsAr
 	// If autobotsArg is true, run the HandleAutobotsScripts
 	if autobotsArg {
 		logrus.Infof("Running P4 SDP autobots...")
-		HandleSDPinstanceAutobotsScripts(OutputJSONFilePath, instanceArg)
+		HandleSDPinstanceAutobotsScripts(collector, instanceArg)
 	}
 	return nil //TODO Sus
 }